@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// systemd socket activation (LISTEN_PID, LISTEN_FDS)
+//
+// With a dns_fwd.socket unit holding ListenDatagram=53 and ListenStream=53,
+// systemd binds port 53 and the service can run unprivileged. The passed
+// sockets replace LISTEN_ADDR and LISTEN_PROTO; stream sockets serve TCP,
+// datagram sockets UDP.
+// ---------------------------------------------
+
+// listenFDsStart is the first file descriptor systemd passes (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// activatedDNSServers returns a server for every socket systemd passed
+// to this process, or nil when it was not socket-activated. The
+// variables are unset so children don't pick the sockets up.
+func activatedDNSServers() ([]*dns.Server, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", fds)
+	}
+
+	var servers []*dns.Server
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		server, err := activatedDNSServer(fd)
+		if err != nil {
+			return nil, fmt.Errorf("socket fd %d: %w", fd, err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// activatedDNSServer wraps the socket fd in a server for its network.
+func activatedDNSServer(fd int) (*dns.Server, error) {
+	f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+	defer f.Close() // the listener or conn holds its own duplicate
+
+	if l, err := net.FileListener(f); err == nil {
+		return &dns.Server{Listener: l, Addr: l.Addr().String(), Net: "tcp"}, nil
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("neither a stream nor a datagram socket: %w", err)
+	}
+	return &dns.Server{PacketConn: pc, Addr: pc.LocalAddr().String(), Net: "udp"}, nil
+}
+
+// serveDNS starts server on its passed-in socket, if any, or by binding
+// its address.
+func serveDNS(server *dns.Server) error {
+	if server.Listener != nil || server.PacketConn != nil {
+		return server.ActivateAndServe()
+	}
+	return server.ListenAndServe()
+}
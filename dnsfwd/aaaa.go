@@ -0,0 +1,110 @@
+package dnsfwd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// AAAA handling (AAAA_MODE, DNS64_PREFIX)
+// ---------------------------------------------
+
+const (
+	aaaaModeNormal     = "normal"            // forward AAAA like any other type
+	aaaaModeEmpty      = "empty"             // answer NODATA locally, e.g. on IPv4-only networks
+	aaaaModeSynthesize = "synthesize-from-a" // DNS64: build AAAA from A when there is none
+)
+
+// aaaaAnswer returns the local reply to an AAAA query for a name in cfg,
+// or nil when the query should be forwarded as usual.
+func (h *DNSHandler) aaaaAnswer(req *dns.Msg, cfg *ZoneConfig) *dns.Msg {
+	if req.Question[0].Qtype != dns.TypeAAAA || h.aaaaMode != aaaaModeEmpty {
+		return nil
+	}
+
+	return h.zoneErrorResponse(req, dns.RcodeSuccess, cfg)
+}
+
+// parseDNS64Prefix parses DNS64_PREFIX, an IPv6 prefix of one of the
+// lengths RFC 6052 defines an embedding for.
+func parseDNS64Prefix(prefix string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid DNS64_PREFIX %q (want an IPv6 prefix such as 64:ff9b::/96)", prefix)
+	}
+
+	switch ones, _ := ipNet.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+		return ipNet, nil
+	default:
+		return nil, fmt.Errorf("invalid DNS64_PREFIX %q (length must be 32, 40, 48, 56, 64 or 96)", prefix)
+	}
+}
+
+// embedIPv4 returns v4 embedded into prefix as laid out by RFC 6052 2.2:
+// the address follows the prefix, skipping bits 64-71 (the "u" octet).
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// synthesizeAAAA implements DNS64 for a forwarded AAAA query m: when resp
+// succeeded without any AAAA record, the same name is asked for A and the
+// answer comes back with every A turned into an AAAA under DNS64_PREFIX.
+// Otherwise resp is returned as is.
+func (h *DNSHandler) synthesizeAAAA(ctx context.Context, m, resp *dns.Msg, cfg *ZoneConfig) *dns.Msg {
+	if h.dns64 == nil || m.Question[0].Qtype != dns.TypeAAAA || resp.Rcode != dns.RcodeSuccess {
+		return resp
+	}
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return resp
+		}
+	}
+
+	aReq := m.Copy()
+	aReq.Id = dns.Id()
+	aReq.Question[0].Qtype = dns.TypeA
+
+	aResp, _, err := h.forwardQuery(ctx, aReq, cfg)
+	if err != nil || aResp.Rcode != dns.RcodeSuccess {
+		slog.Debug("DNS64 A lookup failed", "zone", cfg.Zone, "name", m.Question[0].Name, "error", err)
+		return resp
+	}
+
+	var answer []dns.RR
+	synthesized := false
+	for _, rr := range aResp.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			answer = append(answer, rr)
+			continue
+		}
+		hdr := a.Hdr
+		hdr.Rrtype = dns.TypeAAAA
+		answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(h.dns64, a.A)})
+		synthesized = true
+	}
+	if !synthesized {
+		return resp
+	}
+
+	resp.Answer = answer
+	resp.Ns = nil
+	return resp
+}
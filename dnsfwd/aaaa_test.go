@@ -0,0 +1,114 @@
+package dnsfwd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAAAAMode(t *testing.T) {
+	records := map[string][]dns.RR{
+		"systemd-web. A":    {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+		"systemd-web. AAAA": {mustRR("systemd-web. 30 IN AAAA fd00::5")},
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		fwd := &stubForwarder{records: records}
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.AAAAMode = aaaaModeNormal
+		})
+
+		resp := exchange(t, h, "web.pod.example.", dns.TypeAAAA)
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeAAAA {
+			t.Errorf("AAAA answer = %v, want the upstream's", resp.Answer)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		fwd := &stubForwarder{records: records}
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.AAAAMode = aaaaModeEmpty
+		})
+
+		resp := exchange(t, h, "web.pod.example.", dns.TypeAAAA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Errorf("AAAA reply = %v, want NODATA", resp)
+		}
+		if owner := soaOwner(resp); owner != "pod.example." {
+			t.Errorf("SOA owner = %q, want pod.example.", owner)
+		}
+		if got := fwd.names(); len(got) != 0 {
+			t.Errorf("upstream queries = %v, want none", got)
+		}
+
+		// A is unaffected
+		if resp := exchange(t, h, "web.pod.example.", dns.TypeA); len(resp.Answer) != 1 {
+			t.Errorf("A answer = %v, want the upstream's", resp.Answer)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, configure := range []func(*Config){
+			func(c *Config) { c.AAAAMode = "block" },
+			func(c *Config) { c.AAAAMode = aaaaModeSynthesize },
+			func(c *Config) { c.AAAAMode = aaaaModeEmpty; c.DNS64Prefix = "64:ff9b::/96" },
+		} {
+			cfg := DefaultConfig()
+			configure(&cfg)
+			if _, err := NewHandler(cfg); err == nil {
+				t.Errorf("NewHandler with AAAA_MODE=%q DNS64_PREFIX=%q succeeded", cfg.AAAAMode, cfg.DNS64Prefix)
+			}
+		}
+	})
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	// RFC 6052 2.4's examples for 192.0.2.33
+	tests := []struct{ prefix, want string }{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		prefix, err := parseDNS64Prefix(tt.prefix)
+		if err != nil {
+			t.Fatalf("parseDNS64Prefix(%q): %v", tt.prefix, err)
+		}
+		if got := embedIPv4(prefix, net.ParseIP("192.0.2.33")); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("embedIPv4(%s, 192.0.2.33) = %s, want %s", tt.prefix, got, tt.want)
+		}
+	}
+
+	for _, prefix := range []string{"64:ff9b::/80", "10.0.0.0/8", "64:ff9b::"} {
+		if _, err := parseDNS64Prefix(prefix); err == nil {
+			t.Errorf("parseDNS64Prefix(%q) succeeded", prefix)
+		}
+	}
+}
+
+func TestServeDNSDNS64(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A":    {mustRR("systemd-web. 30 IN A 192.0.2.33")},
+		"systemd-web. AAAA": {},
+		"systemd-v6. AAAA":  {mustRR("systemd-v6. 30 IN AAAA 2001:db8::6")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.DNS64Prefix = "64:ff9b::/96"
+	})
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeAAAA)
+	want := []string{"web.pod.example.\t300\tIN\tAAAA\t64:ff9b::c000:221"}
+	if got := rrStrings(resp.Answer); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("answer = %v, want %v", got, want)
+	}
+
+	// A real AAAA record is returned as is
+	resp = exchange(t, h, "v6.pod.example.", dns.TypeAAAA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::6")) {
+		t.Errorf("answer = %v, want the upstream's AAAA", resp.Answer)
+	}
+}
@@ -0,0 +1,79 @@
+package dnsfwd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Client ACL (ALLOW_CIDRS)
+// ---------------------------------------------
+
+// parseCIDRs parses a CIDR list, skipping empty entries. Bare IPs are
+// accepted as single-host networks.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// clientIP extracts the client address from w, or nil if unknown.
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// clientAllowed reports whether ip may query us. An empty ACL allows all.
+func (h *DNSHandler) clientAllowed(ip net.IP) bool {
+	if len(h.allowNets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range h.allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package dnsfwd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// serveFrom hands a query for name to h over UDP from client ip and
+// returns the reply.
+func serveFrom(t *testing.T, h *DNSHandler, ip, name string) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000}}
+	h.ServeDNS(w, req)
+	if w.msg == nil {
+		t.Fatalf("no reply to %s from %s", name, ip)
+	}
+	return w.msg
+}
+
+func TestClientACL(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.AllowCIDRs = []string{"10.0.0.0/8", "fd00::/8", "192.0.2.1"}
+	})
+
+	tests := []struct {
+		client  string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true}, // IPv4-mapped
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"172.16.0.1", false},
+		{"fd00::53", true},
+		{"fe80::1", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		resp := serveFrom(t, h, tt.client, "web.pod.example.")
+		if allowed := resp.Rcode != dns.RcodeRefused; allowed != tt.allowed {
+			t.Errorf("client %s: rcode %s, allowed = %v, want %v", tt.client, dns.RcodeToString[resp.Rcode], allowed, tt.allowed)
+		}
+	}
+	if n := len(fwd.names()); n != 4 {
+		t.Errorf("%d upstream queries, want one per allowed client", n)
+	}
+}
+
+func TestClientACLEmptyAllowsAll(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{})
+
+	for _, client := range []string{"203.0.113.1", "2001:db8::1"} {
+		if resp := serveFrom(t, h, client, "pod.example."); resp.Rcode == dns.RcodeRefused {
+			t.Errorf("client %s refused without ALLOW_CIDRS", client)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", " ", "192.0.2.1", "fd00::1"})
+	if err != nil {
+		t.Fatalf("parseCIDRs: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "fd00::1/128"}
+	if len(nets) != len(want) {
+		t.Fatalf("parseCIDRs = %v, want %v", nets, want)
+	}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("net %d = %s, want %s", i, n, want[i])
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "fd00::/129"} {
+		if _, err := parseCIDRs([]string{bad}); err == nil {
+			t.Errorf("parseCIDRs(%q) succeeded", bad)
+		}
+	}
+}
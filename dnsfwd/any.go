@@ -0,0 +1,42 @@
+package dnsfwd
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// ANY queries (ANY_MODE)
+// ---------------------------------------------
+
+const (
+	anyModeRefuse   = "refuse"   // RFC 8482: a single synthesized HINFO record
+	anyModeForward  = "forward"  // forward and rewrite like an allowed type
+	anyModeNXDomain = "nxdomain" // answer NXDOMAIN locally
+)
+
+// anyAnswer returns the local reply to an ANY query for a name in cfg, or
+// nil when ANY_MODE forwards it. The apex exists, so it gets NODATA
+// rather than NXDOMAIN.
+func (h *DNSHandler) anyAnswer(req *dns.Msg, cfg *ZoneConfig, isApex bool) *dns.Msg {
+	if req.Question[0].Qtype != dns.TypeANY {
+		return nil
+	}
+
+	switch h.anyMode {
+	case anyModeRefuse:
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: h.zoneAnswerTTL(cfg)},
+			Cpu: "RFC8482",
+		})
+		return m
+	case anyModeNXDomain:
+		if isApex {
+			return h.zoneErrorResponse(req, dns.RcodeSuccess, cfg)
+		}
+		return h.zoneErrorResponse(req, dns.RcodeNameError, cfg)
+	default:
+		return nil
+	}
+}
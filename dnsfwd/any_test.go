@@ -0,0 +1,68 @@
+package dnsfwd
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSAnyRefuse(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	for _, name := range []string{"web.pod.example.", "pod.example."} {
+		resp := exchange(t, h, name, dns.TypeANY)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: rcode = %s, want NOERROR", name, dns.RcodeToString[resp.Rcode])
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%s: answer = %v, want one HINFO", name, resp.Answer)
+			continue
+		}
+		hinfo, ok := resp.Answer[0].(*dns.HINFO)
+		if !ok || hinfo.Hdr.Name != name || hinfo.Cpu != "RFC8482" {
+			t.Errorf("%s: answer = %v, want the RFC 8482 HINFO", name, resp.Answer[0])
+		}
+	}
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+}
+
+func TestServeDNSAnyModes(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. ANY": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.AnyMode = anyModeForward
+	})
+	resp := exchange(t, h, "web.pod.example.", dns.TypeANY)
+	if got := rrStrings(resp.Answer); len(got) != 1 || got[0] != "web.pod.example.\t300\tIN\tA\t10.0.0.5" {
+		t.Errorf("forward: answer = %v, want the rewritten upstream A", got)
+	}
+	if got := fwd.names(); len(got) != 1 || got[0] != "systemd-web." {
+		t.Errorf("forward: upstream queries = %v, want [systemd-web.]", got)
+	}
+
+	h = newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{}, func(c *Config) {
+		c.AnyMode = anyModeNXDomain
+	})
+	tests := []struct {
+		name      string
+		wantRcode int
+	}{
+		{"web.pod.example.", dns.RcodeNameError},
+		// The apex exists: NODATA
+		{"pod.example.", dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		resp := exchange(t, h, tt.name, dns.TypeANY)
+		if resp.Rcode != tt.wantRcode || len(resp.Answer) != 0 {
+			t.Errorf("nxdomain: %s reply = %v, want %s without answers", tt.name, resp, dns.RcodeToString[tt.wantRcode])
+		}
+		if owner := soaOwner(resp); owner != "pod.example." {
+			t.Errorf("nxdomain: %s SOA owner = %q, want pod.example.", tt.name, owner)
+		}
+	}
+}
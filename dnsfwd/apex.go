@@ -0,0 +1,43 @@
+package dnsfwd
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Zone apex answers (APEX_MODE)
+// ---------------------------------------------
+
+const (
+	apexModeSOA = "soa" // authoritative: the local SOA and NS, NODATA otherwise
+	apexModeNS  = "ns"  // delegation point: a referral to SOA_MNAME with glue
+)
+
+// apexAnswer returns the local reply to req for cfg's apex, authoritative
+// per AUTHORITATIVE. With APEX_MODE=ns every query gets a referral, the NS
+// RRset in the authority section, which is not an authoritative answer.
+func (h *DNSHandler) apexAnswer(req *dns.Msg, cfg *ZoneConfig) *dns.Msg {
+	ttl := h.zoneAnswerTTL(cfg)
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeSuccess)
+	m.Authoritative = h.authoritative
+
+	if h.apexMode == apexModeNS {
+		m.Authoritative = false
+		m.Ns = append(m.Ns, h.createLocalNS(cfg.Zone, ttl))
+		m.Extra = append(m.Extra, h.nsGlue(ttl)...)
+		return m
+	}
+
+	switch req.Question[0].Qtype {
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, h.createLocalSOA(cfg.Zone, h.zoneNegativeTTL(cfg)))
+	case dns.TypeNS:
+		m.Answer = append(m.Answer, h.createLocalNS(cfg.Zone, ttl))
+		m.Extra = append(m.Extra, h.nsGlue(ttl)...)
+	default:
+		return h.zoneErrorResponse(req, dns.RcodeSuccess, cfg)
+	}
+	return m
+}
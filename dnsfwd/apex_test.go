@@ -0,0 +1,95 @@
+package dnsfwd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestApexNS(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.SOAMname = "ns1.example.net."
+		c.NSAddrs = []string{"192.0.2.53", "2001:db8::53"}
+	})
+
+	resp := exchange(t, h, "Pod.Example.", dns.TypeNS)
+	if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative {
+		t.Errorf("rcode %s, AA %v, want an authoritative NOERROR", dns.RcodeToString[resp.Rcode], resp.Authoritative)
+	}
+	want := []string{"pod.example.\t300\tIN\tNS\tns1.example.net."}
+	if got := rrStrings(resp.Answer); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("answer = %v, want %v", got, want)
+	}
+	wantGlue := []string{
+		"ns1.example.net.\t300\tIN\tA\t192.0.2.53",
+		"ns1.example.net.\t300\tIN\tAAAA\t2001:db8::53",
+	}
+	if got := rrStrings(resp.Extra); len(got) != 2 || got[0] != wantGlue[0] || got[1] != wantGlue[1] {
+		t.Errorf("additional = %v, want %v", got, wantGlue)
+	}
+
+	// Without NS_ADDRS the NS comes alone
+	h = newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+	if resp := exchange(t, h, "pod.example.", dns.TypeNS); len(resp.Extra) != 0 {
+		t.Errorf("additional = %v without NS_ADDRS, want none", resp.Extra)
+	}
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+}
+
+func TestApexMode(t *testing.T) {
+	// The types in each section of the reply
+	type sections struct {
+		answer, ns, extra []uint16
+	}
+	types := func(rrs []dns.RR) []uint16 {
+		var out []uint16
+		for _, rr := range rrs {
+			out = append(out, rr.Header().Rrtype)
+		}
+		return out
+	}
+	glue := []uint16{dns.TypeA, dns.TypeAAAA}
+	referral := sections{ns: []uint16{dns.TypeNS}, extra: glue}
+
+	tests := []struct {
+		mode     string
+		qtype    uint16
+		want     sections
+		wantAuth bool
+	}{
+		{apexModeSOA, dns.TypeSOA, sections{answer: []uint16{dns.TypeSOA}}, true},
+		{apexModeSOA, dns.TypeNS, sections{answer: []uint16{dns.TypeNS}, extra: glue}, true},
+		{apexModeNS, dns.TypeSOA, referral, false},
+		{apexModeNS, dns.TypeNS, referral, false},
+	}
+	for _, tt := range tests {
+		fwd := &stubForwarder{}
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.ApexMode = tt.mode
+			c.SOAMname = "ns1.example.net."
+			c.NSAddrs = []string{"192.0.2.53", "2001:db8::53"}
+		})
+
+		resp := exchange(t, h, "pod.example.", tt.qtype)
+		name := tt.mode + " " + dns.TypeToString[tt.qtype]
+		if resp.Rcode != dns.RcodeSuccess || resp.Authoritative != tt.wantAuth {
+			t.Errorf("%s: rcode %s, AA %v, want NOERROR, AA %v", name, dns.RcodeToString[resp.Rcode], resp.Authoritative, tt.wantAuth)
+		}
+		got := sections{types(resp.Answer), types(resp.Ns), types(resp.Extra)}
+		if !slices.Equal(got.answer, tt.want.answer) || !slices.Equal(got.ns, tt.want.ns) || !slices.Equal(got.extra, tt.want.extra) {
+			t.Errorf("%s: sections %v, want %v", name, got, tt.want)
+		}
+		if tt.mode == apexModeNS && len(resp.Ns) == 1 {
+			if ns, ok := resp.Ns[0].(*dns.NS); !ok || ns.Hdr.Name != "pod.example." || ns.Ns != "ns1.example.net." {
+				t.Errorf("%s: referral %v, want pod.example. NS ns1.example.net.", name, resp.Ns[0])
+			}
+		}
+		if got := fwd.names(); len(got) != 0 {
+			t.Errorf("%s: upstream queries = %v, want none", name, got)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package dnsfwd
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Upstream selection (BALANCE_MODE)
+// ---------------------------------------------
+
+const (
+	balanceFirst      = "first"       // always in configured order
+	balanceRoundRobin = "round-robin" // rotate the first upstream per query
+	balanceRandom     = "random"      // start at a random upstream
+	balanceLatency    = "latency"     // lowest latency EWMA first
+)
+
+// Latency EWMA tuning: each sample moves the average by latencyWeight,
+// and an upstream that gets no queries has its average halved every
+// latencyHalfLife, so one that was slow gets tried again eventually.
+const (
+	latencyWeight   = 0.3
+	latencyHalfLife = 30 * time.Second
+)
+
+func isBalanceMode(mode string) bool {
+	switch mode {
+	case balanceFirst, balanceRoundRobin, balanceRandom, balanceLatency:
+		return true
+	}
+	return false
+}
+
+func (h *DNSHandler) zoneBalance(cfg *ZoneConfig) string {
+	if cfg.Balance != "" {
+		return cfg.Balance
+	}
+	return h.balance
+}
+
+// upstreamOrder returns cfg's upstreams in the order forwardQuery should
+// try them. Upstreams the probe saw down are skipped, unless all of them
+// are, in which case they're all tried anyway.
+func (h *DNSHandler) upstreamOrder(cfg *ZoneConfig) []string {
+	if len(cfg.Upstreams) <= 1 {
+		return cfg.Upstreams
+	}
+
+	candidates := make([]string, 0, len(cfg.Upstreams))
+	for i, upstream := range cfg.Upstreams {
+		if cfg.state.up(i) {
+			candidates = append(candidates, upstream)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, cfg.Upstreams...)
+	}
+
+	n := len(candidates)
+	start := 0
+	switch h.zoneBalance(cfg) {
+	case balanceLatency:
+		// Stable, so equally fast (or unmeasured) upstreams keep their order
+		now := time.Now()
+		rtts := make(map[string]time.Duration, n)
+		for _, upstream := range candidates {
+			rtts[upstream] = cfg.state.latency(slices.Index(cfg.Upstreams, upstream), now)
+		}
+		slices.SortStableFunc(candidates, func(a, b string) int {
+			return int(rtts[a] - rtts[b])
+		})
+	case balanceRoundRobin:
+		if cfg.state != nil {
+			start = int((cfg.state.next.Add(1) - 1) % uint32(n))
+		}
+	case balanceRandom:
+		start = rand.IntN(n)
+	}
+
+	order := make([]string, 0, n)
+	order = append(order, candidates[start:]...)
+	return append(order, candidates[:start]...)
+}
+
+// latency returns upstream i's latency EWMA, decayed for the time since
+// its last sample.
+func (s *zoneState) latency(i int, now time.Time) time.Duration {
+	if s == nil || i < 0 || i >= len(s.upstreams) {
+		return 0
+	}
+
+	u := &s.upstreams[i]
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.decayed(now)
+}
+
+func (u *upstreamState) decayed(now time.Time) time.Duration {
+	if u.rtt == 0 {
+		return 0
+	}
+	halvings := float64(now.Sub(u.sampled)) / float64(latencyHalfLife)
+	return time.Duration(float64(u.rtt) * math.Exp2(-halvings))
+}
+
+// observeLatency folds one exchange with upstream i, taking rtt, into its
+// EWMA. Failed exchanges are recorded by the caller as a full timeout.
+func (s *zoneState) observeLatency(i int, rtt time.Duration, now time.Time) {
+	if s == nil || i < 0 || i >= len(s.upstreams) {
+		return
+	}
+
+	u := &s.upstreams[i]
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if prev := u.decayed(now); prev == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = prev + time.Duration(latencyWeight*float64(rtt-prev))
+	}
+	if u.rtt <= 0 {
+		u.rtt = 1 // keep it measured
+	}
+	u.sampled = now
+}
+
+// shuffleAnswers randomizes the order of the A records, and separately of
+// the AAAA records, in answer, keeping every other record in its place so
+// CNAME chains still come first (SHUFFLE_ANSWERS).
+func shuffleAnswers(answer []dns.RR) {
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var idx []int
+		for i, rr := range answer {
+			if rr.Header().Rrtype == rrtype {
+				idx = append(idx, i)
+			}
+		}
+		rand.Shuffle(len(idx), func(i, j int) {
+			answer[idx[i]], answer[idx[j]] = answer[idx[j]], answer[idx[i]]
+		})
+	}
+}
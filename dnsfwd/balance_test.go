@@ -0,0 +1,188 @@
+package dnsfwd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// firstUpstreams counts, over n calls of upstreamOrder for zone, how
+// often each upstream came first.
+func firstUpstreams(h *DNSHandler, zone string, n int) map[string]int {
+	cfg, _, _ := h.selectZoneForName(zone)
+	counts := make(map[string]int)
+	for range n {
+		counts[h.upstreamOrder(cfg)[0]]++
+	}
+	return counts
+}
+
+const threeUpstreams = "pod.example.=udp:10.0.0.1:53;10.0.0.2:53;10.0.0.3:53"
+
+func TestBalanceFirst(t *testing.T) {
+	h := newTestHandler(t, threeUpstreams, &stubForwarder{})
+
+	counts := firstUpstreams(h, "pod.example.", 100)
+	if counts["10.0.0.1:53"] != 100 {
+		t.Errorf("first upstreams = %v, want 10.0.0.1:53 every time", counts)
+	}
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	h := newTestHandler(t, threeUpstreams+"?balance=round-robin", &stubForwarder{})
+
+	cfg, _, _ := h.selectZoneForName("pod.example.")
+	if order := h.upstreamOrder(cfg); len(order) != 3 || order[0] != "10.0.0.1:53" || order[1] != "10.0.0.2:53" || order[2] != "10.0.0.3:53" {
+		t.Errorf("first order = %v, want configured order", order)
+	}
+	// The rest keep their order after the rotated first one
+	if order := h.upstreamOrder(cfg); order[0] != "10.0.0.2:53" || order[1] != "10.0.0.3:53" || order[2] != "10.0.0.1:53" {
+		t.Errorf("second order = %v, want rotated by one", order)
+	}
+
+	counts := firstUpstreams(h, "pod.example.", 299)
+	for _, upstream := range []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"} {
+		// 301 calls in all, 101 to 10.0.0.1 and 10.0.0.2 counting the two above
+		if n := counts[upstream]; n < 99 || n > 100 {
+			t.Errorf("%s first %d times in 299 calls, want an even share", upstream, n)
+		}
+	}
+}
+
+func TestBalanceRandom(t *testing.T) {
+	h := newTestHandler(t, threeUpstreams, &stubForwarder{}, func(c *Config) {
+		c.BalanceMode = balanceRandom
+	})
+
+	// Each share is binomial(3000, 1/3): 1000 ± 26; 800 is far out
+	counts := firstUpstreams(h, "pod.example.", 3000)
+	for _, upstream := range []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"} {
+		if n := counts[upstream]; n < 800 || n > 1200 {
+			t.Errorf("%s first %d times in 3000 calls, want about 1000", upstream, n)
+		}
+	}
+}
+
+func TestBalanceSkipsDown(t *testing.T) {
+	h := newTestHandler(t, threeUpstreams+"?balance=round-robin", &stubForwarder{})
+	cfg, _, _ := h.selectZoneForName("pod.example.")
+
+	cfg.state.setUp(1, false)
+	counts := firstUpstreams(h, "pod.example.", 100)
+	if counts["10.0.0.2:53"] != 0 || counts["10.0.0.1:53"] != 50 || counts["10.0.0.3:53"] != 50 {
+		t.Errorf("first upstreams = %v, want 10.0.0.2:53 skipped and the others even", counts)
+	}
+	if order := h.upstreamOrder(cfg); len(order) != 2 {
+		t.Errorf("order = %v, want the down upstream left out", order)
+	}
+
+	// All down: try them all anyway
+	cfg.state.setUp(0, false)
+	cfg.state.setUp(2, false)
+	if order := h.upstreamOrder(cfg); len(order) != 3 {
+		t.Errorf("order with every upstream down = %v, want all three", order)
+	}
+}
+
+func TestShuffleAnswers(t *testing.T) {
+	records := []dns.RR{mustRR("systemd-web. 30 IN CNAME systemd-lb.")}
+	for i := 1; i <= 8; i++ {
+		records = append(records, mustRR(fmt.Sprintf("systemd-lb. 30 IN A 10.0.0.%d", i)))
+	}
+	fwd := &stubForwarder{records: map[string][]dns.RR{"systemd-web. A": records}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.ShuffleAnswers = true
+	})
+
+	orders := make(map[string]bool)
+	var want []string
+	for range 20 {
+		resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+		if _, ok := resp.Answer[0].(*dns.CNAME); !ok {
+			t.Fatalf("first answer = %v, want the CNAME to stay first", resp.Answer[0])
+		}
+		got := rrStrings(resp.Answer)
+		orders[strings.Join(got, ",")] = true
+
+		sort.Strings(got)
+		if want == nil {
+			want = got
+		} else if !slices.Equal(got, want) {
+			t.Fatalf("answer set = %v, want %v", got, want)
+		}
+	}
+	// 8! orders: 20 queries all in the same one means no shuffling
+	if len(orders) < 2 {
+		t.Error("answer order never changed")
+	}
+}
+
+func TestBalanceLatency(t *testing.T) {
+	h := newTestHandler(t, threeUpstreams+"?balance=latency", &stubForwarder{})
+	cfg, _, _ := h.selectZoneForName("pod.example.")
+	now := time.Now()
+
+	// Unmeasured upstreams keep the configured order
+	if order := h.upstreamOrder(cfg); strings.Join(order, ",") != "10.0.0.1:53,10.0.0.2:53,10.0.0.3:53" {
+		t.Errorf("unmeasured order = %v, want configured order", order)
+	}
+
+	cfg.state.observeLatency(0, 100*time.Millisecond, now)
+	cfg.state.observeLatency(1, 5*time.Millisecond, now)
+	cfg.state.observeLatency(2, 30*time.Millisecond, now)
+	if order := h.upstreamOrder(cfg); strings.Join(order, ",") != "10.0.0.2:53,10.0.0.3:53,10.0.0.1:53" {
+		t.Errorf("order = %v, want fastest first", order)
+	}
+
+	// One slow sample moves the average, without replacing it
+	cfg.state.observeLatency(1, 55*time.Millisecond, now)
+	if rtt := cfg.state.latency(1, now); rtt != 20*time.Millisecond {
+		t.Errorf("EWMA = %v, want 20ms", rtt)
+	}
+
+	// The average halves every latencyHalfLife, so the slow one recovers
+	later := now.Add(latencyHalfLife)
+	if rtt := cfg.state.latency(0, later); rtt != 50*time.Millisecond {
+		t.Errorf("EWMA after one half-life = %v, want 50ms", rtt)
+	}
+}
+
+func TestBalanceLatencyPrefersFastest(t *testing.T) {
+	delays := map[string]time.Duration{
+		"10.0.0.1:53": 30 * time.Millisecond,
+		"10.0.0.2:53": time.Millisecond,
+		"10.0.0.3:53": 15 * time.Millisecond,
+	}
+	var mu sync.Mutex
+	var asked []string
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, upstream string) (*dns.Msg, error) {
+		mu.Lock()
+		asked = append(asked, upstream)
+		mu.Unlock()
+		time.Sleep(delays[upstream])
+
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		return resp, nil
+	})
+	h := newTestHandler(t, threeUpstreams, fwd, func(c *Config) {
+		c.BalanceMode = balanceLatency
+	})
+
+	for i := range 8 {
+		exchange(t, h, fmt.Sprintf("web%d.pod.example.", i), dns.TypeA)
+	}
+	// Each gets measured once while the others are unmeasured, then the
+	// fastest wins every time
+	want := "10.0.0.1:53,10.0.0.2:53,10.0.0.3:53,10.0.0.2:53,10.0.0.2:53,10.0.0.2:53,10.0.0.2:53,10.0.0.2:53"
+	if got := strings.Join(asked, ","); got != want {
+		t.Errorf("upstreams asked\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package dnsfwd
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Query path benchmarks, run with
+//
+//	go test ./dnsfwd -run '^$' -bench ServeDNS -benchmem
+//
+// against an in-memory ResponseWriter and a stub Forwarder, cache off,
+// two zones, tracing off. Each comment gives allocs/op; keep them current
+// when a change to the query path moves them.
+
+// benchHandler returns a handler for two zones whose upstream answers
+// every query with one A record, and quiets the access log for b.
+func benchHandler(b *testing.B) *DNSHandler {
+	b.Helper()
+
+	quietLog(b)
+	answer := mustRR("systemd-web. 30 IN A 10.0.0.5")
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, dns.Copy(answer))
+		return resp, nil
+	})
+	return newTestHandler(b, "pod.example.=udp:10.0.0.1:53,other.example.=udp:10.0.0.2:53", fwd)
+}
+
+// quietLog drops the info-level access log until t ends.
+func quietLog(t testing.TB) {
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+}
+
+func benchServe(b *testing.B, h *DNSHandler, name string, qtype uint16) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	w := newTestWriter("udp")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		h.ServeDNS(w, req)
+	}
+}
+
+// Local SOA at the zone apex: 15 allocs/op.
+func BenchmarkServeDNSApex(b *testing.B) {
+	benchServe(b, benchHandler(b), "pod.example.", dns.TypeSOA)
+}
+
+// NXDOMAIN for a name outside every zone: 15 allocs/op.
+func BenchmarkServeDNSNXDOMAIN(b *testing.B) {
+	benchServe(b, benchHandler(b), "web.nowhere.example.", dns.TypeA)
+}
+
+// Rewritten, forwarded and restored: 25 allocs/op, 5 of them the stub
+// Forwarder's.
+func BenchmarkServeDNSForwardRewrite(b *testing.B) {
+	benchServe(b, benchHandler(b), "web.pod.example.", dns.TypeA)
+}
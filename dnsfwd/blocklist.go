@@ -0,0 +1,132 @@
+package dnsfwd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Blocklist (BLOCKLIST, BLOCK_MODE)
+// Format:
+//   BLOCKLIST="tracker.pod.hetmer.net.,*.ads.example.com."
+//
+// A plain name blocks exactly that name; "*." blocks every name below it,
+// not the name itself, like wildcard zones. Matching is case-insensitive
+// and applies inside and outside the zones.
+// ---------------------------------------------
+
+// BLOCK_MODE values
+const (
+	blockModeNXDomain = "nxdomain"
+	blockModeSinkhole = "sinkhole" // answer A/AAAA with SINKHOLE_ADDRS
+)
+
+type blocklist struct {
+	exact   map[string]bool // lowercased names
+	parents map[string]bool // lowercased names whose subdomains are blocked
+}
+
+// parseBlocklist parses blocklist entries, skipping empty ones and "#"
+// comments.
+func parseBlocklist(entries []string) (*blocklist, error) {
+	b := &blocklist{exact: make(map[string]bool), parents: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		name := strings.ToLower(dns.Fqdn(entry))
+		parent, wildcard := strings.CutPrefix(name, "*.")
+		if _, ok := dns.IsDomainName(parent); !ok || parent == "" {
+			return nil, fmt.Errorf("invalid name %q", entry)
+		}
+		if wildcard {
+			b.parents[parent] = true
+		} else {
+			b.exact[name] = true
+		}
+	}
+	return b, nil
+}
+
+// match returns the blocklist entry covering the lowercased name: name
+// itself or the parent whose subdomains are blocked. A nil blocklist
+// blocks nothing.
+func (b *blocklist) match(name string) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	if b.exact[name] {
+		return name, true
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if parent := name[off:]; b.parents[parent] {
+			return parent, true
+		}
+	}
+	return "", false
+}
+
+// blockedAnswer answers a blocked q per BLOCK_MODE: NXDOMAIN, or the
+// sinkhole addresses, with NODATA for types or families it has none for.
+// The local SOA is the one any other negative answer for q would carry.
+func (h *DNSHandler) blockedAnswer(req *dns.Msg) *dns.Msg {
+	owner, ttl := h.blockedSOAOwner(strings.ToLower(req.Question[0].Name))
+	if h.blockMode == blockModeNXDomain {
+		m := h.errorResponse(req, dns.RcodeNameError, owner, ttl)
+		return withEDE(req, m, dns.ExtendedErrorCodeBlocked, "blocked")
+	}
+
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: h.globals.Load().answerTTL}
+	for _, ip := range h.sinkhole {
+		switch ip4 := ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(m.Answer) == 0 && owner != "" {
+		m.Ns = append(m.Ns, h.createLocalSOA(owner, ttl))
+	}
+	return withEDE(req, m, dns.ExtendedErrorCodeBlocked, "blocked")
+}
+
+// blockedSOAOwner returns the owner and negative TTL of the SOA in a
+// negative answer for the blocked, lowercased name: the origin of the zone
+// holding it, or per OUT_OF_ZONE_SOA outside every zone but the catch-all.
+func (h *DNSHandler) blockedSOAOwner(name string) (string, uint32) {
+	if cfg, ok, _ := h.selectZoneForName(name); ok && cfg.Zone != CatchAllZone {
+		return cfg.origin(), h.zoneNegativeTTL(cfg)
+	}
+	return h.outOfZoneSOAOwner(name)
+}
+
+// sinkholeAddrs checks the BLOCK_MODE and SINKHOLE_ADDRS combination.
+func sinkholeAddrs(mode string, addrs []string) ([]net.IP, error) {
+	ips, err := parseIPs(addrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SINKHOLE_ADDRS: %w", err)
+	}
+
+	switch mode {
+	case blockModeNXDomain:
+		if len(ips) > 0 {
+			return nil, fmt.Errorf("SINKHOLE_ADDRS needs BLOCK_MODE=%s", blockModeSinkhole)
+		}
+	case blockModeSinkhole:
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("BLOCK_MODE=%s needs SINKHOLE_ADDRS", blockModeSinkhole)
+		}
+	default:
+		return nil, fmt.Errorf("invalid BLOCK_MODE: %s", mode)
+	}
+	return ips, nil
+}
@@ -0,0 +1,108 @@
+package dnsfwd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlocklistMatch(t *testing.T) {
+	b, err := parseBlocklist([]string{"Tracker.Pod.Example", "# comment", " ", "*.ads.example."})
+	if err != nil {
+		t.Fatalf("parseBlocklist: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		wantEntry string
+		wantOK    bool
+	}{
+		{"tracker.pod.example.", "tracker.pod.example.", true},
+		{"x.tracker.pod.example.", "", false},
+		{"x.ads.example.", "ads.example.", true},
+		{"a.b.ads.example.", "ads.example.", true},
+		{"ads.example.", "", false}, // "*." blocks below the parent only
+		{"web.pod.example.", "", false},
+	}
+	for _, tt := range tests {
+		entry, ok := b.match(tt.name)
+		if entry != tt.wantEntry || ok != tt.wantOK {
+			t.Errorf("match(%q) = %q, %v, want %q, %v", tt.name, entry, ok, tt.wantEntry, tt.wantOK)
+		}
+	}
+
+	if _, err := parseBlocklist([]string{"*."}); err == nil {
+		t.Error(`parseBlocklist("*.") succeeded, want an error`)
+	}
+}
+
+// soaOwner returns the owner of the SOA in m's authority section, or ""
+// without one.
+func soaOwner(m *dns.Msg) string {
+	for _, rr := range m.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return rr.Header().Name
+		}
+	}
+	return ""
+}
+
+func TestBlockedAnswerNXDOMAIN(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.Blocklist = []string{"tracker.pod.example.", "*.ads.example."}
+	})
+
+	tests := []struct {
+		name      string
+		wantOwner string
+	}{
+		// The zone's own SOA, not one owned by the blocklist entry
+		{"tracker.pod.example.", "pod.example."},
+		// Outside every zone, OUT_OF_ZONE_SOA as for any other name there
+		{"x.ads.example.", "invalid."},
+	}
+	for _, tt := range tests {
+		resp := exchange(t, h, tt.name, dns.TypeA)
+		if resp.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: rcode = %s, want NXDOMAIN", tt.name, dns.RcodeToString[resp.Rcode])
+		}
+		if owner := soaOwner(resp); owner != tt.wantOwner {
+			t.Errorf("%s: SOA owner = %q, want %q", tt.name, owner, tt.wantOwner)
+		}
+	}
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+}
+
+func TestBlockedAnswerSinkhole(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.Blocklist = []string{"tracker.pod.example.", "*.ads.example."}
+		c.BlockMode = blockModeSinkhole
+		c.SinkholeAddrs = []string{"0.0.0.0"}
+		c.OutOfZoneSOA = outOfZoneSOANone
+	})
+
+	a := exchange(t, h, "tracker.pod.example.", dns.TypeA)
+	if len(a.Answer) != 1 || !a.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Errorf("A answer = %v, want the sinkhole address", a.Answer)
+	}
+
+	// No IPv6 sinkhole: NODATA with the zone's SOA
+	aaaa := exchange(t, h, "tracker.pod.example.", dns.TypeAAAA)
+	if aaaa.Rcode != dns.RcodeSuccess || len(aaaa.Answer) != 0 {
+		t.Errorf("AAAA reply = %v, want NODATA", aaaa)
+	}
+	if owner := soaOwner(aaaa); owner != "pod.example." {
+		t.Errorf("AAAA SOA owner = %q, want pod.example.", owner)
+	}
+
+	// Outside every zone with OUT_OF_ZONE_SOA=none: NODATA without a SOA
+	out := exchange(t, h, "x.ads.example.", dns.TypeAAAA)
+	if out.Rcode != dns.RcodeSuccess || len(out.Answer) != 0 || len(out.Ns) != 0 {
+		t.Errorf("out-of-zone AAAA reply = %v, want NODATA without authority", out)
+	}
+}
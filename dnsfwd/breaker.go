@@ -0,0 +1,83 @@
+package dnsfwd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ---------------------------------------------
+// Upstream circuit breaker (BREAKER_THRESHOLD, BREAKER_COOLDOWN)
+//
+// After BREAKER_THRESHOLD consecutive failed exchanges an upstream's
+// breaker opens and forwardQuery skips it for BREAKER_COOLDOWN. Then it's
+// half-open: one query gets through as a trial, re-opening the breaker on
+// failure and closing it on success, as does any successful probe.
+// ---------------------------------------------
+
+// errBreakerOpen is returned by forwardQuery, wrapped in a
+// *breakerOpenError, when every upstream's breaker was open.
+var errBreakerOpen = errors.New("all upstreams in backoff")
+
+// breakerOpenError carries when the first of the skipped upstreams is
+// tried again.
+type breakerOpenError struct {
+	retryAt time.Time
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("%v, retry in %s", errBreakerOpen, e.retryIn(time.Now()))
+}
+
+func (e *breakerOpenError) Unwrap() error { return errBreakerOpen }
+
+// retryIn is the time left until retryAt, rounded up to whole seconds.
+func (e *breakerOpenError) retryIn(now time.Time) time.Duration {
+	return (max(e.retryAt.Sub(now), 0) + time.Second - 1).Truncate(time.Second)
+}
+
+// breakerAllows reports whether upstream i may be asked at now. An open
+// breaker says no until the cooldown ends, returning when that is; the
+// first caller after it gets the half-open trial, pushing the end out by
+// another cooldown so concurrent queries keep skipping the upstream.
+func (s *zoneState) breakerAllows(i int, now time.Time, threshold uint32, cooldown time.Duration) (bool, time.Time) {
+	if s == nil || threshold == 0 || i < 0 || i >= len(s.upstreams) {
+		return true, time.Time{}
+	}
+
+	u := &s.upstreams[i]
+	if u.failures.Load() < threshold {
+		return true, time.Time{}
+	}
+	until := u.openUntil.Load()
+	if now.UnixNano() < until {
+		return false, time.Unix(0, until)
+	}
+	if !u.openUntil.CompareAndSwap(until, now.Add(cooldown).UnixNano()) {
+		return false, now.Add(cooldown)
+	}
+	return true, time.Time{}
+}
+
+// breakerFailure counts a failed exchange with upstream i, reporting
+// whether it opened the breaker.
+func (s *zoneState) breakerFailure(i int, now time.Time, threshold uint32, cooldown time.Duration) bool {
+	if s == nil || threshold == 0 || i < 0 || i >= len(s.upstreams) {
+		return false
+	}
+
+	u := &s.upstreams[i]
+	if u.failures.Add(1) < threshold {
+		return false
+	}
+	u.openUntil.Store(now.Add(cooldown).UnixNano())
+	return true
+}
+
+// breakerSuccess closes upstream i's breaker.
+func (s *zoneState) breakerSuccess(i int) {
+	if s == nil || i < 0 || i >= len(s.upstreams) {
+		return
+	}
+	s.upstreams[i].failures.Store(0)
+}
@@ -0,0 +1,101 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	var failing atomic.Bool
+	var calls atomic.Int32
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		calls.Add(1)
+		if failing.Load() {
+			return nil, errors.New("connection refused")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 30 IN A 10.0.0.5"))
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.BreakerThreshold = 2
+		c.BreakerCooldown = time.Hour
+		c.UpstreamRetries = 0
+	})
+
+	failing.Store(true)
+	for range 2 {
+		if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d upstream exchanges, want 2", n)
+	}
+
+	// Open: SERVFAIL at once, without asking the upstream
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	resp := serve(t, h, req)
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("rcode = %s with the breaker open, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("%d upstream exchanges with the breaker open, want still 2", n)
+	}
+	if e := ede(resp); e == nil || e.InfoCode != dns.ExtendedErrorCodeNoReachableAuthority || !strings.Contains(e.ExtraText, "retry in") {
+		t.Errorf("EDE = %v, want No Reachable Authority with a retry hint", e)
+	}
+
+	// A successful probe closes it
+	failing.Store(false)
+	if err := h.ProbeUpstreams(); err != nil {
+		t.Fatalf("ProbeUpstreams: %v", err)
+	}
+	if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("reply = %v after the probe, want the answer", resp)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	s := newZoneState(1)
+	now := time.Now()
+	const threshold, cooldown = 2, time.Minute
+
+	if s.breakerFailure(0, now, threshold, cooldown) {
+		t.Fatal("breaker opened below the threshold")
+	}
+	if !s.breakerFailure(0, now, threshold, cooldown) {
+		t.Fatal("breaker still closed at the threshold")
+	}
+	if ok, until := s.breakerAllows(0, now.Add(time.Second), threshold, cooldown); ok || !until.Equal(time.Unix(0, now.Add(cooldown).UnixNano())) {
+		t.Errorf("breakerAllows during the cooldown = %v, %v, want false until the cooldown ends", ok, until)
+	}
+
+	// After the cooldown one trial gets through, the next query waits on it
+	later := now.Add(cooldown + time.Second)
+	if ok, _ := s.breakerAllows(0, later, threshold, cooldown); !ok {
+		t.Error("no half-open trial after the cooldown")
+	}
+	if ok, _ := s.breakerAllows(0, later, threshold, cooldown); ok {
+		t.Error("second query let through while the trial is pending")
+	}
+
+	// A failed trial re-opens it, a successful one closes it
+	s.breakerFailure(0, later, threshold, cooldown)
+	if ok, _ := s.breakerAllows(0, later.Add(time.Second), threshold, cooldown); ok {
+		t.Error("breaker closed after a failed trial")
+	}
+	s.breakerSuccess(0)
+	if ok, _ := s.breakerAllows(0, later.Add(time.Second), threshold, cooldown); !ok {
+		t.Error("breaker still open after a success")
+	}
+}
@@ -0,0 +1,242 @@
+package dnsfwd
+
+import (
+	"container/list"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Response cache
+// ---------------------------------------------
+
+type cacheKey struct {
+	zone   string // zones may share upstream names but not upstreams
+	view   int    // nor do a zone's split-horizon views
+	name   string // rewritten (upstream) name, lowercased
+	qtype  uint16
+	subnet string // EDNS client subnet sent upstream, if any
+	do     bool   // DNSSEC records requested
+	rd     bool   // recursion desired, which UPSTREAM_RD=mirror lets vary
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	prefetching bool // a refresh is under way, see claimPrefetch
+}
+
+// responseCache is a bounded LRU of upstream responses. A nil
+// *responseCache is valid and caches nothing.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List // front = most recently used
+}
+
+func newResponseCache(size int) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// newCacheKey keys the upstream query m for cfg. Answers may differ per
+// client subnet and with DNSSEC records, so ECS and DO are part of the key.
+func newCacheKey(cfg *ZoneConfig, m *dns.Msg) cacheKey {
+	q := m.Question[0]
+	key := cacheKey{zone: cfg.Zone, view: cfg.view, name: strings.ToLower(q.Name), qtype: q.Qtype, rd: m.RecursionDesired}
+
+	if opt := m.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				key.subnet = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+			}
+		}
+	}
+	return key
+}
+
+// get returns a copy of the cached response with TTLs decremented by the
+// time spent in the cache, or nil on a miss.
+func (c *responseCache) get(key cacheKey, now time.Time) *dns.Msg {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+
+	return msg
+}
+
+// set stores a copy of msg for ttl seconds, evicting the least recently
+// used entry when the cache is full.
+func (c *responseCache) set(key cacheKey, msg *dns.Msg, ttl uint32, now time.Time) {
+	if c == nil || ttl == 0 {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// purge drops the entries of the zones in zones.
+func (c *responseCache) purge(zones map[string]bool) {
+	if c == nil || len(zones) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.entries {
+		if zones[key.zone] {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// claimPrefetch reports whether key's entry is in the last threshold
+// fraction of its TTL and nobody is refreshing it yet, marking it as being
+// refreshed. The mark goes away with the entry, when the refresh stores
+// its replacement or it expires.
+func (c *responseCache) claimPrefetch(key cacheKey, threshold float64, now time.Time) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	ttl := entry.expires.Sub(entry.stored)
+	if entry.prefetching || entry.expires.Sub(now) > time.Duration(threshold*float64(ttl)) {
+		return false
+	}
+	entry.prefetching = true
+	return true
+}
+
+// prefetch refreshes key's entry in the background, via the upstream
+// query m, once a hit finds it within PREFETCH_THRESHOLD of expiring.
+func (h *DNSHandler) prefetch(m *dns.Msg, cfg *ZoneConfig, key cacheKey) {
+	if h.prefetchThreshold == 0 || !h.cache.claimPrefetch(key, h.prefetchThreshold, time.Now()) {
+		return
+	}
+	prefetchesTotal.Inc()
+
+	go func() {
+		ctx, cancel := h.queryContext()
+		defer cancel()
+
+		if _, _, err := h.fetch(ctx, m, cfg, key); err != nil {
+			slog.Warn("prefetch failed", "zone", cfg.Zone, "name", m.Question[0].Name, "error", err)
+		}
+	}()
+}
+
+// minAnswerTTL returns the lowest TTL in the answer section, or false
+// when there is nothing cacheable.
+func minAnswerTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Rcode != dns.RcodeSuccess || msg.Truncated || len(msg.Answer) == 0 {
+		return 0, false
+	}
+
+	ttl := msg.Answer[0].Header().Ttl
+	for _, rr := range msg.Answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return ttl, true
+}
+
+// negativeCacheTTL returns how long an NXDOMAIN/NODATA response may be
+// cached: the upstream SOA minimum (RFC 2308), capped at limit.
+func negativeCacheTTL(msg *dns.Msg, limit uint32) (uint32, bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0:
+	default:
+		return 0, false
+	}
+
+	ttl := limit
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(ttl, soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	return ttl, true
+}
@@ -0,0 +1,257 @@
+package dnsfwd
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseCacheTTL(t *testing.T) {
+	c := newResponseCache(8)
+	key := cacheKey{zone: "pod.example.", name: "systemd-web.", qtype: dns.TypeA}
+	msg := new(dns.Msg)
+	msg.Answer = append(msg.Answer, mustRR("systemd-web. 60 IN A 10.0.0.5"))
+	msg.Ns = append(msg.Ns, mustRR("internal. 30 IN NS ns.internal."))
+	now := time.Now()
+	c.set(key, msg, 60, now)
+
+	tests := []struct {
+		elapsed       time.Duration
+		wantAnswerTTL uint32
+		wantNsTTL     uint32
+	}{
+		{0, 60, 30},
+		{25 * time.Second, 35, 5},
+		{59 * time.Second, 1, 0}, // never below zero
+	}
+	for _, tt := range tests {
+		got := c.get(key, now.Add(tt.elapsed))
+		if got == nil {
+			t.Fatalf("get after %v: miss, want a hit", tt.elapsed)
+		}
+		if ttl := got.Answer[0].Header().Ttl; ttl != tt.wantAnswerTTL {
+			t.Errorf("answer TTL after %v = %d, want %d", tt.elapsed, ttl, tt.wantAnswerTTL)
+		}
+		if ttl := got.Ns[0].Header().Ttl; ttl != tt.wantNsTTL {
+			t.Errorf("authority TTL after %v = %d, want %d", tt.elapsed, ttl, tt.wantNsTTL)
+		}
+	}
+	// Hits hand out copies
+	if msg.Answer[0].Header().Ttl != 60 {
+		t.Errorf("stored TTL changed to %d", msg.Answer[0].Header().Ttl)
+	}
+
+	if got := c.get(key, now.Add(60*time.Second)); got != nil {
+		t.Errorf("get at expiry = %v, want a miss", got)
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Error("expired entry still cached")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(2)
+	key := func(name string) cacheKey { return cacheKey{zone: "pod.example.", name: name, qtype: dns.TypeA} }
+	now := time.Now()
+
+	c.set(key("a."), new(dns.Msg), 60, now)
+	c.set(key("b."), new(dns.Msg), 60, now)
+	c.get(key("a."), now) // b. is now the least recently used
+	c.set(key("c."), new(dns.Msg), 60, now)
+
+	for name, want := range map[string]bool{"a.": true, "b.": false, "c.": true} {
+		if hit := c.get(key(name), now) != nil; hit != want {
+			t.Errorf("%s cached %v, want %v", name, hit, want)
+		}
+	}
+	if n := c.lru.Len(); n != 2 {
+		t.Errorf("%d entries, want CACHE_SIZE 2", n)
+	}
+
+	// Zero TTLs and a disabled cache store nothing
+	c.set(key("d."), new(dns.Msg), 0, now)
+	if c.get(key("d."), now) != nil {
+		t.Error("entry with TTL 0 cached")
+	}
+	off := newResponseCache(0)
+	off.set(key("a."), new(dns.Msg), 60, now)
+	if off.get(key("a."), now) != nil {
+		t.Error("CACHE_SIZE=0 cached an entry")
+	}
+}
+
+func TestServeDNSCacheHit(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.CacheSize = 16
+	})
+
+	for _, name := range []string{"web.pod.example.", "WEB.pod.example."} {
+		resp := exchange(t, h, name, dns.TypeA)
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != name {
+			t.Errorf("%s: answer = %v, want its A record under the client's name", name, resp.Answer)
+		}
+	}
+	if got := fwd.names(); len(got) != 1 {
+		t.Errorf("upstream queries = %v, want one, then a cache hit", got)
+	}
+}
+
+func TestClaimPrefetch(t *testing.T) {
+	c := newResponseCache(8)
+	key := cacheKey{zone: "pod.example.", name: "systemd-web.", qtype: dns.TypeA}
+	msg := new(dns.Msg)
+	now := time.Now()
+	c.set(key, msg, 100, now)
+
+	tests := []struct {
+		elapsed time.Duration
+		want    bool
+	}{
+		{0, false},
+		{89 * time.Second, false},
+		{90 * time.Second, true},  // the last 10% of 100s
+		{95 * time.Second, false}, // already claimed
+	}
+	for _, tt := range tests {
+		if got := c.claimPrefetch(key, 0.1, now.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("claimPrefetch after %v = %v, want %v", tt.elapsed, got, tt.want)
+		}
+	}
+
+	// The refreshed entry can be prefetched again in its own last 10%
+	c.set(key, msg, 100, now.Add(95*time.Second))
+	if !c.claimPrefetch(key, 0.1, now.Add(185*time.Second)) {
+		t.Error("claimPrefetch of the refreshed entry = false, want true")
+	}
+
+	if c.claimPrefetch(cacheKey{name: "missing."}, 0.1, now) {
+		t.Error("claimPrefetch of a missing entry = true")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var exchanges atomic.Int32
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		exchanges.Add(1)
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 1 IN A 10.0.0.5"))
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.CacheSize = 16
+		c.PrefetchThreshold = 0.5
+	})
+
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	if n := exchanges.Load(); n != 1 {
+		t.Fatalf("%d exchanges for a miss and an early hit, want 1", n)
+	}
+
+	// Past half of the 1s TTL a hit refreshes the entry in the background
+	time.Sleep(600 * time.Millisecond)
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	deadline := time.Now().Add(time.Second)
+	for exchanges.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := exchanges.Load(); n != 2 {
+		t.Fatalf("%d exchanges after a late hit, want a prefetch", n)
+	}
+
+	// The fresh entry is early in its TTL again
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	time.Sleep(20 * time.Millisecond)
+	if n := exchanges.Load(); n != 2 {
+		t.Errorf("%d exchanges after a hit on the refreshed entry, want 2", n)
+	}
+}
+
+func TestNegativeCacheTTL(t *testing.T) {
+	soa := func(ttl, minttl uint32) dns.RR {
+		return mustRR(fmt.Sprintf("internal. %d IN SOA ns.internal. hostmaster.internal. 1 3600 600 86400 %d", ttl, minttl))
+	}
+	negative := func(rcode int, ns ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.Rcode = rcode
+		m.Ns = ns
+		return m
+	}
+	truncated := negative(dns.RcodeNameError, soa(3600, 30))
+	truncated.Truncated = true
+	positive := negative(dns.RcodeSuccess)
+	positive.Answer = append(positive.Answer, mustRR("systemd-web. 30 IN A 10.0.0.5"))
+
+	tests := []struct {
+		name    string
+		msg     *dns.Msg
+		wantTTL uint32
+		wantOK  bool
+	}{
+		{"NXDOMAIN, SOA minimum", negative(dns.RcodeNameError, soa(3600, 30)), 30, true},
+		{"NXDOMAIN, SOA TTL", negative(dns.RcodeNameError, soa(20, 30)), 20, true},
+		{"NXDOMAIN, capped", negative(dns.RcodeNameError, soa(3600, 600)), 60, true},
+		{"NXDOMAIN without SOA", negative(dns.RcodeNameError), 60, true},
+		{"NODATA", negative(dns.RcodeSuccess, soa(3600, 30)), 30, true},
+		{"answer", positive, 0, false},
+		{"SERVFAIL", negative(dns.RcodeServerFailure), 0, false},
+		{"truncated", truncated, 0, false},
+	}
+	for _, tt := range tests {
+		ttl, ok := negativeCacheTTL(tt.msg, 60)
+		if ttl != tt.wantTTL || ok != tt.wantOK {
+			t.Errorf("%s: negativeCacheTTL = %d, %v, want %d, %v", tt.name, ttl, ok, tt.wantTTL, tt.wantOK)
+		}
+	}
+}
+
+func TestServeDNSNegativeCache(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A":    {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+		"systemd-web. AAAA": {},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.CacheSize = 16
+	})
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantRcode int
+	}{
+		{"missing.pod.example.", dns.TypeA, dns.RcodeNameError},
+		{"web.pod.example.", dns.TypeAAAA, dns.RcodeSuccess}, // NODATA
+	}
+	for _, tt := range tests {
+		fresh := exchange(t, h, tt.name, tt.qtype)
+		cached := exchange(t, h, tt.name, tt.qtype)
+
+		// The cached reply is the fresh one, local SOA and all
+		for _, resp := range []*dns.Msg{fresh, cached} {
+			if resp.Rcode != tt.wantRcode || len(resp.Answer) != 0 || soaOwner(resp) != "pod.example." {
+				t.Errorf("%s %s: reply = %v, want %s with the local SOA", tt.name, dns.TypeToString[tt.qtype], resp, dns.RcodeToString[tt.wantRcode])
+			}
+		}
+		if got, want := rrStrings(cached.Ns), rrStrings(fresh.Ns); len(got) != 1 || got[0] != want[0] {
+			t.Errorf("%s %s: cached authority = %v, want %v", tt.name, dns.TypeToString[tt.qtype], got, want)
+		}
+	}
+	if got := fwd.names(); len(got) != 2 {
+		t.Errorf("upstream queries = %v, want one per name", got)
+	}
+
+	// Apex answers are local and never cached
+	exchange(t, h, "pod.example.", dns.TypeSOA)
+	exchange(t, h, "pod.example.", dns.TypeA)
+	if n := h.cache.lru.Len(); n != 2 {
+		t.Errorf("%d cache entries after apex queries, want the 2 negative ones", n)
+	}
+}
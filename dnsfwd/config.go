@@ -0,0 +1,338 @@
+package dnsfwd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Config file (CONFIG_FILE)
+// Format (JSON):
+//   {
+//     "default_prefix": "systemd-",
+//     "listen_addr": ":53",
+//     "answer_ttl": 300,
+//     "negative_ttl": 60,
+//     "zones": [
+//       {"zone": "pod.hetmer.net.", "prefix": "systemd-",
+//        (or "prefixes": ["systemd-", "k8s-"], tried in order)
+//        "protocol": "udp", "upstreams": ["10.0.0.1:53", "10.0.0.2:53"],
+//        "answer_ttl": 30, "negative_ttl": 10, "allowed_types": ["A", "SRV"],
+//        "views": [{"cidrs": ["10.0.0.0/8"], "upstreams": ["10.0.0.3:53"]}]}
+//     ],
+//     "overrides": ["api.pod.hetmer.net. A 10.0.0.5"]
+//   }
+//
+// Global settings left out (or zero) keep their env var values.
+// ---------------------------------------------
+
+// FileConfig holds the global settings of a config file; see Apply.
+type FileConfig struct {
+	DefaultPrefix string     `json:"default_prefix"`
+	ListenAddr    string     `json:"listen_addr"`
+	AnswerTTL     uint32     `json:"answer_ttl"`
+	NegativeTTL   uint32     `json:"negative_ttl"`
+	Zones         []fileZone `json:"zones"`
+	Overrides     []string   `json:"overrides"` // "name type value", as in OVERRIDES
+}
+
+type fileZone struct {
+	Zone       string   `json:"zone"`
+	Prefix     string   `json:"prefix"`
+	Prefixes   []string `json:"prefixes"`    // tried in order, instead of prefix
+	PrefixMode string   `json:"prefix_mode"` // first (default) or each
+	Rewrite    string   `json:"rewrite"`     // prefix (default), strip or none
+	Protocol   string   `json:"protocol"`    // udp (default), tcp, tls or tcp-fallback
+	Upstreams  []string `json:"upstreams"`
+
+	TLSServerName string `json:"tls_server_name"`
+	Balance       string `json:"balance"`       // first, round-robin, random or latency
+	UpstreamZone  string `json:"upstream_zone"` // internal zone the subdomain is moved under
+
+	AllowedTypes []string `json:"allowed_types"` // e.g. ["A", "SRV"], defaults to FORWARD_TYPES
+
+	AnswerTTL   uint32 `json:"answer_ttl"`
+	NegativeTTL uint32 `json:"negative_ttl"`
+
+	Views []fileView `json:"views"` // split horizon, first matching view wins
+}
+
+// fileView is a ZoneView: clients in cidrs are sent to upstreams.
+type fileView struct {
+	CIDRs     []string `json:"cidrs"` // CIDRs or bare IPs
+	Upstreams []string `json:"upstreams"`
+}
+
+// LoadConfigFile reads the JSON config file at path, returning its zones
+// and its global settings.
+func LoadConfigFile(path string) (map[string]ZoneConfig, *FileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	var fc FileConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	if len(fc.Zones) == 0 {
+		return nil, nil, fmt.Errorf("config file %s defines no zones", path)
+	}
+
+	if _, err := parseOverrides(fc.Overrides); err != nil {
+		return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	zones := make(map[string]ZoneConfig, len(fc.Zones))
+	for i, fz := range fc.Zones {
+		if fz.Zone == "" {
+			return nil, nil, fmt.Errorf("config file %s: zone #%d has no name", path, i+1)
+		}
+
+		zone := fz.Zone
+		if !strings.HasSuffix(zone, ".") {
+			zone += "."
+		}
+		if _, dup := zones[zone]; dup {
+			return nil, nil, fmt.Errorf("config file %s: duplicate zone %s", path, zone)
+		}
+
+		proto := normalizeProtocol(fz.Protocol)
+		if proto == "" {
+			proto = "udp"
+		}
+
+		var upstreams []string
+		for _, upstream := range fz.Upstreams {
+			normalized, err := normalizeUpstream(strings.TrimSpace(upstream), proto)
+			if err != nil {
+				return nil, nil, fmt.Errorf("config file %s: zone %s: %w", path, zone, err)
+			}
+			upstreams = append(upstreams, normalized)
+		}
+		if len(upstreams) == 0 {
+			return nil, nil, fmt.Errorf("config file %s: zone %s has no upstreams", path, zone)
+		}
+
+		var upstreamZone string
+		if fz.UpstreamZone != "" {
+			upstreamZone = strings.ToLower(dns.Fqdn(fz.UpstreamZone))
+		}
+
+		var allowedTypes []uint16
+		for _, name := range fz.AllowedTypes {
+			qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				return nil, nil, fmt.Errorf("config file %s: zone %s: unknown query type in allowed_types: %s", path, zone, name)
+			}
+			allowedTypes = append(allowedTypes, qtype)
+		}
+
+		var views []ZoneView
+		for j, fv := range fz.Views {
+			cidrs, err := parseCIDRs(fv.CIDRs)
+			if err != nil {
+				return nil, nil, fmt.Errorf("config file %s: zone %s: view #%d: %w", path, zone, j+1, err)
+			}
+			view := ZoneView{CIDRs: cidrs}
+			for _, upstream := range fv.Upstreams {
+				normalized, err := normalizeUpstream(strings.TrimSpace(upstream), proto)
+				if err != nil {
+					return nil, nil, fmt.Errorf("config file %s: zone %s: view #%d: %w", path, zone, j+1, err)
+				}
+				view.Upstreams = append(view.Upstreams, normalized)
+			}
+			views = append(views, view)
+		}
+
+		prefix, prefixes := fz.Prefix, []string(nil)
+		if len(fz.Prefixes) > 0 {
+			if fz.Prefix != "" {
+				return nil, nil, fmt.Errorf("config file %s: zone %s: prefix and prefixes are mutually exclusive", path, zone)
+			}
+			prefix, prefixes = fz.Prefixes[0], fz.Prefixes[1:]
+		}
+
+		rewrite, noRewrite := fz.Rewrite, fz.Rewrite == rewriteNone
+		if noRewrite {
+			rewrite = ""
+		}
+
+		zones[zone] = ZoneConfig{
+			Zone:        zone,
+			Prefix:      prefix,
+			Prefixes:    prefixes,
+			PrefixMode:  fz.PrefixMode,
+			Rewrite:     rewrite,
+			NoRewrite:   noRewrite,
+			Protocol:    proto,
+			Upstreams:   upstreams,
+			AnswerTTL:   fz.AnswerTTL,
+			NegativeTTL: fz.NegativeTTL,
+
+			TLSServerName: fz.TLSServerName,
+			Balance:       fz.Balance,
+			UpstreamZone:  upstreamZone,
+			AllowedTypes:  allowedTypes,
+			ReverseZone:   isReverseZone(zone),
+			Views:         views,
+		}
+	}
+
+	return zones, &fc, nil
+}
+
+// Apply overrides cfg's settings with those set in the file, adding its
+// overrides to cfg's. ListenAddr is left to the caller.
+func (fc *FileConfig) Apply(cfg *Config) {
+	if fc.DefaultPrefix != "" {
+		cfg.DefaultPrefix = fc.DefaultPrefix
+	}
+	if fc.AnswerTTL != 0 {
+		cfg.AnswerTTL = fc.AnswerTTL
+	}
+	if fc.NegativeTTL != 0 {
+		cfg.NegativeTTL = fc.NegativeTTL
+	}
+	// A new slice, so applying the file to copies of cfg leaves cfg be
+	cfg.Overrides = slices.Concat(cfg.Overrides, fc.Overrides)
+}
+
+// validateZones checks every zone's name, protocol and upstreams, so a
+// typo fails at startup rather than as SERVFAIL on every query.
+func validateZones(zones map[string]ZoneConfig) error {
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cfg := zones[name]
+
+		if _, ok := dns.IsDomainName(cfg.Zone); !ok {
+			return fmt.Errorf("zone %s: invalid zone name", name)
+		}
+
+		if !isProtocol(cfg.Protocol) {
+			return fmt.Errorf("zone %s: unsupported protocol %q (want udp, tcp, tls or tcp-fallback)", name, cfg.Protocol)
+		}
+
+		if strings.Count(cfg.Prefix, "%s") > 1 {
+			return fmt.Errorf("zone %s: prefix %q has more than one %%s placeholder", name, cfg.Prefix)
+		}
+
+		switch cfg.PrefixMode {
+		case "", prefixModeFirst:
+		case prefixModeEach:
+			if strings.Contains(cfg.Prefix, ".") {
+				return fmt.Errorf("zone %s: prefix_mode each needs a single-label prefix, not %q", name, cfg.Prefix)
+			}
+		default:
+			return fmt.Errorf("zone %s: unsupported prefix_mode %q (want first or each)", name, cfg.PrefixMode)
+		}
+
+		for _, prefix := range cfg.Prefixes {
+			if prefix == "" {
+				return fmt.Errorf("zone %s: empty fallback prefix, use %q for none", name, NoPrefix)
+			}
+			if err := validatePrefix(&cfg, prefix); err != nil {
+				return fmt.Errorf("zone %s: %w", name, err)
+			}
+		}
+
+		switch cfg.Rewrite {
+		case "", rewritePrefix, rewriteStrip:
+		default:
+			return fmt.Errorf("zone %s: unsupported rewrite %q (want prefix, strip or none)", name, cfg.Rewrite)
+		}
+
+		// Reverse zones and the catch-all zone are forwarded unchanged, so
+		// none of the rewriting options apply
+		rewriteOptions := (cfg.Prefix != "" && cfg.Prefix != NoPrefix) || len(cfg.Prefixes) > 0 || cfg.PrefixMode == prefixModeEach ||
+			cfg.UpstreamZone != ""
+		if cfg.ReverseZone && (rewriteOptions || cfg.Rewrite == rewriteStrip) {
+			return fmt.Errorf("zone %s: reverse zones are forwarded unchanged and take no prefix, prefix_mode, rewrite or upstream_zone", name)
+		}
+
+		if cfg.Zone == CatchAllZone && (rewriteOptions || cfg.Rewrite == rewriteStrip) {
+			return fmt.Errorf("zone %s: the catch-all zone is forwarded unchanged and takes no prefix, prefix_mode, rewrite or upstream_zone", name)
+		}
+
+		if cfg.NoRewrite && rewriteOptions {
+			return fmt.Errorf("zone %s: rewrite none forwards names unchanged and takes no prefix, prefix_mode or upstream_zone", name)
+		}
+
+		if _, ok := dns.IsDomainName(cfg.UpstreamZone); cfg.UpstreamZone != "" && !ok {
+			return fmt.Errorf("zone %s: invalid upstream_zone %q", name, cfg.UpstreamZone)
+		}
+
+		if cfg.Balance != "" && !isBalanceMode(cfg.Balance) {
+			return fmt.Errorf("zone %s: unsupported balance mode %q (want first, round-robin, random or latency)", name, cfg.Balance)
+		}
+
+		for _, upstream := range cfg.Upstreams {
+			if err := validateUpstream(upstream); err != nil {
+				return fmt.Errorf("zone %s: %w", name, err)
+			}
+		}
+
+		if err := validateViews(&cfg); err != nil {
+			return fmt.Errorf("zone %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func validateUpstream(upstream string) error {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream %q: %w", upstream, err)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port in upstream %q", upstream)
+	}
+
+	// IP literal (optionally with an IPv6 zone ID) or a resolvable hostname
+	ip, _, _ := strings.Cut(host, "%")
+	if net.ParseIP(ip) == nil && !isHostname(host) {
+		return fmt.Errorf("invalid host in upstream %q", upstream)
+	}
+
+	return nil
+}
+
+// isHostname reports whether host is a plausible DNS hostname: dot
+// separated labels of letters, digits, '-' and '_'.
+func isHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
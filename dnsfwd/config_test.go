@@ -0,0 +1,214 @@
+package dnsfwd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateZonesCatchAll(t *testing.T) {
+	for _, env := range []string{
+		".=udp:1.1.1.1:53",
+		".=-:udp:1.1.1.1:53",
+		".=udp:1.1.1.1:53?rewrite=none",
+	} {
+		zones, err := ParseZoneEnv(env)
+		if err != nil {
+			t.Fatalf("ParseZoneEnv(%q): %v", env, err)
+		}
+		if err := validateZones(zones); err != nil {
+			t.Errorf("validateZones(%q): %v", env, err)
+		}
+	}
+
+	// The catch-all forwards names unchanged; a prefix would be dropped
+	for _, env := range []string{
+		".=systemd-:udp:1.1.1.1:53",
+		".=-|k8s-:udp:1.1.1.1:53",
+		".=udp:1.1.1.1:53?rewrite=strip",
+		".=udp:1.1.1.1:53?upstream_zone=internal.",
+	} {
+		zones, err := ParseZoneEnv(env)
+		if err != nil {
+			t.Fatalf("ParseZoneEnv(%q): %v", env, err)
+		}
+		err = validateZones(zones)
+		if err == nil || !strings.Contains(err.Error(), "catch-all") {
+			t.Errorf("validateZones(%q) = %v, want the catch-all error", env, err)
+		}
+	}
+}
+
+// writeConfigFile writes content to a config file in a temporary
+// directory and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"default_prefix": "k8s-",
+		"listen_addr": ":5353",
+		"answer_ttl": 120,
+		"zones": [
+			{"zone": "pod.example", "prefix": "systemd-", "upstreams": ["10.0.0.1", "10.0.0.2:5353"]},
+			{"zone": "dot.example.", "protocol": "dot", "upstreams": ["1.1.1.1"], "answer_ttl": 30}
+		],
+		"overrides": ["api.pod.example. A 10.0.0.5"]
+	}`)
+
+	zones, fc, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+	if fc.DefaultPrefix != "k8s-" || fc.ListenAddr != ":5353" || fc.AnswerTTL != 120 || len(fc.Overrides) != 1 {
+		t.Errorf("globals = %+v", fc)
+	}
+
+	pod := zones["pod.example."]
+	if pod.Prefix != "systemd-" || pod.Protocol != "udp" || strings.Join(pod.Upstreams, ",") != "10.0.0.1:53,10.0.0.2:5353" {
+		t.Errorf("pod.example. = %s %s %v, want systemd- udp [10.0.0.1:53 10.0.0.2:5353]", pod.Prefix, pod.Protocol, pod.Upstreams)
+	}
+	dot := zones["dot.example."]
+	if dot.Protocol != "tls" || strings.Join(dot.Upstreams, ",") != "1.1.1.1:853" || dot.AnswerTTL != 30 {
+		t.Errorf("dot.example. = %s %v ttl %d, want tls [1.1.1.1:853] ttl 30", dot.Protocol, dot.Upstreams, dot.AnswerTTL)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Overrides = []string{"env.pod.example. A 10.0.0.6"}
+	fc.Apply(&cfg)
+	if cfg.DefaultPrefix != "k8s-" || cfg.AnswerTTL != 120 || cfg.NegativeTTL != 60 || len(cfg.Overrides) != 2 {
+		t.Errorf("applied = prefix %q, TTLs %d/%d, overrides %v", cfg.DefaultPrefix, cfg.AnswerTTL, cfg.NegativeTTL, cfg.Overrides)
+	}
+}
+
+func TestLoadConfigFileMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"not JSON", `zones: []`, "invalid config file"},
+		{"truncated", `{"zones": [`, "invalid config file"},
+		{"unknown field", `{"zonez": []}`, "unknown field"},
+		{"wrong type", `{"answer_ttl": "300", "zones": []}`, "invalid config file"},
+		{"no zones", `{"zones": []}`, "defines no zones"},
+		{"unnamed zone", `{"zones": [{"upstreams": ["10.0.0.1"]}]}`, "has no name"},
+		{"duplicate zone", `{"zones": [{"zone": "a.", "upstreams": ["10.0.0.1"]}, {"zone": "a", "upstreams": ["10.0.0.2"]}]}`, "duplicate zone"},
+		{"no upstreams", `{"zones": [{"zone": "a."}]}`, "has no upstreams"},
+		{"bad upstream", `{"zones": [{"zone": "a.", "upstreams": ["[2001:db8::1"]}]}`, "zone a."},
+		{"bad type", `{"zones": [{"zone": "a.", "upstreams": ["10.0.0.1"], "allowed_types": ["AA"]}]}`, "unknown query type"},
+		{"bad view", `{"zones": [{"zone": "a.", "upstreams": ["10.0.0.1"], "views": [{"cidrs": ["10.0.0.0/33"]}]}]}`, "view #1"},
+		{"prefix and prefixes", `{"zones": [{"zone": "a.", "prefix": "x-", "prefixes": ["y-"], "upstreams": ["10.0.0.1"]}]}`, "mutually exclusive"},
+		{"bad override", `{"zones": [{"zone": "a.", "upstreams": ["10.0.0.1"]}], "overrides": ["a. A"]}`, "config file"},
+	}
+	for _, tt := range tests {
+		_, _, err := LoadConfigFile(writeConfigFile(t, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: LoadConfigFile = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if _, _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadConfigFile of a missing file succeeded")
+	}
+}
+
+func TestValidateZonesUpstreams(t *testing.T) {
+	good := []string{
+		"udp:10.0.0.1:53",
+		"udp:10.0.0.1",
+		"tcp:[2001:db8::1]:5353",
+		"udp:[fe80::1%eth0]",
+		"tls:dns.example.com:853",
+		"udp:dns-1.internal",
+	}
+	for _, value := range good {
+		env := "a.example.=" + value
+		zones, err := ParseZoneEnv(env)
+		if err != nil {
+			t.Errorf("ParseZoneEnv(%q): %v", env, err)
+			continue
+		}
+		if err := validateZones(zones); err != nil {
+			t.Errorf("validateZones(%q): %v", env, err)
+		}
+	}
+
+	bad := []string{
+		"udp:10.0.0.1:0",
+		"udp:10.0.0.1:65536",
+		"udp:10.0.0.1:dns",
+		"udp:bad host:53",
+		"udp:under_score..example:53",
+		"sctp:10.0.0.1:53",
+	}
+	for _, value := range bad {
+		env := "a.example.=" + value
+		zones, err := ParseZoneEnv(env)
+		if err != nil {
+			continue // caught while parsing, just as good
+		}
+		err = validateZones(zones)
+		if err == nil || !strings.Contains(err.Error(), "zone a.example.") {
+			t.Errorf("validateZones(%q) = %v, want an error naming the zone", env, err)
+		}
+	}
+}
+
+func TestAllowedTypesPerZone(t *testing.T) {
+	zones, _, err := LoadConfigFile(writeConfigFile(t, `{"zones": [
+		{"zone": "a.example.", "upstreams": ["10.0.0.1"], "allowed_types": ["A"]},
+		{"zone": "srv.example.", "upstreams": ["10.0.0.2"], "allowed_types": ["a", "SRV"]},
+		{"zone": "default.example.", "upstreams": ["10.0.0.3"]}
+	]}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+	fwd := &stubForwarder{}
+	cfg := DefaultConfig()
+	cfg.Zones = zones
+	cfg.Forwarder = fwd
+	cfg.CacheSize = 0
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		forward bool
+	}{
+		{"web.a.example.", dns.TypeA, true},
+		{"web.a.example.", dns.TypeAAAA, false},
+		{"web.a.example.", dns.TypeSRV, false},
+		{"web.srv.example.", dns.TypeA, true},
+		{"web.srv.example.", dns.TypeSRV, true},
+		{"web.srv.example.", dns.TypeAAAA, false},
+		// FORWARD_TYPES, A and AAAA by default
+		{"web.default.example.", dns.TypeAAAA, true},
+		{"web.default.example.", dns.TypeSRV, false},
+	}
+	for _, tt := range tests {
+		before := len(fwd.names())
+		resp := exchange(t, h, tt.name, tt.qtype)
+		forwarded := len(fwd.names()) > before
+
+		if forwarded != tt.forward {
+			t.Errorf("%s %s: forwarded %v, want %v", tt.name, dns.TypeToString[tt.qtype], forwarded, tt.forward)
+		}
+		if !tt.forward && (resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || soaOwner(resp) == "") {
+			t.Errorf("%s %s: reply = %v, want NODATA with the local SOA", tt.name, dns.TypeToString[tt.qtype], resp)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+// Package dnsfwd is the DNS rewriting forwarder behind dns_fwd, usable on
+// its own as a dns.Handler.
+//
+// A DNSHandler answers queries for its zones by rewriting the name with
+// the zone's prefix, forwarding it upstream and rewriting the answer back.
+// Build one from a Config, starting with DefaultConfig for the same
+// defaults the dns_fwd binary uses, and serve it with a dns.Server as in
+// the NewHandler example.
+//
+// Config fields mirror the dns_fwd env vars of the same name, and so do
+// the errors NewHandler returns for them.
+package dnsfwd
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Public API
+// ---------------------------------------------
+
+// Config holds everything a DNSHandler is built from. Zero values are not
+// defaults; start from DefaultConfig.
+type Config struct {
+	Zones map[string]ZoneConfig // by zone name, see ParseZoneEnv and LoadConfigFile
+
+	DefaultPrefix  string   // DEFAULT_PREFIX, for zones without their own
+	AnswerTTL      uint32   // ANSWER_TTL
+	NegativeTTL    uint32   // NEGATIVE_TTL
+	TTLMode        string   // TTL_MODE: override, passthrough or cap
+	MinTTL         uint32   // MIN_TTL, floor for upstream TTLs in passthrough and cap, 0 disables
+	ForwardTypes   []string // FORWARD_TYPES, qtype names such as "A"
+	Overrides      []string // OVERRIDES, "name type value" each
+	Blocklist      []string // BLOCKLIST, names or "*." parents
+	BlockMode      string   // BLOCK_MODE: nxdomain or sinkhole
+	SinkholeAddrs  []string // SINKHOLE_ADDRS, with BlockMode sinkhole
+	OutOfZoneRcode string   // OUT_OF_ZONE_RCODE: nxdomain, refused or servfail
+	OutOfZoneSOA   string   // OUT_OF_ZONE_SOA: owner name of the NXDOMAIN SOA, none or closest
+	Padding        string   // PADDING: off or block, for DoT/DoH responses
+	AAAAMode       string   // AAAA_MODE, empty is normal, or synthesize-from-a with DNS64Prefix
+	AnyMode        string   // ANY_MODE: refuse, forward or nxdomain
+	ApexMode       string   // APEX_MODE: soa or ns
+	Authoritative  bool     // AUTHORITATIVE, AA on apex answers and zone NXDOMAIN/NODATA
+	DNS64Prefix    string   // DNS64_PREFIX, e.g. 64:ff9b::/96
+	MaxAnswers     int      // MAX_ANSWERS, 0 is unlimited
+	ShuffleAnswers bool     // SHUFFLE_ANSWERS
+
+	SOAMname   string   // SOA_MNAME
+	SOARname   string   // SOA_RNAME, also accepts user@domain
+	SOARefresh uint32   // SOA_REFRESH
+	SOARetry   uint32   // SOA_RETRY
+	SOAExpire  uint32   // SOA_EXPIRE
+	SOASerial  uint32   // SOA_SERIAL, 0 is the current time
+	NSAddrs    []string // NS_ADDRS, glue for SOAMname
+
+	AllowCIDRs      []string // ALLOW_CIDRS, empty allows everyone
+	RateLimit       uint32   // RATE_LIMIT, queries/s per client, 0 disables
+	RateBurst       uint32   // RATE_BURST, 0 is RateLimit
+	RateLimitAction string   // RATE_LIMIT_ACTION: refuse or drop
+
+	StripDO     bool   // STRIP_DO
+	ECSMode     string // ECS_MODE: off, passthrough or synthesize
+	ECSPrefixV4 uint32 // ECS_PREFIX_V4
+	ECSPrefixV6 uint32 // ECS_PREFIX_V6
+
+	BalanceMode       string         // BALANCE_MODE: first, round-robin, random or latency
+	UpstreamTimeout   time.Duration  // UPSTREAM_TIMEOUT
+	QueryTimeout      time.Duration  // QUERY_TIMEOUT, 0 disables
+	UpstreamRetries   int            // UPSTREAM_RETRIES
+	AutoTCP           bool           // AUTO_TCP
+	TCPCooldown       time.Duration  // TCP_COOLDOWN, 0 disables
+	BreakerThreshold  uint32         // BREAKER_THRESHOLD, consecutive upstream failures, 0 disables
+	BreakerCooldown   time.Duration  // BREAKER_COOLDOWN
+	CaseRandomization bool           // CASE_RANDOMIZATION
+	MaxInflight       uint32         // MAX_INFLIGHT, 0 is unlimited
+	InflightWait      time.Duration  // INFLIGHT_WAIT
+	PoolMaxIdle       int            // UPSTREAM_POOL_MAX_IDLE, 0 disables pooling
+	PoolIdleTimeout   time.Duration  // UPSTREAM_POOL_IDLE_TIMEOUT
+	UpstreamCAs       *x509.CertPool // UPSTREAM_TLS_CA, nil means system roots, see LoadCertPool
+	UpstreamBindAddrs []string       // UPSTREAM_BIND_ADDR, source IPs for upstream queries, one per family
+	UpstreamRD        string         // UPSTREAM_RD: on, off or mirror
+	CacheSize         int            // CACHE_SIZE, 0 disables
+	PrefetchThreshold float64        // PREFETCH_THRESHOLD, fraction of the TTL left that triggers a refresh, 0 disables
+	ProbeInterval     time.Duration  // PROBE_INTERVAL, 0 disables
+
+	// Context, when set, aborts in-flight upstream queries once done
+	Context context.Context
+	// Forwarder, when set, replaces the network exchange with upstreams
+	Forwarder Forwarder
+}
+
+// DefaultConfig returns the dns_fwd defaults, without any zones.
+func DefaultConfig() Config {
+	return Config{
+		DefaultPrefix:   "systemd-",
+		AnswerTTL:       300,
+		NegativeTTL:     60,
+		TTLMode:         ttlModeOverride,
+		ForwardTypes:    []string{"A", "AAAA"},
+		OutOfZoneRcode:  "nxdomain",
+		OutOfZoneSOA:    "invalid.",
+		Padding:         paddingOff,
+		AnyMode:         anyModeRefuse,
+		ApexMode:        apexModeSOA,
+		UpstreamRD:      upstreamRDOn,
+		Authoritative:   true,
+		BlockMode:       blockModeNXDomain,
+		SOAMname:        "dns-pod.hetmer.net.",
+		SOARname:        "pod.hetmer.net.",
+		SOARefresh:      3600,
+		SOARetry:        600,
+		SOAExpire:       86400,
+		RateLimitAction: "refuse",
+		StripDO:         true,
+		ECSMode:         ecsModeOff,
+		ECSPrefixV4:     24,
+		ECSPrefixV6:     56,
+		BalanceMode:     balanceFirst,
+		UpstreamTimeout: 2 * time.Second,
+		QueryTimeout:    5 * time.Second,
+		UpstreamRetries: 1,
+		AutoTCP:         true,
+		BreakerCooldown: 30 * time.Second,
+		MaxInflight:     1000,
+		InflightWait:    100 * time.Millisecond,
+		PoolMaxIdle:     4,
+		PoolIdleTimeout: 30 * time.Second,
+		CacheSize:       1024,
+		ProbeInterval:   10 * time.Second,
+	}
+}
+
+// NewHandler validates cfg and builds a handler from it.
+func NewHandler(cfg Config) (*DNSHandler, error) {
+	if err := validateZones(cfg.Zones); err != nil {
+		return nil, err
+	}
+
+	forwardTypes, err := parseTypeList(cfg.ForwardTypes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FORWARD_TYPES: %w", err)
+	}
+
+	overrides, err := parseOverrides(cfg.Overrides)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OVERRIDES: %w", err)
+	}
+
+	blocked, err := parseBlocklist(cfg.Blocklist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BLOCKLIST: %w", err)
+	}
+
+	sinkhole, err := sinkholeAddrs(cfg.BlockMode, cfg.SinkholeAddrs)
+	if err != nil {
+		return nil, err
+	}
+
+	allowNets, err := parseCIDRs(cfg.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ALLOW_CIDRS: %w", err)
+	}
+
+	var dropThrottled bool
+	switch cfg.RateLimitAction {
+	case "refuse":
+	case "drop":
+		dropThrottled = true
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_ACTION: %s", cfg.RateLimitAction)
+	}
+
+	// DNS64_PREFIX turns synthesis on unless AAAA_MODE says otherwise
+	var dns64 *net.IPNet
+	aaaaMode := aaaaModeNormal
+	if cfg.DNS64Prefix != "" {
+		if dns64, err = parseDNS64Prefix(cfg.DNS64Prefix); err != nil {
+			return nil, err
+		}
+		aaaaMode = aaaaModeSynthesize
+	}
+	if cfg.AAAAMode != "" {
+		aaaaMode = cfg.AAAAMode
+	}
+	switch aaaaMode {
+	case aaaaModeNormal, aaaaModeEmpty:
+		if dns64 != nil {
+			return nil, fmt.Errorf("DNS64_PREFIX needs AAAA_MODE=%s, not %s", aaaaModeSynthesize, aaaaMode)
+		}
+	case aaaaModeSynthesize:
+		if dns64 == nil {
+			return nil, fmt.Errorf("AAAA_MODE=%s needs DNS64_PREFIX", aaaaMode)
+		}
+	default:
+		return nil, fmt.Errorf("invalid AAAA_MODE: %s", aaaaMode)
+	}
+
+	switch cfg.ECSMode {
+	case ecsModeOff, ecsModePassthrough, ecsModeSynthesize:
+	default:
+		return nil, fmt.Errorf("invalid ECS_MODE: %s", cfg.ECSMode)
+	}
+
+	if cfg.ECSPrefixV4 > 32 || cfg.ECSPrefixV6 > 128 {
+		return nil, fmt.Errorf("invalid ECS_PREFIX_V4/ECS_PREFIX_V6: %d/%d", cfg.ECSPrefixV4, cfg.ECSPrefixV6)
+	}
+
+	mname, err := parseSOAName(cfg.SOAMname)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOA_MNAME: %w", err)
+	}
+	rname, err := parseSOAName(cfg.SOARname)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOA_RNAME: %w", err)
+	}
+
+	nsAddrs, err := parseIPs(cfg.NSAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NS_ADDRS: %w", err)
+	}
+
+	bindAddrs, err := parseBindAddrs(cfg.UpstreamBindAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPSTREAM_BIND_ADDR: %w", err)
+	}
+
+	var outOfZone int
+	switch strings.ToLower(cfg.OutOfZoneRcode) {
+	case "nxdomain":
+		outOfZone = dns.RcodeNameError
+	case "refused":
+		outOfZone = dns.RcodeRefused
+	case "servfail":
+		outOfZone = dns.RcodeServerFailure
+	default:
+		return nil, fmt.Errorf("invalid OUT_OF_ZONE_RCODE: %s", cfg.OutOfZoneRcode)
+	}
+
+	outOfZoneSOA := strings.ToLower(cfg.OutOfZoneSOA)
+	switch outOfZoneSOA {
+	case outOfZoneSOANone, outOfZoneSOAClosest:
+	default:
+		if _, ok := dns.IsDomainName(outOfZoneSOA); !ok || outOfZoneSOA == "" {
+			return nil, fmt.Errorf("invalid OUT_OF_ZONE_SOA: %s (want an owner name, none or closest)", cfg.OutOfZoneSOA)
+		}
+		outOfZoneSOA = dns.Fqdn(outOfZoneSOA)
+	}
+
+	switch cfg.Padding {
+	case paddingOff, paddingBlock:
+	default:
+		return nil, fmt.Errorf("invalid PADDING: %s", cfg.Padding)
+	}
+
+	switch cfg.AnyMode {
+	case anyModeRefuse, anyModeForward, anyModeNXDomain:
+	default:
+		return nil, fmt.Errorf("invalid ANY_MODE: %s", cfg.AnyMode)
+	}
+
+	switch cfg.ApexMode {
+	case apexModeSOA, apexModeNS:
+	default:
+		return nil, fmt.Errorf("invalid APEX_MODE: %s", cfg.ApexMode)
+	}
+
+	switch cfg.UpstreamRD {
+	case upstreamRDOn, upstreamRDOff, upstreamRDMirror:
+	default:
+		return nil, fmt.Errorf("invalid UPSTREAM_RD: %s", cfg.UpstreamRD)
+	}
+
+	if !isBalanceMode(cfg.BalanceMode) {
+		return nil, fmt.Errorf("invalid BALANCE_MODE: %s", cfg.BalanceMode)
+	}
+
+	if cfg.PrefetchThreshold < 0 || cfg.PrefetchThreshold >= 1 {
+		return nil, fmt.Errorf("invalid PREFETCH_THRESHOLD: %g (want 0 to disable, or a fraction below 1)", cfg.PrefetchThreshold)
+	}
+
+	if cfg.BreakerThreshold > 0 && cfg.BreakerCooldown <= 0 {
+		return nil, fmt.Errorf("invalid BREAKER_COOLDOWN: %s (want a positive duration with BREAKER_THRESHOLD)", cfg.BreakerCooldown)
+	}
+
+	switch cfg.TTLMode {
+	case ttlModeOverride, ttlModePassthrough, ttlModeCap:
+	default:
+		return nil, fmt.Errorf("invalid TTL_MODE: %s", cfg.TTLMode)
+	}
+	if cfg.TTLMode == ttlModeCap && cfg.MinTTL > cfg.AnswerTTL {
+		return nil, fmt.Errorf("invalid MIN_TTL: %d is above ANSWER_TTL %d with TTL_MODE=%s", cfg.MinTTL, cfg.AnswerTTL, ttlModeCap)
+	}
+
+	h := &DNSHandler{
+		ctx:               cfg.Context,
+		cache:             newResponseCache(cfg.CacheSize),
+		prefetchThreshold: cfg.PrefetchThreshold,
+		forwardTypes:      forwardTypes,
+		balance:           cfg.BalanceMode,
+		ttlMode:           cfg.TTLMode,
+		minTTL:            cfg.MinTTL,
+		aaaaMode:          aaaaMode,
+		anyMode:           cfg.AnyMode,
+		apexMode:          cfg.ApexMode,
+		authoritative:     cfg.Authoritative,
+		dns64:             dns64,
+		blocklist:         blocked,
+		blockMode:         cfg.BlockMode,
+		sinkhole:          sinkhole,
+		outOfZone:         outOfZone,
+		outOfZoneSOA:      outOfZoneSOA,
+		padding:           cfg.Padding,
+		nsAddrs:           nsAddrs,
+		soa: dns.SOA{
+			Ns:      mname,
+			Mbox:    rname,
+			Refresh: cfg.SOARefresh,
+			Retry:   cfg.SOARetry,
+			Expire:  cfg.SOAExpire,
+		},
+		allowNets:   allowNets,
+		limiter:     newRateLimiter(cfg.RateLimit, cfg.RateBurst, dropThrottled),
+		inflight:    newInflightLimit(cfg.MaxInflight, cfg.InflightWait),
+		stripDO:     cfg.StripDO,
+		ecsMode:     cfg.ECSMode,
+		ecsPrefixV4: uint8(cfg.ECSPrefixV4),
+		ecsPrefixV6: uint8(cfg.ECSPrefixV6),
+
+		upstreamTimeout: cfg.UpstreamTimeout,
+		queryTimeout:    cfg.QueryTimeout,
+		retries:         cfg.UpstreamRetries,
+		autoTCP:         cfg.AutoTCP,
+		tcpCooldown:     cfg.TCPCooldown,
+		maxAnswers:      cfg.MaxAnswers,
+		shuffleAnswers:  cfg.ShuffleAnswers,
+		randomizeCase:   cfg.CaseRandomization,
+		upstreamCAs:     cfg.UpstreamCAs,
+		bindAddrs:       bindAddrs,
+		upstreamRD:      cfg.UpstreamRD,
+		pool:            newConnPool(cfg.PoolMaxIdle, cfg.PoolIdleTimeout),
+		forwarder:       cfg.Forwarder,
+		probeInterval:   cfg.ProbeInterval,
+
+		breakerThreshold: cfg.BreakerThreshold,
+		breakerCooldown:  cfg.BreakerCooldown,
+	}
+
+	h.swapZones(cfg.Zones, &globals{
+		defaultPrefix: cfg.DefaultPrefix,
+		negativeTTL:   cfg.NegativeTTL,
+		answerTTL:     cfg.AnswerTTL,
+		overrides:     overrides,
+	})
+
+	serial := cfg.SOASerial
+	if serial == 0 {
+		serial = uint32(time.Now().Unix())
+	}
+	h.serial.Store(serial)
+
+	return h, nil
+}
+
+// SetZones validates zones and swaps them in atomically, bumping the SOA
+// serial, which it returns. Upstreams kept from the previous zones keep
+// their health, breaker and latency state; cached answers of zones that
+// changed are dropped. On error the previous zones stay active.
+func (h *DNSHandler) SetZones(zones map[string]ZoneConfig) (uint32, error) {
+	if err := validateZones(zones); err != nil {
+		return 0, err
+	}
+
+	h.swapZones(zones, nil)
+	return h.bumpSerial(time.Now()), nil
+}
+
+// Reload applies what a config file can change from cfg: its zones as
+// SetZones does, DefaultPrefix, AnswerTTL, NegativeTTL and Overrides,
+// swapped in together. The rest of cfg is ignored. On error the previous
+// config stays active.
+func (h *DNSHandler) Reload(cfg Config) (uint32, error) {
+	overrides, err := parseOverrides(cfg.Overrides)
+	if err != nil {
+		return 0, fmt.Errorf("invalid OVERRIDES: %w", err)
+	}
+	if h.ttlMode == ttlModeCap && h.minTTL > cfg.AnswerTTL {
+		return 0, fmt.Errorf("invalid MIN_TTL: %d is above ANSWER_TTL %d with TTL_MODE=%s", h.minTTL, cfg.AnswerTTL, ttlModeCap)
+	}
+	if err := validateZones(cfg.Zones); err != nil {
+		return 0, err
+	}
+
+	h.swapZones(cfg.Zones, &globals{
+		defaultPrefix: cfg.DefaultPrefix,
+		negativeTTL:   cfg.NegativeTTL,
+		answerTTL:     cfg.AnswerTTL,
+		overrides:     overrides,
+	})
+	return h.bumpSerial(time.Now()), nil
+}
+
+// swapZones replaces the handler's zones and settings with zones and g,
+// nil keeping the current settings. Each zone carries the settings it
+// was loaded with, so a query sees the zone and settings of one reload,
+// never a mix. Cached answers of zones the swap removed or changed are
+// dropped, as are all of them when the prefix or a TTL changed.
+func (h *DNSHandler) swapZones(zones map[string]ZoneConfig, g *globals) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	prev, prevGlobals := h.zones, h.globals.Load()
+	if g == nil {
+		g = prevGlobals
+	}
+	zones = withState(zones, prev)
+	for name, cfg := range zones {
+		cfg.globals = g
+		zones[name] = cfg
+	}
+	h.zones = zones
+	h.globals.Store(g)
+
+	all := prevGlobals != nil && (g.defaultPrefix != prevGlobals.defaultPrefix ||
+		g.answerTTL != prevGlobals.answerTTL || g.negativeTTL != prevGlobals.negativeTTL)
+	changed := make(map[string]bool)
+	for name, old := range prev {
+		if cfg, ok := zones[name]; all || !ok || zoneChanged(old, cfg) {
+			changed[name] = true
+		}
+	}
+	h.cache.purge(changed)
+}
+
+// Run probes the upstreams every ProbeInterval and expires idle rate
+// limiter buckets until ctx is done. Queries are answered without it, but
+// health then stays at its initial all-up state.
+func (h *DNSHandler) Run(ctx context.Context) {
+	go h.limiter.cleanupLoop(ctx, time.Minute)
+	if h.probeInterval > 0 {
+		h.probeLoop(ctx, h.probeInterval)
+	}
+	<-ctx.Done()
+}
@@ -0,0 +1,174 @@
+package dnsfwd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReload(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"k8s-web. A": {mustRR("k8s-web. 30 IN A 10.0.0.6")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+	before := h.serial.Load()
+
+	zones, err := ParseZoneEnv("pod.example.=udp:10.0.0.1:53,other.example.=udp:10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Zones = zones
+	cfg.DefaultPrefix = "k8s-"
+	cfg.AnswerTTL = 120
+	cfg.Overrides = []string{"fixed.other.example. A 192.0.2.1"}
+	serial, err := h.Reload(cfg)
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if serial <= before {
+		t.Errorf("serial = %d after reload, want above %d", serial, before)
+	}
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 120 {
+		t.Errorf("answer = %v, want k8s-web.'s address with the new ANSWER_TTL", resp.Answer)
+	}
+
+	resp = exchange(t, h, "fixed.other.example.", dns.TypeA)
+	if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("answer = %v, want the new override", resp.Answer)
+	}
+
+	// A bad reload keeps everything as it was
+	cfg.DefaultPrefix = "bad-"
+	cfg.Overrides = []string{"broken"}
+	if _, err := h.Reload(cfg); err == nil {
+		t.Fatal("Reload with a bad override succeeded")
+	}
+	if g := h.globals.Load(); g.defaultPrefix != "k8s-" || len(g.overrides) != 1 {
+		t.Errorf("after a failed reload: prefix %q, %d overrides, want k8s- and 1", g.defaultPrefix, len(g.overrides))
+	}
+}
+
+func TestReloadSwapsZonesWithSettings(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{})
+	zones, err := ParseZoneEnv("pod.example.=udp:10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Zones = zones
+	cfg.DefaultPrefix = "k8s-"
+	if _, err := h.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	h.mu.RLock()
+	zone := h.zones["pod.example."]
+	h.mu.RUnlock()
+	if zone.globals != h.globals.Load() {
+		t.Error("the reloaded zone doesn't carry the settings it was loaded with")
+	}
+
+	// A query holding the zone keeps its settings across a later reload
+	cfg.DefaultPrefix = "later-"
+	if _, err := h.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := h.zonePrefix(&zone); got != "k8s-" {
+		t.Errorf("prefix = %q, want k8s- from the zone's own reload", got)
+	}
+}
+
+func TestReloadPurgesChangedZones(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53,other.example.=udp:10.0.0.2:53", fwd, func(c *Config) {
+		c.CacheSize = 16
+	})
+	query := func() {
+		t.Helper()
+		for _, name := range []string{"web.pod.example.", "web.other.example."} {
+			if resp := exchange(t, h, name, dns.TypeA); len(resp.Answer) != 1 {
+				t.Fatalf("%s: answer = %v, want one A record", name, resp.Answer)
+			}
+		}
+	}
+	query()
+
+	zones, err := ParseZoneEnv("pod.example.=udp:10.0.0.3:53,other.example.=udp:10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.SetZones(zones); err != nil {
+		t.Fatalf("SetZones: %v", err)
+	}
+	query()
+
+	want := []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"}
+	fwd.mu.Lock()
+	got := fwd.queries
+	fwd.mu.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("%d upstream queries, want %d: the changed zone forwarded again, the other cached", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].upstream != want[i] {
+			t.Errorf("query %d went to %s, want %s", i, got[i].upstream, want[i])
+		}
+	}
+
+	// New settings make every cached answer stale
+	cfg := DefaultConfig()
+	cfg.Zones = zones
+	cfg.AnswerTTL = 120
+	if _, err := h.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if n := h.cache.lru.Len(); n != 0 {
+		t.Errorf("%d cached answers after an ANSWER_TTL change, want none", n)
+	}
+}
+
+func TestSetZonesBumpsSerial(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{}, func(c *Config) {
+		c.SOASerial = 1
+	})
+	zones, err := ParseZoneEnv("pod.example.=udp:10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := uint32(1)
+	for range 2 {
+		serial, err := h.SetZones(zones)
+		if err != nil {
+			t.Fatalf("SetZones: %v", err)
+		}
+		if serial <= prev {
+			t.Errorf("serial = %d after a reload, want above %d", serial, prev)
+		}
+		soa := exchange(t, h, "pod.example.", dns.TypeSOA)
+		if len(soa.Answer) != 1 || soa.Answer[0].(*dns.SOA).Serial != serial {
+			t.Errorf("apex SOA = %v, want serial %d", soa.Answer, serial)
+		}
+		prev = serial
+	}
+
+	// A serial ahead of the clock still goes up, by one
+	h.serial.Store(4000000000)
+	if serial, _ := h.SetZones(zones); serial != 4000000001 {
+		t.Errorf("serial = %d, want 4000000001", serial)
+	}
+
+	// A failed reload leaves it alone
+	if _, err := h.SetZones(map[string]ZoneConfig{"pod.example.": {Zone: "pod.example."}}); err == nil {
+		t.Fatal("SetZones without upstreams succeeded")
+	}
+	if serial := h.serial.Load(); serial != 4000000001 {
+		t.Errorf("serial = %d after a failed reload, want 4000000001", serial)
+	}
+}
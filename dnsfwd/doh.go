@@ -0,0 +1,132 @@
+package dnsfwd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// DNS-over-HTTPS front-end (RFC 8484)
+// ---------------------------------------------
+
+const dohContentType = "application/dns-message"
+
+// dohResponseWriter is an in-memory dns.ResponseWriter that captures the
+// reply ServeDNS writes, so DoH runs through the same code path as
+// UDP/TCP.
+type dohResponseWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// tcpAddr parses an HTTP host:port into a *net.TCPAddr. Reporting DoH
+// clients as TCP keeps UDP-only logic such as truncation out of the way.
+func tcpAddr(hostport string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", hostport)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+func (h *DNSHandler) serveDoH(rw http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(rw, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// base64url without padding per RFC 8484, but tolerate padding
+		wire, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohContentType {
+			http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(rw, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	w := &dohResponseWriter{remote: tcpAddr(r.RemoteAddr)}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = local
+	}
+
+	h.ServeDNS(w, req)
+	if w.msg == nil {
+		http.Error(rw, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := w.msg.Pack()
+	if err != nil {
+		http.Error(rw, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minAnswerTTL(w.msg); ok {
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	if _, err := rw.Write(out); err != nil {
+		writeErrorsTotal.Inc()
+		slog.Warn("failed to write DoH response", "client", r.RemoteAddr, "error", err)
+	}
+}
+
+// NewDoHServer returns an HTTP server answering DNS-over-HTTPS at
+// /dns-query; set its TLSConfig to serve HTTPS.
+func (h *DNSHandler) NewDoHServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", h.serveDoH)
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
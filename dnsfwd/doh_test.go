@@ -0,0 +1,106 @@
+package dnsfwd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoH(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+	server := httptest.NewServer(h.NewDoHServer("").Handler)
+	defer server.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	req.Id = 0 // RFC 8484 asks for ID 0, for HTTP caches
+	wire, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() (*http.Response, error) {
+		return http.Get(server.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(wire))
+	}
+	post := func() (*http.Response, error) {
+		return http.Post(server.URL+"/dns-query", dohContentType, bytes.NewReader(wire))
+	}
+	for name, send := range map[string]func() (*http.Response, error){"GET": get, "POST": post} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := send()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %s, want 200", resp.Status)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, dohContentType)
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != "max-age=300" {
+				t.Errorf("Cache-Control = %q, want max-age=300", cc)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := new(dns.Msg)
+			if err := m.Unpack(body); err != nil {
+				t.Fatalf("unpacking the response: %v", err)
+			}
+			if len(m.Answer) != 1 || m.Answer[0].Header().Name != "web.pod.example." {
+				t.Errorf("answer = %v, want web.pod.example.'s A record", m.Answer)
+			}
+		})
+	}
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{})
+	server := httptest.NewServer(h.NewDoHServer("").Handler)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		ct         string
+		body       string
+		wantStatus int
+	}{
+		{"GET without dns", http.MethodGet, "", "", "", http.StatusBadRequest},
+		{"GET bad base64", http.MethodGet, "?dns=!!!", "", "", http.StatusBadRequest},
+		{"GET not a message", http.MethodGet, "?dns=AAAA", "", "", http.StatusBadRequest},
+		{"POST wrong type", http.MethodPost, "", "text/plain", "x", http.StatusUnsupportedMediaType},
+		{"POST not a message", http.MethodPost, "", dohContentType, "x", http.StatusBadRequest},
+		{"PUT", http.MethodPut, "", dohContentType, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, server.URL+"/dns-query"+tt.query, bytes.NewReader([]byte(tt.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.ct != "" {
+			req.Header.Set("Content-Type", tt.ct)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// EDNS0 handling for upstream queries
+// ---------------------------------------------
+
+// ECS_MODE values
+const (
+	ecsModeOff         = "off"
+	ecsModePassthrough = "passthrough" // copy the client's ECS option
+	ecsModeSynthesize  = "synthesize"  // build one from the client's address
+)
+
+// ensureOPT returns m's OPT record, adding an empty one if needed.
+func ensureOPT(m *dns.Msg) *dns.OPT {
+	if opt := m.IsEdns0(); opt != nil {
+		return opt
+	}
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	return m.IsEdns0()
+}
+
+// clientUDPSize returns the UDP payload size req advertises, never less
+// than the 512 bytes every client must accept.
+func clientUDPSize(req *dns.Msg) uint16 {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return opt.UDPSize()
+	}
+	return dns.MinMsgSize
+}
+
+func findSubnet(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// clientSubnet returns the ECS option to send upstream for req, or nil.
+func (h *DNSHandler) clientSubnet(req *dns.Msg, client net.IP) *dns.EDNS0_SUBNET {
+	switch h.ecsMode {
+	case ecsModePassthrough:
+		ecs := findSubnet(req.IsEdns0())
+		if ecs == nil {
+			return nil
+		}
+		return &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			Address:       ecs.Address,
+		}
+
+	case ecsModeSynthesize:
+		if client == nil {
+			return nil
+		}
+
+		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+		if ip4 := client.To4(); ip4 != nil {
+			ecs.Family = 1
+			ecs.SourceNetmask = h.ecsPrefixV4
+			ecs.Address = ip4.Mask(net.CIDRMask(int(h.ecsPrefixV4), 8*net.IPv4len))
+		} else {
+			ecs.Family = 2
+			ecs.SourceNetmask = h.ecsPrefixV6
+			ecs.Address = client.Mask(net.CIDRMask(int(h.ecsPrefixV6), 8*net.IPv6len))
+		}
+		return ecs
+	}
+
+	return nil
+}
+
+// restoreClientOPT makes resp's OPT record fit what the client sent: none
+// at all for non-EDNS clients, otherwise one advertising the client's
+// buffer size and without an ECS option the client didn't ask for. The
+// upstream's padding is dropped too, it was sized for another message.
+func restoreClientOPT(req, resp *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	if reqOpt != nil && resp.IsEdns0() == nil {
+		resp.SetEdns0(clientUDPSize(req), reqOpt.Do())
+	}
+
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			extra = append(extra, rr)
+			continue
+		}
+		if reqOpt == nil {
+			continue
+		}
+		opt.SetUDPSize(clientUDPSize(req))
+
+		keepECS := findSubnet(reqOpt) != nil
+		options := opt.Option[:0]
+		for _, o := range opt.Option {
+			switch o.(type) {
+			case *dns.EDNS0_SUBNET:
+				if !keepECS {
+					continue
+				}
+			case *dns.EDNS0_PADDING:
+				continue
+			}
+			options = append(options, o)
+		}
+		opt.Option = options
+		extra = append(extra, opt)
+	}
+	resp.Extra = extra
+}
+
+// ---------------------------------------------
+// Extended DNS Errors (RFC 8914)
+// ---------------------------------------------
+
+// withEDE attaches an Extended DNS Error explaining m's rcode, if the
+// client sent an OPT record to put it in, and returns m.
+func withEDE(req, m *dns.Msg, code uint16, text string) *dns.Msg {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return m
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(clientUDPSize(req), reqOpt.Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+	return m
+}
+
+// upstreamEDE describes why forwardQuery failed with err.
+func upstreamEDE(err error) (uint16, string) {
+	var netErr net.Error
+	var breakerErr *breakerOpenError
+	switch {
+	case errors.Is(err, errInflightFull):
+		return dns.ExtendedErrorCodeOther, "too many upstream queries in flight"
+	case errors.As(err, &breakerErr):
+		return dns.ExtendedErrorCodeNoReachableAuthority, breakerErr.Error()
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dns.ExtendedErrorCodeNoReachableAuthority, "upstream timeout"
+	}
+	return dns.ExtendedErrorCodeNetworkError, "upstream unreachable"
+}
+
+// ---------------------------------------------
+// Padding (RFC 7830, RFC 8467)
+// ---------------------------------------------
+
+// PADDING values
+const (
+	paddingOff   = "off"
+	paddingBlock = "block" // pad to paddingBlockSize
+)
+
+// paddingBlockSize is the response block length RFC 8467 recommends.
+const paddingBlockSize = 468
+
+// padResponse pads resp to a multiple of paddingBlockSize with PADDING=block.
+// As RFC 7830 asks, only responses to queries carrying a padding option
+// are padded, and only on encrypted transports (DoT and DoH), where the
+// size is all an observer sees.
+func (h *DNSHandler) padResponse(w dns.ResponseWriter, req, resp *dns.Msg) {
+	if h.padding != paddingBlock || !encryptedTransport(w) {
+		return
+	}
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil || !slices.ContainsFunc(reqOpt.Option, func(o dns.EDNS0) bool {
+		_, ok := o.(*dns.EDNS0_PADDING)
+		return ok
+	}) {
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(clientUDPSize(req), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+
+	// Len counts the empty option's 4-byte header already
+	if rem := resp.Len() % paddingBlockSize; rem != 0 {
+		padding.Padding = make([]byte, paddingBlockSize-rem)
+	}
+}
+
+// encryptedTransport reports whether w answers over DoT or DoH.
+func encryptedTransport(w dns.ResponseWriter) bool {
+	switch w := w.(type) {
+	case *dohResponseWriter:
+		return true
+	case dns.ConnectionStater:
+		return w.ConnectionState() != nil
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package dnsfwd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// ede returns the Extended DNS Error option in m, or nil without one.
+func ede(m *dns.Msg) *dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func TestExtendedDNSErrors(t *testing.T) {
+	failing := func(err error) Forwarder {
+		return forwardFunc(func(context.Context, *dns.Msg, *ZoneConfig, string, string) (*dns.Msg, error) {
+			return nil, err
+		})
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		fwd       Forwarder
+		configure func(*Config)
+		wantRcode int
+		wantEDE   bool
+		wantCode  uint16
+	}{
+		{
+			name:      "out of zone refused",
+			qname:     "web.other.example.",
+			fwd:       &stubForwarder{},
+			configure: func(c *Config) { c.OutOfZoneRcode = "refused" },
+			wantRcode: dns.RcodeRefused,
+			wantEDE:   true,
+			wantCode:  dns.ExtendedErrorCodeNotAuthoritative,
+		},
+		{
+			name:      "out of zone NXDOMAIN",
+			qname:     "web.other.example.",
+			fwd:       &stubForwarder{},
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name:      "blocked",
+			qname:     "tracker.pod.example.",
+			fwd:       &stubForwarder{},
+			configure: func(c *Config) { c.Blocklist = []string{"tracker.pod.example."} },
+			wantRcode: dns.RcodeNameError,
+			wantEDE:   true,
+			wantCode:  dns.ExtendedErrorCodeBlocked,
+		},
+		{
+			name:      "upstream timeout",
+			qname:     "web.pod.example.",
+			fwd:       failing(context.DeadlineExceeded),
+			wantRcode: dns.RcodeServerFailure,
+			wantEDE:   true,
+			wantCode:  dns.ExtendedErrorCodeNoReachableAuthority,
+		},
+		{
+			name:      "upstream unreachable",
+			qname:     "web.pod.example.",
+			fwd:       failing(errors.New("connection refused")),
+			wantRcode: dns.RcodeServerFailure,
+			wantEDE:   true,
+			wantCode:  dns.ExtendedErrorCodeNetworkError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var configure []func(*Config)
+			if tt.configure != nil {
+				configure = append(configure, tt.configure)
+			}
+			h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", tt.fwd, configure...)
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, dns.TypeA)
+			req.SetEdns0(1232, false)
+			resp := serve(t, h, req)
+
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			e := ede(resp)
+			switch {
+			case !tt.wantEDE && e != nil:
+				t.Errorf("EDE = %v, want none", e)
+			case tt.wantEDE && e == nil:
+				t.Errorf("no EDE, want code %d", tt.wantCode)
+			case tt.wantEDE && e.InfoCode != tt.wantCode:
+				t.Errorf("EDE code = %d (%q), want %d", e.InfoCode, e.ExtraText, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestExtendedDNSErrorNeedsEDNS(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{}, func(c *Config) {
+		c.OutOfZoneRcode = "refused"
+	})
+
+	resp := exchange(t, h, "web.other.example.", dns.TypeA)
+	if resp.IsEdns0() != nil {
+		t.Errorf("OPT in reply to a query without one: %v", resp.IsEdns0())
+	}
+}
+
+// tlsTestWriter is a testWriter that looks like a DoT connection.
+type tlsTestWriter struct {
+	*testWriter
+}
+
+func (w tlsTestWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{HandshakeComplete: true}
+}
+
+func TestPaddingBlock(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+		"systemd-lb. A": {
+			mustRR("systemd-lb. 30 IN A 10.0.0.1"),
+			mustRR("systemd-lb. 30 IN A 10.0.0.2"),
+			mustRR("systemd-lb. 30 IN A 10.0.0.3"),
+		},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.Padding = paddingBlock
+	})
+
+	query := func(encrypted bool, name string, pad bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(1232, false)
+		if pad {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+		}
+		tw := newTestWriter("tcp")
+		var w dns.ResponseWriter = tw
+		if encrypted {
+			w = tlsTestWriter{tw}
+		}
+		h.ServeDNS(w, req)
+		return tw.msg
+	}
+
+	for _, name := range []string{"web.pod.example.", "lb.pod.example.", "missing.pod.example.", "pod.example."} {
+		resp := query(true, name, true)
+		packed, err := resp.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed)%paddingBlockSize != 0 {
+			t.Errorf("%s: %d bytes over DoT, want a multiple of %d", name, len(packed), paddingBlockSize)
+		}
+	}
+
+	// Not over plain DNS, nor for a query without padding of its own
+	for _, tt := range []struct{ encrypted, pad bool }{{false, true}, {true, false}} {
+		resp := query(tt.encrypted, "web.pod.example.", tt.pad)
+		for _, o := range resp.IsEdns0().Option {
+			if _, ok := o.(*dns.EDNS0_PADDING); ok {
+				t.Errorf("encrypted %v, query padded %v: response padded", tt.encrypted, tt.pad)
+			}
+		}
+	}
+}
+
+// lastQuery returns the last message fwd sent upstream, or nil.
+func lastQuery(fwd *stubForwarder) *dns.Msg {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+
+	if len(fwd.queries) == 0 {
+		return nil
+	}
+	return fwd.queries[len(fwd.queries)-1].msg
+}
+
+func TestECSMode(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	clientECS := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4()}
+
+	tests := []struct {
+		mode string
+		ecs  *dns.EDNS0_SUBNET // in the client's query
+		want string            // upstream's ECS, "" for none
+	}{
+		{ecsModeOff, clientECS, ""},
+		{ecsModePassthrough, clientECS, "198.51.100.0/24/0"},
+		{ecsModePassthrough, nil, ""},
+		// From the client's address, 192.0.2.10, cut to ECS_PREFIX_V4
+		{ecsModeSynthesize, nil, "192.0.2.0/24/0"},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.ECSMode = tt.mode
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion("web.pod.example.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		if tt.ecs != nil {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, tt.ecs)
+		}
+		resp := serve(t, h, req)
+
+		var got string
+		if ecs := findSubnet(lastQuery(fwd).IsEdns0()); ecs != nil {
+			got = ecs.String()
+		}
+		if got != tt.want {
+			t.Errorf("ECS_MODE=%s, client ECS %v: upstream ECS = %q, want %q", tt.mode, tt.ecs != nil, got, tt.want)
+		}
+		// The client only gets an ECS option back if it sent one
+		if tt.ecs == nil && findSubnet(resp.IsEdns0()) != nil {
+			t.Errorf("ECS_MODE=%s: reply carries an ECS option the client didn't send", tt.mode)
+		}
+
+		// Local answers never go upstream, ECS or not
+		before := len(fwd.names())
+		req.SetQuestion("pod.example.", dns.TypeSOA)
+		if resp := serve(t, h, req); len(resp.Answer) != 1 {
+			t.Errorf("ECS_MODE=%s: apex SOA reply = %v, want the local SOA", tt.mode, resp)
+		}
+		if len(fwd.names()) != before {
+			t.Errorf("ECS_MODE=%s: the apex SOA was forwarded", tt.mode)
+		}
+	}
+
+	// ECS_PREFIX_V6 applies to IPv6 clients
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.ECSMode = ecsModeSynthesize
+	})
+	w := newTestWriter("udp")
+	w.remote = &net.UDPAddr{IP: net.ParseIP("2001:db8:1:2:3::1"), Port: 40000}
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	h.ServeDNS(w, req)
+	if ecs := findSubnet(lastQuery(fwd).IsEdns0()); ecs == nil || ecs.String() != "[2001:db8:1::]/56/0" {
+		t.Errorf("upstream ECS for an IPv6 client = %v, want [2001:db8:1::]/56/0", ecs)
+	}
+
+	if _, err := NewHandler(Config{ECSMode: "sometimes"}); err == nil {
+		t.Error("NewHandler with ECS_MODE=sometimes succeeded")
+	}
+}
+
+func TestStripDO(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+
+	tests := []struct {
+		strip, do bool
+		want      bool // DO upstream
+	}{
+		{true, true, false},
+		{false, true, true},
+		{false, false, false},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.StripDO = tt.strip
+		})
+		req := new(dns.Msg)
+		req.SetQuestion("web.pod.example.", dns.TypeA)
+		req.SetEdns0(1232, tt.do)
+		resp := serve(t, h, req)
+
+		opt := lastQuery(fwd).IsEdns0()
+		if opt == nil || opt.Do() != tt.want {
+			t.Errorf("STRIP_DO=%v, client DO %v: upstream OPT %v, want DO %v", tt.strip, tt.do, opt, tt.want)
+		}
+		if opt := resp.IsEdns0(); opt == nil || opt.Do() != tt.want {
+			t.Errorf("STRIP_DO=%v, client DO %v: reply OPT %v, want DO %v", tt.strip, tt.do, opt, tt.want)
+		}
+	}
+}
+
+func TestUpstreamUDPSize(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	tests := []struct {
+		size uint16 // the client's, 0 without EDNS
+		want uint16 // upstream's and the reply's, 0 for no OPT
+	}{
+		{0, 0},
+		{4096, 4096},
+		{1232, 1232},
+		// Below the 512 bytes every client takes
+		{256, dns.MinMsgSize},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("web.pod.example.", dns.TypeA)
+		if tt.size != 0 {
+			req.SetEdns0(tt.size, false)
+		}
+		resp := serve(t, h, req)
+
+		for name, m := range map[string]*dns.Msg{"upstream query": lastQuery(fwd), "reply": resp} {
+			var got uint16
+			if opt := m.IsEdns0(); opt != nil {
+				got = opt.UDPSize()
+			}
+			if got != tt.want {
+				t.Errorf("client size %d: %s advertises %d, want %d", tt.size, name, got, tt.want)
+			}
+		}
+	}
+
+	// The upstream's own OPT gives way to the client's size
+	h = newTestHandler(t, "pod.example.=udp:10.0.0.1:53", forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR("systemd-web. 30 IN A 10.0.0.5"))
+		resp.SetEdns0(65000, false)
+		return resp, nil
+	}))
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	if opt := serve(t, h, req).IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+		t.Errorf("reply OPT = %v, want the client's 1232 bytes", opt)
+	}
+}
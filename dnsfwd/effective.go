@@ -0,0 +1,255 @@
+package dnsfwd
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Effective configuration (/config)
+//
+// What the handler actually runs with, after defaults, the config file
+// and ZONES parsing, as JSON. The handler holds no credentials: TLS keys
+// stay with the listeners, and the upstream CA bundle only shows as
+// custom or system.
+// ---------------------------------------------
+
+type effectiveConfig struct {
+	DefaultPrefix     string   `json:"default_prefix"`
+	AnswerTTL         uint32   `json:"answer_ttl"`
+	NegativeTTL       uint32   `json:"negative_ttl"`
+	TTLMode           string   `json:"ttl_mode"`
+	MinTTL            uint32   `json:"min_ttl"`
+	ForwardTypes      []string `json:"forward_types"`
+	Overrides         int      `json:"overrides"`         // number of names
+	BlocklistEntries  int      `json:"blocklist_entries"` // names and "*." parents
+	BlockMode         string   `json:"block_mode"`
+	SinkholeAddrs     []string `json:"sinkhole_addrs"`
+	OutOfZoneRcode    string   `json:"out_of_zone_rcode"`
+	OutOfZoneSOA      string   `json:"out_of_zone_soa"`
+	Padding           string   `json:"padding"`
+	SOA               string   `json:"soa"` // as served, owner "."
+	NSAddrs           []string `json:"ns_addrs"`
+	BalanceMode       string   `json:"balance_mode"`
+	AAAAMode          string   `json:"aaaa_mode"`
+	AnyMode           string   `json:"any_mode"`
+	ApexMode          string   `json:"apex_mode"`
+	Authoritative     bool     `json:"authoritative"`
+	DNS64Prefix       string   `json:"dns64_prefix,omitempty"`
+	AllowCIDRs        []string `json:"allow_cidrs"`
+	RateLimit         float64  `json:"rate_limit"`
+	RateBurst         float64  `json:"rate_burst"`
+	RateLimitAction   string   `json:"rate_limit_action"`
+	MaxInflight       int      `json:"max_inflight"`
+	InflightWait      string   `json:"inflight_wait"`
+	StripDO           bool     `json:"strip_do"`
+	ECSMode           string   `json:"ecs_mode"`
+	ECSPrefixV4       uint8    `json:"ecs_prefix_v4"`
+	ECSPrefixV6       uint8    `json:"ecs_prefix_v6"`
+	UpstreamTimeout   string   `json:"upstream_timeout"`
+	QueryTimeout      string   `json:"query_timeout"`
+	UpstreamRetries   int      `json:"upstream_retries"`
+	AutoTCP           bool     `json:"auto_tcp"`
+	TCPCooldown       string   `json:"tcp_cooldown"`
+	BreakerThreshold  uint32   `json:"breaker_threshold"`
+	BreakerCooldown   string   `json:"breaker_cooldown"`
+	MaxAnswers        int      `json:"max_answers"`
+	ShuffleAnswers    bool     `json:"shuffle_answers"`
+	CaseRandomization bool     `json:"case_randomization"`
+	UpstreamTLSCA     string   `json:"upstream_tls_ca"` // custom or system
+	UpstreamBindAddrs []string `json:"upstream_bind_addr"`
+	UpstreamRD        string   `json:"upstream_rd"`
+	PoolMaxIdle       int      `json:"upstream_pool_max_idle"`
+	PoolIdleTimeout   string   `json:"upstream_pool_idle_timeout"`
+	CacheSize         int      `json:"cache_size"`
+	PrefetchThreshold float64  `json:"prefetch_threshold"`
+	ProbeInterval     string   `json:"probe_interval"`
+
+	Zones []effectiveZone `json:"zones"`
+}
+
+// effectiveZone is a ZoneConfig with the handler-wide fallbacks applied.
+type effectiveZone struct {
+	Zone          string   `json:"zone"`
+	Prefix        string   `json:"prefix"`             // empty for none
+	Prefixes      []string `json:"prefixes,omitempty"` // tried after prefix, empty for none
+	PrefixMode    string   `json:"prefix_mode"`
+	Rewrite       string   `json:"rewrite"`
+	Protocol      string   `json:"protocol"`
+	Upstreams     []string `json:"upstreams"`
+	TLSServerName string   `json:"tls_server_name,omitempty"`
+	Balance       string   `json:"balance"`
+	UpstreamZone  string   `json:"upstream_zone,omitempty"`
+	AllowedTypes  []string `json:"allowed_types"`
+	AnswerTTL     uint32   `json:"answer_ttl"`
+	NegativeTTL   uint32   `json:"negative_ttl"`
+	Reverse       bool     `json:"reverse"`
+
+	Views []effectiveView `json:"views,omitempty"`
+}
+
+type effectiveView struct {
+	CIDRs     []string `json:"cidrs"`
+	Upstreams []string `json:"upstreams"`
+}
+
+func typeNames(types []uint16) []string {
+	names := make([]string, 0, len(types))
+	for _, qtype := range types {
+		names = append(names, dns.TypeToString[qtype])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *DNSHandler) effectiveConfig() effectiveConfig {
+	g := h.globals.Load()
+	ec := effectiveConfig{
+		DefaultPrefix:     g.defaultPrefix,
+		AnswerTTL:         g.answerTTL,
+		NegativeTTL:       g.negativeTTL,
+		TTLMode:           h.ttlMode,
+		MinTTL:            h.minTTL,
+		ForwardTypes:      typeNames(slices.Collect(maps.Keys(h.forwardTypes))),
+		Overrides:         len(g.overrides),
+		BlockMode:         h.blockMode,
+		SinkholeAddrs:     []string{},
+		OutOfZoneRcode:    dns.RcodeToString[h.outOfZone],
+		OutOfZoneSOA:      h.outOfZoneSOA,
+		Padding:           h.padding,
+		SOA:               h.createLocalSOA(".", g.negativeTTL).String(),
+		NSAddrs:           []string{},
+		UpstreamBindAddrs: []string{},
+		UpstreamRD:        h.upstreamRD,
+		BalanceMode:       h.balance,
+		AAAAMode:          h.aaaaMode,
+		AnyMode:           h.anyMode,
+		ApexMode:          h.apexMode,
+		Authoritative:     h.authoritative,
+		AllowCIDRs:        []string{},
+		RateLimitAction:   "refuse",
+		StripDO:           h.stripDO,
+		ECSMode:           h.ecsMode,
+		ECSPrefixV4:       h.ecsPrefixV4,
+		ECSPrefixV6:       h.ecsPrefixV6,
+		UpstreamTimeout:   h.upstreamTimeout.String(),
+		QueryTimeout:      h.queryTimeout.String(),
+		UpstreamRetries:   h.retries,
+		AutoTCP:           h.autoTCP,
+		TCPCooldown:       h.tcpCooldown.String(),
+		BreakerThreshold:  h.breakerThreshold,
+		BreakerCooldown:   h.breakerCooldown.String(),
+		MaxAnswers:        h.maxAnswers,
+		ShuffleAnswers:    h.shuffleAnswers,
+		CaseRandomization: h.randomizeCase,
+		UpstreamTLSCA:     "system",
+		PrefetchThreshold: h.prefetchThreshold,
+		ProbeInterval:     h.probeInterval.String(),
+	}
+
+	if h.blocklist != nil {
+		ec.BlocklistEntries = len(h.blocklist.exact) + len(h.blocklist.parents)
+	}
+	for _, ip := range h.sinkhole {
+		ec.SinkholeAddrs = append(ec.SinkholeAddrs, ip.String())
+	}
+	for _, ip := range h.nsAddrs {
+		ec.NSAddrs = append(ec.NSAddrs, ip.String())
+	}
+	for _, ip := range h.bindAddrs {
+		ec.UpstreamBindAddrs = append(ec.UpstreamBindAddrs, ip.String())
+	}
+	if h.dns64 != nil {
+		ec.DNS64Prefix = h.dns64.String()
+	}
+	for _, n := range h.allowNets {
+		ec.AllowCIDRs = append(ec.AllowCIDRs, n.String())
+	}
+	if h.limiter != nil {
+		ec.RateLimit = h.limiter.rate
+		ec.RateBurst = h.limiter.burst
+		if h.limiter.drop {
+			ec.RateLimitAction = "drop"
+		}
+	}
+	if h.inflight != nil {
+		ec.MaxInflight = cap(h.inflight.slots)
+		ec.InflightWait = h.inflight.wait.String()
+	}
+	if h.upstreamCAs != nil {
+		ec.UpstreamTLSCA = "custom"
+	}
+	if h.pool != nil {
+		ec.PoolMaxIdle = h.pool.maxIdle
+		ec.PoolIdleTimeout = h.pool.idleTimeout.String()
+	}
+	if h.cache != nil {
+		ec.CacheSize = h.cache.size
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	names := slices.Sorted(maps.Keys(h.zones))
+	ec.Zones = make([]effectiveZone, 0, len(names))
+	for _, name := range names {
+		cfg := h.zones[name]
+		ez := effectiveZone{
+			Zone:          cfg.Zone,
+			Prefix:        h.zonePrefix(&cfg),
+			PrefixMode:    cmp.Or(cfg.PrefixMode, prefixModeFirst),
+			Rewrite:       cmp.Or(cfg.Rewrite, rewritePrefix),
+			Protocol:      cfg.Protocol,
+			Upstreams:     cfg.Upstreams,
+			TLSServerName: cfg.TLSServerName,
+			Balance:       h.zoneBalance(&cfg),
+			UpstreamZone:  cfg.UpstreamZone,
+			AnswerTTL:     h.zoneAnswerTTL(&cfg),
+			NegativeTTL:   h.zoneNegativeTTL(&cfg),
+			Reverse:       cfg.ReverseZone,
+		}
+		if cfg.NoRewrite {
+			ez.Rewrite = rewriteNone
+		}
+		if cfg.AllowedTypes != nil {
+			ez.AllowedTypes = typeNames(cfg.AllowedTypes)
+		} else {
+			ez.AllowedTypes = ec.ForwardTypes
+			if cfg.ReverseZone && !h.forwardTypes[dns.TypePTR] {
+				ez.AllowedTypes = append(slices.Clone(ez.AllowedTypes), "PTR")
+			}
+		}
+		for _, candidate := range cfg.prefixCandidates()[1:] {
+			ez.Prefixes = append(ez.Prefixes, h.zonePrefix(candidate))
+		}
+		for _, view := range cfg.Views {
+			ev := effectiveView{Upstreams: view.Upstreams}
+			for _, n := range view.CIDRs {
+				ev.CIDRs = append(ev.CIDRs, n.String())
+			}
+			ez.Views = append(ez.Views, ev)
+		}
+		if name == CatchAllZone {
+			ez.Prefix = ""
+		}
+		ec.Zones = append(ec.Zones, ez)
+	}
+	return ec
+}
+
+// ServeConfig answers with the effective configuration as JSON.
+func (h *DNSHandler) ServeConfig(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(h.effectiveConfig()); err != nil {
+		slog.Warn("failed to write /config response", "error", err)
+	}
+}
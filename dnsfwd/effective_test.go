@@ -0,0 +1,50 @@
+package dnsfwd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeConfig(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1;10.0.0.2:5353?answer_ttl=30,"+
+		"dot.example.=ext-:tls:1.1.1.1?rewrite=strip&tls_server_name=one.one.one.one,"+
+		"10.in-addr.arpa.=udp:10.0.0.1", &stubForwarder{}, func(c *Config) {
+		c.DefaultPrefix = "k8s-"
+		c.NegativeTTL = 20
+		c.Overrides = []string{"api.pod.example. A 10.0.0.5"}
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeConfig(rec, httptest.NewRequest("GET", "/config", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	var ec effectiveConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &ec); err != nil {
+		t.Fatalf("decoding /config: %v\n%s", err, rec.Body)
+	}
+	if ec.DefaultPrefix != "k8s-" || ec.AnswerTTL != 300 || ec.NegativeTTL != 20 || ec.Overrides != 1 || ec.UpstreamTLSCA != "system" {
+		t.Errorf("globals = prefix %q, TTLs %d/%d, %d overrides, CA %s", ec.DefaultPrefix, ec.AnswerTTL, ec.NegativeTTL, ec.Overrides, ec.UpstreamTLSCA)
+	}
+
+	want := []string{
+		"10.in-addr.arpa. prefix= rewrite=prefix udp 10.0.0.1:53 ttl=300/20 types=A,AAAA,PTR",
+		"dot.example. prefix=ext- rewrite=strip tls 1.1.1.1:853 ttl=300/20 types=A,AAAA",
+		"pod.example. prefix=k8s- rewrite=prefix udp 10.0.0.1:53,10.0.0.2:5353 ttl=30/20 types=A,AAAA",
+	}
+	var got []string
+	for _, z := range ec.Zones {
+		got = append(got, fmt.Sprintf("%s prefix=%s rewrite=%s %s %s ttl=%d/%d types=%s", z.Zone, z.Prefix, z.Rewrite,
+			z.Protocol, strings.Join(z.Upstreams, ","), z.AnswerTTL, z.NegativeTTL, strings.Join(z.AllowedTypes, ",")))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("zones\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if ec.Zones[1].TLSServerName != "one.one.one.one" {
+		t.Errorf("tls_server_name = %q, want one.one.one.one", ec.Zones[1].TLSServerName)
+	}
+}
@@ -0,0 +1,51 @@
+package dnsfwd_test
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/miekg/dns"
+
+	"github.com/totoCZ/dns_fwd/dnsfwd"
+)
+
+// A handler for one zone with the dns_fwd defaults, served over UDP.
+func ExampleNewHandler() {
+	zones, err := dnsfwd.ParseZoneEnv("pod.example.=udp:10.0.0.1:53")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := dnsfwd.DefaultConfig()
+	cfg.Zones = zones
+	cfg.DefaultPrefix = "systemd-"
+
+	handler, err := dnsfwd.NewHandler(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go handler.Run(context.Background()) // upstream probing and rate limiter cleanup
+
+	server := &dns.Server{Addr: ":53", Net: "udp", Handler: handler}
+	log.Fatal(server.ListenAndServe())
+}
+
+func ExampleDNSHandler_WriteZoneSummary() {
+	zones, err := dnsfwd.ParseZoneEnv("pod.example.=udp:10.0.0.1:53;10.0.0.2,10.in-addr.arpa.=tcp:10.0.0.1")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := dnsfwd.DefaultConfig()
+	cfg.Zones = zones
+
+	handler, err := dnsfwd.NewHandler(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler.WriteZoneSummary(os.Stdout)
+	// Output:
+	//   10.in-addr.arpa. prefix=(none) reverse tcp://10.0.0.1:53
+	//   pod.example. prefix=systemd- udp://10.0.0.1:53;10.0.0.2:53
+}
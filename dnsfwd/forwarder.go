@@ -0,0 +1,35 @@
+package dnsfwd
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Upstream exchanges
+// ---------------------------------------------
+
+// Forwarder performs one exchange of m with upstream over proto (udp, tcp
+// or tls) for zone cfg. Retries, failover and load balancing happen above
+// it, so a fake Forwarder lets the handler run without sockets.
+type Forwarder interface {
+	Forward(ctx context.Context, m *dns.Msg, cfg *ZoneConfig, proto, upstream string) (*dns.Msg, error)
+}
+
+// netForwarder is the Forwarder used in production: real exchanges,
+// pooled where the protocol allows.
+type netForwarder struct {
+	h *DNSHandler
+}
+
+func (f netForwarder) Forward(ctx context.Context, m *dns.Msg, cfg *ZoneConfig, proto, upstream string) (*dns.Msg, error) {
+	return f.h.exchange(ctx, f.h.newClient(cfg, proto, upstream), m, upstream)
+}
+
+func (h *DNSHandler) forward(ctx context.Context, m *dns.Msg, cfg *ZoneConfig, proto, upstream string) (*dns.Msg, error) {
+	if h.forwarder != nil {
+		return h.forwarder.Forward(ctx, m, cfg, proto, upstream)
+	}
+	return netForwarder{h: h}.Forward(ctx, m, cfg, proto, upstream)
+}
@@ -0,0 +1,432 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyForwarder fails the first failures exchanges with each upstream,
+// then answers with an A record. It counts the exchanges per upstream.
+type flakyForwarder struct {
+	failures int
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (f *flakyForwarder) Forward(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, upstream string) (*dns.Msg, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[upstream]++
+	if f.calls[upstream] <= f.failures {
+		return nil, errors.New("i/o timeout")
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 30 IN A 10.0.0.5"))
+	return resp, nil
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		retries   int
+		wantRcode int
+		wantCalls int
+	}{
+		{"no failures", 0, 1, dns.RcodeSuccess, 1},
+		{"fails once", 1, 1, dns.RcodeSuccess, 2},
+		{"fails twice with two retries", 2, 2, dns.RcodeSuccess, 3},
+		{"fails more than it's retried", 2, 1, dns.RcodeServerFailure, 2},
+		{"no retries", 1, 0, dns.RcodeServerFailure, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := &flakyForwarder{failures: tt.failures}
+			h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+				c.UpstreamRetries = tt.retries
+			})
+
+			resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if n := fwd.calls["10.0.0.1:53"]; n != tt.wantCalls {
+				t.Errorf("%d exchanges, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetriesThenFailover(t *testing.T) {
+	fwd := &flakyForwarder{failures: 5}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53;10.0.0.2:53", fwd, func(c *Config) {
+		c.UpstreamRetries = 1
+	})
+	// The second upstream fails just as often, but it's only asked after
+	// the first one's retries are used up
+	fwd.calls = map[string]int{"10.0.0.2:53": 5}
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("rcode = %s, want NOERROR from the second upstream", dns.RcodeToString[resp.Rcode])
+	}
+	if n := fwd.calls["10.0.0.1:53"]; n != 2 {
+		t.Errorf("%d exchanges with the first upstream, want 2", n)
+	}
+}
+
+// silentUpstream returns the address of a UDP socket that never answers,
+// open until the test ends.
+func silentUpstream(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func TestFailover(t *testing.T) {
+	quietLog(t)
+	dead, alive := silentUpstream(t), startUpstream(t, "udp", answerA)
+	configure := func(c *Config) {
+		c.UpstreamTimeout = 100 * time.Millisecond
+		c.UpstreamRetries = 0
+	}
+
+	// The dead first upstream costs one short timeout, not the whole query
+	h := newTestHandler(t, "pod.example.=udp:"+dead+";"+alive, nil, configure)
+	start := time.Now()
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("reply = %v, want the second upstream's answer", resp)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failover took %s, want about one 100ms timeout", elapsed)
+	}
+
+	h = newTestHandler(t, "pod.example.=udp:"+dead+";"+silentUpstream(t), nil, configure)
+	if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s with every upstream dead, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	buf := captureLog(t, slog.LevelWarn)
+	silent := silentUpstream(t)
+	h := newTestHandler(t, "pod.example.=udp:"+silent, nil, func(c *Config) {
+		c.UpstreamTimeout = 100 * time.Millisecond
+		c.UpstreamRetries = 0
+	})
+
+	start := time.Now()
+	if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SERVFAIL after %s, want one 100ms timeout", elapsed)
+	}
+	if log := buf.String(); !strings.Contains(log, `"upstream":"udp://`+silent+`"`) || !strings.Contains(log, "timeout") {
+		t.Errorf("log = %s, want the timeout with the upstream's address", log)
+	}
+}
+
+// truncatingForwarder answers over UDP with TC set and no records, and
+// over TCP in full, keeping the transport of every exchange.
+type truncatingForwarder struct {
+	mu     sync.Mutex
+	protos []string
+}
+
+func (f *truncatingForwarder) Forward(_ context.Context, m *dns.Msg, _ *ZoneConfig, proto, _ string) (*dns.Msg, error) {
+	f.mu.Lock()
+	f.protos = append(f.protos, proto)
+	f.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	if proto == "udp" {
+		resp.Truncated = true
+		return resp, nil
+	}
+	for _, ip := range []string{"10.0.0.5", "10.0.0.6"} {
+		resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 30 IN A "+ip))
+	}
+	return resp, nil
+}
+
+func TestAutoTCP(t *testing.T) {
+	fwd := &truncatingForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if resp.Truncated || len(resp.Answer) != 2 {
+		t.Errorf("reply = %v, want the full answer from TCP", resp)
+	}
+	if want := []string{"udp", "tcp"}; !slices.Equal(fwd.protos, want) {
+		t.Errorf("exchanges over %v, want %v", fwd.protos, want)
+	}
+}
+
+func TestAutoTCPOff(t *testing.T) {
+	fwd := &truncatingForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.AutoTCP = false
+	})
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if !resp.Truncated || len(resp.Answer) != 0 {
+		t.Errorf("reply = %v, want the truncated UDP answer", resp)
+	}
+	if want := []string{"udp"}; !slices.Equal(fwd.protos, want) {
+		t.Errorf("exchanges over %v, want %v", fwd.protos, want)
+	}
+}
+
+func TestTCPCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		cooldown time.Duration
+		wait     time.Duration
+		want     []string
+	}{
+		{"within the cooldown", time.Minute, 0, []string{"udp", "tcp", "tcp"}},
+		{"after the cooldown", 20 * time.Millisecond, 50 * time.Millisecond, []string{"udp", "tcp", "udp", "tcp"}},
+		{"disabled", 0, 0, []string{"udp", "tcp", "udp", "tcp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := &truncatingForwarder{}
+			h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+				c.TCPCooldown = tt.cooldown
+			})
+
+			exchange(t, h, "web.pod.example.", dns.TypeA)
+			time.Sleep(tt.wait)
+			resp := exchange(t, h, "app.pod.example.", dns.TypeA)
+			if resp.Truncated || len(resp.Answer) != 2 {
+				t.Errorf("reply = %v, want the full answer from TCP", resp)
+			}
+			if !slices.Equal(fwd.protos, tt.want) {
+				t.Errorf("exchanges over %v, want %v", fwd.protos, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardCancelled(t *testing.T) {
+	quietLog(t)
+	// An upstream that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := newTestHandler(t, "pod.example.=udp:"+pc.LocalAddr().String(), nil, func(c *Config) {
+		c.Context = ctx
+		c.UpstreamTimeout = 10 * time.Second
+		c.QueryTimeout = 0
+	})
+
+	done := make(chan *dns.Msg)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("web.pod.example.", dns.TypeA)
+		w := newTestWriter("udp")
+		h.ServeDNS(w, req)
+		done <- w.msg
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case resp := <-done:
+		if resp == nil || resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("reply = %v, want SERVFAIL", resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("query still in flight a second after the context was cancelled")
+	}
+}
+
+func TestMalformedResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(resp *dns.Msg)
+	}{
+		{"mismatched ID", func(resp *dns.Msg) { resp.Id++ }},
+		{"different name", func(resp *dns.Msg) { resp.Question[0].Name = "systemd-api." }},
+		{"different type", func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA }},
+		{"no question", func(resp *dns.Msg) { resp.Question = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+				resp := new(dns.Msg)
+				resp.SetReply(m)
+				resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 30 IN A 10.0.0.5"))
+				tt.mangle(resp)
+				return resp, nil
+			})
+			h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+				c.UpstreamRetries = 0
+			})
+			counter := malformedResponsesTotal.WithLabelValues("udp://10.0.0.1:53")
+			before := testutil.ToFloat64(counter)
+
+			resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+			if resp.Rcode != dns.RcodeServerFailure || len(resp.Answer) != 0 {
+				t.Errorf("reply = %v, want SERVFAIL", resp)
+			}
+			if n := testutil.ToFloat64(counter) - before; n != 1 {
+				t.Errorf("malformed_responses_total went up by %v, want 1", n)
+			}
+		})
+	}
+}
+
+func TestTCPZone(t *testing.T) {
+	zones, err := ParseZoneEnv("pod.example.=tcp:10.0.0.1:53,other.example.=udp:10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, q := zones["pod.example."].Protocol, zones["other.example."].Protocol; p != "tcp" || q != "udp" {
+		t.Fatalf("protocols = %s, %s, want tcp, udp", p, q)
+	}
+
+	var mu sync.Mutex
+	var protos []string
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, proto, _ string) (*dns.Msg, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		protos = append(protos, proto)
+		return nil, errors.New("connection reset")
+	})
+	h := newTestHandler(t, "pod.example.=tcp:10.0.0.1:53;10.0.0.2:53", fwd, func(c *Config) {
+		c.UpstreamRetries = 2
+	})
+
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	if len(protos) != 6 {
+		t.Errorf("%d exchanges, want 3 with each upstream", len(protos))
+	}
+	for _, proto := range protos {
+		if proto != "tcp" {
+			t.Fatalf("exchanges over %v, want TCP only", protos)
+		}
+	}
+}
+
+func TestTCPFallbackZone(t *testing.T) {
+	fwd := &truncatingForwarder{}
+	h := newTestHandler(t, "pod.example.=tcp-fallback:10.0.0.1:53", fwd, func(c *Config) {
+		c.AutoTCP = false
+	})
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if resp.Truncated || len(resp.Answer) != 2 {
+		t.Errorf("reply = %v, want the full answer from TCP", resp)
+	}
+	if want := []string{"udp", "tcp"}; !slices.Equal(fwd.protos, want) {
+		t.Errorf("exchanges over %v, want %v", fwd.protos, want)
+	}
+}
+
+func TestNewClientBindAddr(t *testing.T) {
+	tests := []struct {
+		bind      []string
+		proto     string
+		upstream  string
+		wantLocal string // "" for no Dialer
+	}{
+		{nil, "udp", "10.0.0.1:53", ""},
+		{[]string{"192.0.2.1", "2001:db8::1"}, "udp", "10.0.0.1:53", "udp 192.0.2.1:0"},
+		{[]string{"192.0.2.1", "2001:db8::1"}, "tcp", "10.0.0.1:53", "tcp 192.0.2.1:0"},
+		{[]string{"192.0.2.1", "2001:db8::1"}, "tls", "10.0.0.1:853", "tcp 192.0.2.1:0"},
+		{[]string{"192.0.2.1", "2001:db8::1"}, "udp", "[2001:db8::53]:53", "udp [2001:db8::1]:0"},
+		{[]string{"2001:db8::1", "192.0.2.1"}, "tcp", "[fe80::1%eth0]:53", "tcp [2001:db8::1]:0"},
+		// A hostname takes the first address
+		{[]string{"2001:db8::1", "192.0.2.1"}, "udp", "dns.example.net:53", "udp [2001:db8::1]:0"},
+		// Nothing of the upstream's family
+		{[]string{"192.0.2.1"}, "udp", "[2001:db8::53]:53", ""},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", nil, func(c *Config) {
+			c.UpstreamBindAddrs = tt.bind
+		})
+		c := h.newClient(&ZoneConfig{}, tt.proto, tt.upstream)
+
+		var got string
+		if c.Dialer != nil {
+			got = c.Dialer.LocalAddr.Network() + " " + c.Dialer.LocalAddr.String()
+			if c.Dialer.Timeout != h.upstreamTimeout {
+				t.Errorf("%v %s %s: dialer timeout %s, want %s", tt.bind, tt.proto, tt.upstream, c.Dialer.Timeout, h.upstreamTimeout)
+			}
+		}
+		if got != tt.wantLocal {
+			t.Errorf("%v %s %s: local address %q, want %q", tt.bind, tt.proto, tt.upstream, got, tt.wantLocal)
+		}
+	}
+}
+
+func TestUpstreamRD(t *testing.T) {
+	tests := []struct {
+		mode       string
+		wantWithRD bool // upstream RD for a client query with RD set
+		wantNoRD   bool // and without
+	}{
+		{upstreamRDOn, true, true},
+		{upstreamRDOff, false, false},
+		{upstreamRDMirror, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			fwd := &stubForwarder{}
+			h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+				c.UpstreamRD = tt.mode
+			})
+
+			for _, rd := range []bool{true, false} {
+				req := new(dns.Msg)
+				req.SetQuestion("web.pod.example.", dns.TypeA)
+				req.RecursionDesired = rd
+				resp := serve(t, h, req)
+				if resp.RecursionDesired != rd {
+					t.Errorf("client RD %v: reply RD %v, want the client's", rd, resp.RecursionDesired)
+				}
+			}
+
+			fwd.mu.Lock()
+			defer fwd.mu.Unlock()
+			if len(fwd.queries) != 2 {
+				t.Fatalf("%d upstream queries, want 2", len(fwd.queries))
+			}
+			if got := fwd.queries[0].msg.RecursionDesired; got != tt.wantWithRD {
+				t.Errorf("client RD set: upstream RD %v, want %v", got, tt.wantWithRD)
+			}
+			if got := fwd.queries[1].msg.RecursionDesired; got != tt.wantNoRD {
+				t.Errorf("client RD clear: upstream RD %v, want %v", got, tt.wantNoRD)
+			}
+		})
+	}
+}
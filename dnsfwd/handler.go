@@ -0,0 +1,1826 @@
+package dnsfwd
+
+import (
+	"cmp"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// ---------------------------------------------
+// Configuration structures
+// ---------------------------------------------
+
+// ZoneConfig is one zone served by a DNSHandler, as parsed from ZONES
+// or a config file.
+type ZoneConfig struct {
+	Zone       string   // normalized with trailing dot
+	Prefix     string   // optional override, fallback to handler.defaultPrefix; NoPrefix for none
+	Prefixes   []string // tried in order after Prefix when it finds nothing, see prefixCandidates
+	PrefixMode string   // first (default) or each
+	Rewrite    string   // prefix (default) or strip, see rewriteQuery
+	NoRewrite  bool     // pass-through: names are forwarded unchanged (rewrite=none)
+	Protocol   string   // udp/tcp/tls/tcp-fallback
+	Upstreams  []string // host:port or [ipv6]:port, tried in order
+
+	TLSServerName string // for tls, defaults to the upstream host
+	Balance       string // first/round-robin/random/latency, empty inherits BALANCE_MODE
+	UpstreamZone  string // internal zone upstream names end in, lowercased; empty is the root
+
+	AllowedTypes []uint16 // qtypes forwarded for this zone, nil uses FORWARD_TYPES
+	ReverseZone  bool     // under .arpa., names are forwarded unchanged and PTR is allowed
+
+	Views []ZoneView // split horizon: upstreams by client subnet, see forClient
+
+	// Optional overrides, zero inherits the handler's global value
+	AnswerTTL   uint32
+	NegativeTTL uint32
+
+	state   *zoneState // upstream health, shared by copies of the config
+	view    int        // 1-based index of the view narrowed to, 0 for none
+	globals *globals   // the settings loaded with the zone, see swapZones
+}
+
+// DNSHandler answers DNS queries for its zones, forwarding rewritten
+// queries upstream. Build one with NewHandler; it implements dns.Handler.
+type DNSHandler struct {
+	ctx               context.Context // cancelled on shutdown, nil in tests
+	mu                sync.RWMutex    // guards zones, swapped by SetZones
+	zones             map[string]ZoneConfig
+	globals           atomic.Pointer[globals] // swapped by Reload
+	cache             *responseCache
+	prefetchThreshold float64            // PREFETCH_THRESHOLD, fraction of the TTL left, 0 disables
+	flights           singleflight.Group // identical upstream queries in flight, see fetch
+	forwardTypes      map[uint16]bool    // qtypes rewritten and forwarded upstream
+	blocklist         *blocklist
+	blockMode         string        // BLOCK_MODE, nxdomain or sinkhole
+	sinkhole          []net.IP      // SINKHOLE_ADDRS, answers to blocked A/AAAA queries
+	outOfZone         int           // rcode for names outside every zone
+	outOfZoneSOA      string        // OUT_OF_ZONE_SOA, an owner name, none or closest
+	padding           string        // PADDING, off or block
+	soa               dns.SOA       // template for local SOAs, header, serial and Minttl set per zone
+	serial            atomic.Uint32 // SOA serial, bumped on reload
+	nsAddrs           []net.IP      // glue for SOA_MNAME in apex NS answers
+	balance           string        // BALANCE_MODE, per-zone overridable
+	ttlMode           string        // override, passthrough or cap
+	minTTL            uint32        // MIN_TTL, floor for upstream TTLs in passthrough and cap
+	aaaaMode          string        // AAAA_MODE, normal, empty or synthesize-from-a
+	anyMode           string        // ANY_MODE, refuse, forward or nxdomain
+	apexMode          string        // APEX_MODE, soa or ns
+	authoritative     bool          // AUTHORITATIVE, AA on the zones' local answers
+	dns64             *net.IPNet    // DNS64_PREFIX, set with synthesize-from-a
+	allowNets         []*net.IPNet  // client ACL, empty allows everyone
+	limiter           *rateLimiter
+	inflight          *inflightLimit // MAX_INFLIGHT, nil is unlimited
+	stripDO           bool
+	ecsMode           string // off, passthrough or synthesize
+	ecsPrefixV4       uint8
+	ecsPrefixV6       uint8
+
+	// upstreamTimeout bounds each dial/read/write of a single exchange, so
+	// a dead upstream fails over to the next one instead of stalling
+	upstreamTimeout time.Duration
+	queryTimeout    time.Duration // overall budget for retries and failover, 0 is unbounded
+	retries         int           // extra attempts per upstream
+	autoTCP         bool          // re-ask over TCP when a UDP answer is truncated
+	tcpCooldown     time.Duration // TCP_COOLDOWN, go straight to TCP after a truncation, 0 disables
+	maxAnswers      int           // MAX_ANSWERS per response, 0 is unlimited
+	shuffleAnswers  bool          // SHUFFLE_ANSWERS, randomize A/AAAA order
+	randomizeCase   bool          // CASE_RANDOMIZATION, 0x20 qnames upstream
+	pool            *connPool
+	upstreamCAs     *x509.CertPool // nil means system roots
+	bindAddrs       []net.IP       // UPSTREAM_BIND_ADDR, source addresses by family, empty lets the OS pick
+	upstreamRD      string         // UPSTREAM_RD, on, off or mirror
+	forwarder       Forwarder      // nil talks to the upstreams over the network
+	probeInterval   time.Duration  // for Run, 0 disables probing
+
+	// BREAKER_THRESHOLD consecutive failures open an upstream's breaker,
+	// skipping it for BREAKER_COOLDOWN; 0 disables
+	breakerThreshold uint32
+	breakerCooldown  time.Duration
+}
+
+// globals are the handler-wide settings a CONFIG_FILE can change, swapped
+// as one on reload.
+type globals struct {
+	defaultPrefix string
+	negativeTTL   uint32
+	answerTTL     uint32
+	overrides     map[overrideKey][]net.IP
+}
+
+// settings returns the settings cfg was loaded with, or the current ones
+// for a config that didn't come from the handler's zones.
+func (h *DNSHandler) settings(cfg *ZoneConfig) *globals {
+	if cfg.globals != nil {
+		return cfg.globals
+	}
+	return h.globals.Load()
+}
+
+// ---------------------------------------------
+// Parse ZONES
+// Format:
+//   ZONES=pod.hetmer.net.=udp:[ip]:53,net2.hetmer.net.=udp:10.42.0.1:53
+//
+// Optional prefixes, "-" for none at all instead of DEFAULT_PREFIX:
+//   ZONES=pod.hetmer.net.=systemd-:udp:[ip]:53
+//   ZONES=pod.hetmer.net.=-:udp:[ip]:53
+//
+// A prefix may be a template with %s marking the subdomain:
+//   ZONES=pod.hetmer.net.=%s.internal:udp:[ip]:53
+//
+// Several prefixes separated by "|" are tried in order, until one of them
+// finds the name:
+//   ZONES=pod.hetmer.net.=systemd-|k8s-:udp:[ip]:53
+//
+// Wildcard zones cover every name below their parent, but not the parent
+// itself; an explicit zone for the same parent wins:
+//   ZONES=*.hetmer.net.=udp:10.0.0.1:53
+//
+// The protocol is udp, tcp, tls (or dot), or tcp-fallback, which starts on
+// UDP and re-asks over TCP on truncation even with AUTO_TCP=false:
+//   ZONES=pod.hetmer.net.=tcp-fallback:10.0.0.1:53
+//
+// Multiple upstreams (failover, tried in order):
+//   ZONES=pod.hetmer.net.=udp:10.0.0.1:53;10.0.0.2:53
+//
+// Per-zone options, appended query-string style:
+//   ZONES="pod.hetmer.net.=udp:10.0.0.1:53?answer_ttl=30&negative_ttl=10"
+//
+// upstream_zone re-anchors the subdomain under an internal zone, with no
+// prefix unless the zone names one (web.pod.hetmer.net. -> web.systemd.internal.):
+//   ZONES="pod.hetmer.net.=udp:10.0.0.1:53?upstream_zone=systemd.internal."
+//
+// rewrite=strip turns the prefix around for upstreams that already use the
+// zone's names: clients ask for prefixed names, the upstream gets them
+// without (ext-web.pod.hetmer.net. -> web.pod.hetmer.net.):
+//   ZONES="pod.hetmer.net.=ext-:udp:10.0.0.1:53?rewrite=strip"
+//
+// rewrite=none makes a pass-through zone for upstreams that already use
+// the exact external names: they're forwarded unchanged, with no prefix:
+//   ZONES="corp.example.com.=udp:10.0.0.1:53?rewrite=none"
+//
+// Reverse zones (under .arpa.) forward their names unchanged, taking no
+// prefix, and allow PTR on top of FORWARD_TYPES:
+//   ZONES=10.in-addr.arpa.=udp:10.0.0.1:53
+//
+// Each entry is split on its first "=" only, so zone names cannot
+// contain "=" but values may. Whitespace around entries is ignored, and so
+// are empty ones, as left by a trailing comma.
+// ---------------------------------------------
+
+// ParseZoneEnv parses a ZONES value in the format above.
+func ParseZoneEnv(env string) (map[string]ZoneConfig, error) {
+	zones := make(map[string]ZoneConfig)
+
+	if env == "" {
+		return nil, fmt.Errorf("ZONES env var must not be empty")
+	}
+
+	entries, err := splitZoneEntries(env)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		// Leftovers of a trailing or doubled comma are not entries
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		// Only the first "=" separates zone from value; anything after it
+		// belongs to the value
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid ZONES entry: %s", entry)
+		}
+
+		// Space around the "=" is no part of either side: "a. = udp:..."
+		zone := strings.TrimSpace(parts[0])
+		if zone == "" {
+			return nil, fmt.Errorf("invalid ZONES entry: %s", entry)
+		}
+		if !strings.HasSuffix(zone, ".") {
+			zone += "."
+		}
+
+		value, options, _ := strings.Cut(strings.TrimSpace(parts[1]), "?")
+
+		prefix, proto, upstreams, err := parseZoneValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ZONES entry %s: %w", entry, err)
+		}
+
+		prefix, prefixes := splitPrefixes(prefix)
+		cfg := ZoneConfig{
+			Zone:        zone,
+			Prefix:      prefix,
+			Prefixes:    prefixes,
+			Protocol:    proto,
+			Upstreams:   upstreams,
+			ReverseZone: isReverseZone(zone),
+		}
+		if err := parseZoneOptions(&cfg, options); err != nil {
+			return nil, fmt.Errorf("invalid ZONES entry %s: %w", entry, err)
+		}
+
+		zones[zone] = cfg
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("ZONES has no entries")
+	}
+
+	return zones, nil
+}
+
+// splitZoneEntries splits ZONES on the commas outside double quotes, so a
+// quoted segment can carry commas of its own:
+//
+//	"a.=udp:1.1.1.1:53;2.2.2.2:53",b.=udp:10.0.0.1:53
+//
+// The quotes are removed and may cover a whole entry or any part of it.
+func splitZoneEntries(env string) ([]string, error) {
+	var entries []string
+	var entry strings.Builder
+	quoted := false
+	for _, c := range env {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			entries = append(entries, entry.String())
+			entry.Reset()
+		default:
+			entry.WriteRune(c)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in ZONES")
+	}
+	return append(entries, entry.String()), nil
+}
+
+// parseZoneValue splits "[prefix:]proto:upstream[;upstream...]". The prefix
+// is only recognized when the first field is not a known protocol, so
+// everything after the protocol is free to contain colons (IPv6).
+func parseZoneValue(value string) (prefix, proto string, upstreams []string, err error) {
+	field1, rest, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", "", nil, fmt.Errorf("missing protocol")
+	}
+
+	if isProtocol(field1) {
+		proto = field1
+	} else {
+		prefix = field1
+		if proto, rest, ok = strings.Cut(rest, ":"); !ok {
+			return "", "", nil, fmt.Errorf("missing protocol after prefix %q", prefix)
+		}
+	}
+	proto = normalizeProtocol(proto)
+
+	for _, upstream := range strings.Split(rest, ";") {
+		if upstream = strings.TrimSpace(upstream); upstream == "" {
+			continue
+		}
+		normalized, err := normalizeUpstream(upstream, proto)
+		if err != nil {
+			return "", "", nil, err
+		}
+		upstreams = append(upstreams, normalized)
+	}
+	if len(upstreams) == 0 {
+		return "", "", nil, fmt.Errorf("no upstreams")
+	}
+
+	return prefix, proto, upstreams, nil
+}
+
+func isProtocol(proto string) bool {
+	switch proto {
+	case "udp", "tcp", "tls", "dot", "tcp-fallback":
+		return true
+	}
+	return false
+}
+
+// transport returns the protocol queries for a zone using proto go out
+// over first: tcp-fallback starts on UDP and only moves to TCP when an
+// answer comes back truncated.
+func transport(proto string) string {
+	if proto == "tcp-fallback" {
+		return "udp"
+	}
+	return proto
+}
+
+// normalizeProtocol maps the "dot" alias to "tls".
+func normalizeProtocol(proto string) string {
+	if proto == "dot" {
+		return "tls"
+	}
+	return proto
+}
+
+// parseZoneOptions applies "key=value&key=value" options to cfg.
+func parseZoneOptions(cfg *ZoneConfig, options string) error {
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+
+	for key, vals := range values {
+		value := vals[len(vals)-1]
+
+		switch key {
+		case "answer_ttl", "negative_ttl":
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", key, value)
+			}
+			if key == "answer_ttl" {
+				cfg.AnswerTTL = uint32(ttl)
+			} else {
+				cfg.NegativeTTL = uint32(ttl)
+			}
+		case "tls_server_name":
+			cfg.TLSServerName = value
+		case "balance":
+			cfg.Balance = value
+		case "prefix_mode":
+			cfg.PrefixMode = value
+		case "rewrite":
+			if value == rewriteNone {
+				cfg.NoRewrite = true
+			} else {
+				cfg.Rewrite = value
+			}
+		case "upstream_zone":
+			cfg.UpstreamZone = strings.ToLower(dns.Fqdn(value))
+		default:
+			return fmt.Errorf("unknown option %s", key)
+		}
+	}
+
+	return nil
+}
+
+const (
+	defaultDNSPort = "53"
+	defaultDoTPort = "853"
+)
+
+// defaultPort returns the port upstreams of proto listen on by default.
+func defaultPort(proto string) string {
+	if proto == "tls" {
+		return defaultDoTPort
+	}
+	return defaultDNSPort
+}
+
+// normalizeUpstream returns upstream as host:port. It accepts IPv4,
+// hostnames, and IPv6 literals either bracketed ([::1]:53) or bare (::1),
+// including zone IDs (fe80::1%eth0). A missing port defaults to 53, or
+// 853 for tls.
+func normalizeUpstream(upstream, proto string) (string, error) {
+	if strings.HasPrefix(upstream, "[") {
+		end := strings.Index(upstream, "]")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated IPv6 literal in upstream %s", upstream)
+		}
+
+		host, rest := upstream[1:end], upstream[end+1:]
+		switch {
+		case host == "":
+			return "", fmt.Errorf("empty host in upstream %s", upstream)
+		case rest == "":
+			return net.JoinHostPort(host, defaultPort(proto)), nil
+		case strings.HasPrefix(rest, ":") && len(rest) > 1:
+			return net.JoinHostPort(host, rest[1:]), nil
+		default:
+			return "", fmt.Errorf("invalid port in upstream %s", upstream)
+		}
+	}
+
+	// More than one colon without brackets can only be a bare IPv6 literal
+	if strings.Count(upstream, ":") > 1 {
+		return net.JoinHostPort(upstream, defaultPort(proto)), nil
+	}
+
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		// no port at all
+		return net.JoinHostPort(upstream, defaultPort(proto)), nil
+	}
+	if host == "" || port == "" {
+		return "", fmt.Errorf("invalid upstream %s", upstream)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// parseTypeList parses a list of qtype names such as "A", "AAAA", "SRV".
+func parseTypeList(names []string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		qtype, ok := dns.StringToType[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type: %s", name)
+		}
+		types[qtype] = true
+	}
+	return types, nil
+}
+
+// typeAllowed reports whether qtype is forwarded for cfg: its
+// allowed_types when set, FORWARD_TYPES (plus PTR for reverse zones)
+// otherwise. ANY_MODE=forward lets ANY through everywhere.
+func (h *DNSHandler) typeAllowed(cfg *ZoneConfig, qtype uint16) bool {
+	if qtype == dns.TypeANY && h.anyMode == anyModeForward {
+		return true
+	}
+	if cfg.AllowedTypes != nil {
+		return slices.Contains(cfg.AllowedTypes, qtype)
+	}
+	return h.forwardTypes[qtype] || (cfg.ReverseZone && qtype == dns.TypePTR)
+}
+
+// isReverseZone reports whether zone is in the reverse mapping tree,
+// in-addr.arpa. or ip6.arpa. (or any other .arpa. zone).
+func isReverseZone(zone string) bool {
+	return dns.IsSubDomain("arpa.", strings.TrimPrefix(zone, "*."))
+}
+
+// ---------------------------------------------
+// SOA creation per zone
+// ---------------------------------------------
+
+// createLocalSOA returns the SOA served for zone, built from the
+// SOA_* settings.
+func (h *DNSHandler) createLocalSOA(zone string, negativeTTL uint32) *dns.SOA {
+	soa := h.soa
+	soa.Hdr = dns.RR_Header{
+		Name:   zone,
+		Rrtype: dns.TypeSOA,
+		Class:  dns.ClassINET,
+		Ttl:    negativeTTL,
+	}
+	soa.Serial = h.serial.Load()
+	soa.Minttl = negativeTTL
+	return &soa
+}
+
+// errorResponse builds the reply to req with rcode and nothing but,
+// unless zone is empty, the local SOA for zone in the authority section.
+// Negative answers (NXDOMAIN, NODATA) need that SOA for negative caching;
+// REFUSED, SERVFAIL and FORMERR go without.
+func (h *DNSHandler) errorResponse(req *dns.Msg, rcode int, zone string, negativeTTL uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	if zone != "" {
+		m.Ns = append(m.Ns, h.createLocalSOA(zone, negativeTTL))
+	}
+	return m
+}
+
+// zoneErrorResponse is errorResponse with cfg's SOA and negative TTL,
+// flagged authoritative per AUTHORITATIVE as the zone's own data.
+func (h *DNSHandler) zoneErrorResponse(req *dns.Msg, rcode int, cfg *ZoneConfig) *dns.Msg {
+	m := h.errorResponse(req, rcode, cfg.origin(), h.zoneNegativeTTL(cfg))
+	m.Authoritative = h.authoritative
+	return m
+}
+
+// OUT_OF_ZONE_SOA values other than an owner name
+const (
+	outOfZoneSOANone    = "none"    // NXDOMAIN without authority section
+	outOfZoneSOAClosest = "closest" // the SOA of the zone sharing most labels
+)
+
+// outOfZoneSOAOwner returns the owner and negative TTL of the SOA in an
+// out-of-zone NXDOMAIN for the lowercased name per OUT_OF_ZONE_SOA, with
+// an empty owner for none. closest falls back to none when no zone shares
+// a label with name.
+func (h *DNSHandler) outOfZoneSOAOwner(name string) (string, uint32) {
+	switch h.outOfZoneSOA {
+	case outOfZoneSOANone:
+		return "", 0
+	case outOfZoneSOAClosest:
+	default:
+		return h.outOfZoneSOA, h.globals.Load().negativeTTL
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var best *ZoneConfig
+	bestLabels := 0
+	for _, cfg := range h.zones {
+		labels := dns.CompareDomainName(name, cfg.origin())
+		if labels > bestLabels || (labels == bestLabels && best != nil && cfg.Zone < best.Zone) {
+			best = &cfg
+			bestLabels = labels
+		}
+	}
+	if best == nil {
+		return "", 0
+	}
+	return best.origin(), h.zoneNegativeTTL(best)
+}
+
+// bumpSerial moves the SOA serial to now as a unix timestamp, or one past
+// the current serial if that's not later, so every reload shows.
+func (h *DNSHandler) bumpSerial(now time.Time) uint32 {
+	for {
+		old := h.serial.Load()
+		next := uint32(now.Unix())
+		if next <= old {
+			next = old + 1
+		}
+		if h.serial.CompareAndSwap(old, next) {
+			return next
+		}
+	}
+}
+
+// createLocalNS returns the NS record served at zone's apex, naming
+// SOA_MNAME.
+func (h *DNSHandler) createLocalNS(zone string, ttl uint32) *dns.NS {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+		Ns:  h.soa.Ns,
+	}
+}
+
+// nsGlue returns address records for SOA_MNAME from NS_ADDRS.
+func (h *DNSHandler) nsGlue(ttl uint32) []dns.RR {
+	var glue []dns.RR
+	for _, ip := range h.nsAddrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr := dns.RR_Header{Name: h.soa.Ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+			glue = append(glue, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr := dns.RR_Header{Name: h.soa.Ns, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
+			glue = append(glue, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return glue
+}
+
+// parseIPs parses a list of IP addresses, skipping empty entries.
+func parseIPs(list []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parseSOAName turns an SOA_MNAME/SOA_RNAME value into a domain name. For
+// RNAME, an email address like hostmaster@example.com is accepted too.
+func parseSOAName(name string) (string, error) {
+	if local, domain, ok := strings.Cut(name, "@"); ok {
+		name = strings.ReplaceAll(local, ".", `\.`) + "." + domain
+	}
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return name, nil
+}
+
+// zoneAnswerTTL and zoneNegativeTTL return the zone's override, if any,
+// or the global value.
+func (h *DNSHandler) zoneAnswerTTL(cfg *ZoneConfig) uint32 {
+	if cfg.AnswerTTL != 0 {
+		return cfg.AnswerTTL
+	}
+	return h.settings(cfg).answerTTL
+}
+
+// TTL_MODE values
+const (
+	ttlModeOverride    = "override"    // always answerTTL
+	ttlModePassthrough = "passthrough" // keep the upstream TTL
+	ttlModeCap         = "cap"         // upstream TTL, at most answerTTL
+)
+
+// rewrittenTTL returns the TTL to hand out for a rewritten record that
+// arrived from upstream with ttl. Upstream TTLs are raised to MIN_TTL
+// first, so in cap mode a zone answer_ttl below it still wins.
+func (h *DNSHandler) rewrittenTTL(cfg *ZoneConfig, ttl uint32) uint32 {
+	switch h.ttlMode {
+	case ttlModePassthrough:
+		return max(ttl, h.minTTL)
+	case ttlModeCap:
+		return min(max(ttl, h.minTTL), h.zoneAnswerTTL(cfg))
+	default:
+		return h.zoneAnswerTTL(cfg)
+	}
+}
+
+func (h *DNSHandler) zoneNegativeTTL(cfg *ZoneConfig) uint32 {
+	if cfg.NegativeTTL != 0 {
+		return cfg.NegativeTTL
+	}
+	return h.settings(cfg).negativeTTL
+}
+
+// ---------------------------------------------
+// Zone matching
+// ---------------------------------------------
+
+// CatchAllZone is the zone key for names matching no other zone. Queries
+// for it are forwarded without any rewriting.
+const CatchAllZone = "."
+
+// isWildcard reports whether cfg is a "*.parent." zone, covering every
+// name below parent but not parent itself.
+func (cfg *ZoneConfig) isWildcard() bool {
+	return strings.HasPrefix(cfg.Zone, "*.")
+}
+
+// origin returns the name cfg's subdomains are relative to: the zone
+// itself, or a wildcard's parent.
+func (cfg *ZoneConfig) origin() string {
+	if cfg.isWildcard() {
+		return cfg.Zone[2:]
+	}
+	return cfg.Zone
+}
+
+// beats reports whether cfg, with lowercased origin zone, is a more
+// specific match than best. Longer origins win, and on equal origins an
+// explicit zone beats a wildcard. Other ties only happen for zones
+// differing in case; break them by name to stay deterministic.
+func beats(cfg *ZoneConfig, zone string, best *ZoneConfig, bestZone string) bool {
+	switch {
+	case len(zone) != len(bestZone):
+		return len(zone) > len(bestZone)
+	case cfg.isWildcard() != best.isWildcard():
+		return !cfg.isWildcard()
+	default:
+		return cfg.Zone < best.Zone
+	}
+}
+
+// selectZoneForName returns the most specific zone containing name, and
+// whether name is that zone's apex. The longest matching zone wins, so
+// "x.sub.example." picks "sub.example." over "example." regardless of map
+// order; an apex match is by definition the longest possible.
+func (h *DNSHandler) selectZoneForName(name string) (*ZoneConfig, bool, bool) {
+	name = strings.ToLower(name)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// best is kept by value so only the winner's copy ends up on the heap
+	var best ZoneConfig
+	var bestZone string
+	found := false
+	for _, cfg := range h.zones {
+		zone := strings.ToLower(cfg.origin())
+		if cfg.Zone == CatchAllZone {
+			continue
+		}
+
+		// Apex: exact match, Subdomain: ends with ".zone". Wildcards
+		// have no apex.
+		if (name != zone || cfg.isWildcard()) && !isBelow(name, zone) {
+			continue
+		}
+
+		if !found || beats(&cfg, zone, &best, bestZone) {
+			best = cfg
+			bestZone = zone
+			found = true
+		}
+	}
+
+	if !found {
+		// Fall back to the catch-all zone, which has no apex
+		if cfg, ok := h.zones[CatchAllZone]; ok {
+			return &cfg, true, false
+		}
+		return nil, false, false
+	}
+	winner := best
+	return &winner, true, name == bestZone
+}
+
+// isBelow reports whether the lowercased name is a strict subdomain of
+// the lowercased zone, without building "."+zone.
+func isBelow(name, zone string) bool {
+	if zone == "." {
+		return name != "."
+	}
+	n := len(name) - len(zone)
+	return n > 0 && name[n-1] == '.' && name[n:] == zone
+}
+
+// inZone is dns.IsSubDomain for fully qualified names, without splitting
+// them into labels: name is zone or below it, ignoring case.
+func inZone(zone, name string) bool {
+	if zone == "." {
+		return true
+	}
+	n := len(name) - len(zone)
+	return n >= 0 && strings.EqualFold(name[n:], zone) && (n == 0 || name[n-1] == '.')
+}
+
+// ---------------------------------------------
+// Query rewriting
+// ---------------------------------------------
+
+// rewriteQuery maps a client name under cfg's zone to the upstream name.
+// The default prefix rewrite puts the subdomain into the zone's prefix
+// template; strip does the reverse, taking the template off client names
+// that carry it (systemd-web.pod.hetmer.net. -> web.pod.hetmer.net.) and
+// failing for those that don't.
+func (h *DNSHandler) rewriteQuery(name string, cfg *ZoneConfig) (string, error) {
+	name = strings.ToLower(name)
+	zone := strings.ToLower(cfg.origin())
+
+	subdomain, ok := strings.CutSuffix(name, "."+zone)
+	if !ok || subdomain == "" {
+		return "", fmt.Errorf("empty subdomain after trimming zone")
+	}
+
+	// Reverse names mean the same thing everywhere, and pass-through
+	// zones' upstreams use the client's names already
+	if cfg.ReverseZone || cfg.NoRewrite {
+		return name, nil
+	}
+
+	if cfg.Rewrite != rewriteStrip {
+		return h.applyTemplate(subdomain, cfg, upstreamSuffix(cfg)+"."), nil
+	}
+	if subdomain, ok = h.removeTemplate(subdomain, cfg); !ok {
+		return "", fmt.Errorf("%s does not match the prefix of zone %s", name, cfg.Zone)
+	}
+	return subdomain + upstreamSuffix(cfg) + ".", nil
+}
+
+// Rewrite directions
+const (
+	rewritePrefix = "prefix" // client web. -> upstream systemd-web.
+	rewriteStrip  = "strip"  // client systemd-web. -> upstream web.
+	rewriteNone   = "none"   // client web. -> upstream web., sets NoRewrite
+)
+
+// upstreamZone returns the zone upstream names live in: upstream_zone, or
+// for strip zones the zone itself, as the upstream already uses the
+// client's naming apart from the prefix. Empty is the root.
+func upstreamZone(cfg *ZoneConfig) string {
+	if cfg.UpstreamZone == "" && cfg.Rewrite == rewriteStrip {
+		return strings.ToLower(cfg.origin())
+	}
+	return cfg.UpstreamZone
+}
+
+// upstreamSuffix returns ".<upstream zone>" without the trailing dot, or
+// "" when upstream names live at the root.
+func upstreamSuffix(cfg *ZoneConfig) string {
+	if zone := upstreamZone(cfg); zone != "" && zone != "." {
+		return "." + strings.TrimSuffix(zone, ".")
+	}
+	return ""
+}
+
+// Prefix modes
+const (
+	prefixModeFirst = "first" // the template wraps the whole subdomain
+	prefixModeEach  = "each"  // the template wraps every label
+)
+
+// NoPrefix as a zone's prefix turns prefixing off for it, where an empty
+// prefix inherits DEFAULT_PREFIX: web.pod.hetmer.net. goes upstream as
+// web. (or web.<upstream_zone>).
+const NoPrefix = "-"
+
+func (h *DNSHandler) zonePrefix(cfg *ZoneConfig) string {
+	switch {
+	case cfg.Prefix == NoPrefix || cfg.ReverseZone || cfg.NoRewrite:
+		return ""
+	case cfg.Prefix == "" && cfg.UpstreamZone != "":
+		return ""
+	case cfg.Prefix == "":
+		return h.settings(cfg).defaultPrefix
+	}
+	return cfg.Prefix
+}
+
+// prefixTemplate splits the zone's prefix around its "%s" placeholder,
+// which marks where the subdomain goes: "systemd-%s" and plain "systemd-"
+// both prepend, "%s.internal" appends. Matching is case-insensitive, so
+// both halves are lowercased.
+func (h *DNSHandler) prefixTemplate(cfg *ZoneConfig) (before, after string) {
+	before, after, _ = strings.Cut(strings.ToLower(h.zonePrefix(cfg)), "%s")
+	return before, strings.TrimSuffix(after, ".")
+}
+
+// restoreName is the inverse of rewriteQuery: it maps an upstream name
+// such as "systemd-bar." back to "bar.<zone>", or for strip zones
+// "bar.<zone>" to "systemd-bar.<zone>". It reports false for names outside
+// the upstream zone and, for prefix zones, names that don't fit the
+// zone's prefix template.
+func (h *DNSHandler) restoreName(name string, cfg *ZoneConfig) (string, bool) {
+	// Pass-through names are client names already, the apex aside, as
+	// rewriteQuery never sends it upstream
+	if cfg.NoRewrite {
+		return name, inZone(cfg.origin(), name) && !strings.EqualFold(name, cfg.origin())
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	if suffix := upstreamSuffix(cfg); suffix != "" {
+		var ok bool
+		if name, ok = strings.CutSuffix(name, suffix); !ok {
+			return "", false
+		}
+	}
+	if name == "" {
+		return "", false
+	}
+
+	if cfg.Rewrite == rewriteStrip {
+		return h.applyTemplate(name, cfg, "."+cfg.origin()), true
+	}
+	// Without a prefix or upstream zone every name would fit, so only the
+	// rewritten query name itself maps back, in rewriteResponse
+	if before, after := h.prefixTemplate(cfg); before == "" && after == "" && upstreamSuffix(cfg) == "" {
+		return "", false
+	}
+	subdomain, ok := h.removeTemplate(name, cfg)
+	if !ok {
+		return "", false
+	}
+	return subdomain + "." + cfg.origin(), true
+}
+
+// applyTemplate puts subdomain, lowercased and without trailing dot, into
+// the zone's prefix template, as a whole or label by label per its
+// prefix_mode, followed by tail.
+func (h *DNSHandler) applyTemplate(subdomain string, cfg *ZoneConfig, tail string) string {
+	before, after := h.prefixTemplate(cfg)
+	if cfg.PrefixMode != prefixModeEach {
+		return before + subdomain + after + tail
+	}
+
+	var b strings.Builder
+	b.Grow(len(subdomain) + (strings.Count(subdomain, ".")+1)*(len(before)+len(after)) + len(tail))
+	for i, label := range strings.Split(subdomain, ".") {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(before)
+		b.WriteString(label)
+		b.WriteString(after)
+	}
+	b.WriteString(tail)
+	return b.String()
+}
+
+// removeTemplate is the inverse of applyTemplate, reporting false when
+// subdomain doesn't fit the template.
+func (h *DNSHandler) removeTemplate(subdomain string, cfg *ZoneConfig) (string, bool) {
+	before, after := h.prefixTemplate(cfg)
+	if cfg.PrefixMode != prefixModeEach {
+		inner, ok := untemplate(subdomain, before, after)
+		if !ok || strings.HasPrefix(inner, ".") || strings.HasSuffix(inner, ".") {
+			return "", false
+		}
+		return inner, true
+	}
+
+	labels := strings.Split(subdomain, ".")
+	for i, label := range labels {
+		var ok bool
+		if labels[i], ok = untemplate(label, before, after); !ok {
+			return "", false
+		}
+	}
+	return strings.Join(labels, "."), true
+}
+
+// untemplate strips before and after from s, reporting false unless
+// something is left in between.
+func untemplate(s, before, after string) (string, bool) {
+	if len(s) <= len(before)+len(after) || !strings.HasPrefix(s, before) || !strings.HasSuffix(s, after) {
+		return "", false
+	}
+	return s[len(before) : len(s)-len(after)], true
+}
+
+// rewriteResponse maps upstream names in resp back to the client's view.
+// The rewritten query name becomes originalName (keeping the client's
+// casing); other prefixed names, as found in CNAME chains, are restored
+// via restoreName, and so are CNAME and SVCB/HTTPS targets. Owners that
+// map back to neither are counted in rewrite_mismatches_total and left
+// to sanitizeResponse.
+func (h *DNSHandler) rewriteResponse(resp *dns.Msg, cfg *ZoneConfig, newName, originalName string) {
+	restore := func(name string) (string, bool) {
+		if strings.EqualFold(name, newName) {
+			return originalName, true
+		}
+		return h.restoreName(name, cfg)
+	}
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if name, ok := restore(hdr.Name); ok {
+				hdr.Name = name
+				hdr.Ttl = h.rewrittenTTL(cfg, hdr.Ttl)
+			} else if hdr.Rrtype != dns.TypeOPT && !isLocalSOA(rr, cfg) {
+				rewriteMismatchesTotal.WithLabelValues(cfg.Zone).Inc()
+				slog.Debug("record name does not match the rewritten query", "zone", cfg.Zone, "name", hdr.Name, "rewritten", newName)
+			}
+
+			if target := rdataTarget(rr); target != nil {
+				if name, ok := restore(*target); ok {
+					*target = name
+				}
+			}
+		}
+	}
+}
+
+// isLocalSOA reports whether rr is the local SOA fetch puts into negative
+// answers, which is already in the client's naming.
+func isLocalSOA(rr dns.RR, cfg *ZoneConfig) bool {
+	return rr.Header().Rrtype == dns.TypeSOA && strings.EqualFold(rr.Header().Name, cfg.origin())
+}
+
+// rdataTarget returns the alias target in rr's RDATA: a CNAME's, or the
+// TargetName of SVCB and HTTPS records, whose ipv4hint/ipv6hint are plain
+// addresses. A "." target means the owner itself and is left alone.
+func rdataTarget(rr dns.RR) *string {
+	var target *string
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		target = &rr.Target
+	case *dns.SVCB:
+		target = &rr.Target
+	case *dns.HTTPS:
+		target = &rr.Target
+	default:
+		return nil
+	}
+	if *target == "." {
+		return nil
+	}
+	return target
+}
+
+// sanitizeResponse is the last pass over resp after rewriteResponse. Any
+// record still referring to the upstream naming scheme, in its owner or
+// in a name inside its RDATA (NS glue in the additional section, MX and
+// SRV targets, ...), would leak internal names to the client: RDATA names
+// are restored where they fit the prefix template, everything else is
+// dropped.
+func (h *DNSHandler) sanitizeResponse(resp *dns.Msg, cfg *ZoneConfig) {
+	clean := func(section []dns.RR) []dns.RR {
+		kept := section[:0]
+		for _, rr := range section {
+			if h.sanitizeRR(rr, cfg) {
+				kept = append(kept, rr)
+			} else {
+				slog.Debug("dropping record with internal name", "zone", cfg.Zone, "rr", rr.String())
+			}
+		}
+		return kept
+	}
+
+	resp.Answer = clean(resp.Answer)
+	resp.Ns = clean(resp.Ns)
+	resp.Extra = clean(resp.Extra)
+}
+
+// sanitizeRR restores the internal names in rr's RDATA and reports
+// whether rr is safe to return.
+func (h *DNSHandler) sanitizeRR(rr dns.RR, cfg *ZoneConfig) bool {
+	if _, ok := rr.(*dns.OPT); ok {
+		return true
+	}
+	if h.internalName(rr.Header().Name, cfg) {
+		return false
+	}
+
+	var names []*string
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		names = []*string{&rr.Target}
+	case *dns.DNAME:
+		names = []*string{&rr.Target}
+	case *dns.NS:
+		names = []*string{&rr.Ns}
+	case *dns.PTR:
+		names = []*string{&rr.Ptr}
+	case *dns.MX:
+		names = []*string{&rr.Mx}
+	case *dns.SRV:
+		names = []*string{&rr.Target}
+	case *dns.SVCB:
+		names = []*string{&rr.Target}
+	case *dns.HTTPS:
+		names = []*string{&rr.Target}
+	case *dns.SOA:
+		names = []*string{&rr.Ns, &rr.Mbox}
+	}
+
+	for _, name := range names {
+		if !h.internalName(*name, cfg) {
+			continue
+		}
+		restored, ok := h.restoreName(*name, cfg)
+		if !ok {
+			return false
+		}
+		*name = restored
+	}
+	return true
+}
+
+// internalName reports whether name, outside cfg's zone, is in its
+// upstream zone or carries a part of the zone's prefix template: a label
+// starting with the prefix, or the suffix of a "%s.suffix" template.
+func (h *DNSHandler) internalName(name string, cfg *ZoneConfig) bool {
+	// Strip zones' upstream names are plain names in the upstream zone,
+	// by default the zone itself: internal unless they're client names
+	if cfg.Rewrite == rewriteStrip {
+		if !inZone(upstreamZone(cfg), name) || strings.EqualFold(name, cfg.origin()) {
+			return false
+		}
+		if inZone(cfg.origin(), name) {
+			_, err := h.rewriteQuery(name, cfg)
+			return err != nil
+		}
+		return true
+	}
+
+	if inZone(cfg.origin(), name) {
+		return false
+	}
+	if cfg.UpstreamZone != "" && cfg.UpstreamZone != "." && inZone(cfg.UpstreamZone, name) {
+		return true
+	}
+
+	before, after := h.prefixTemplate(cfg)
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	// A "%s.suffix" template's after is ".suffix": name ends in it, or is
+	// the bare suffix
+	if after != "" && (strings.HasSuffix(name, after) || (after[0] == '.' && name == after[1:])) {
+		return true
+	}
+
+	for label := range strings.SplitSeq(name, ".") {
+		if (before != "" && strings.HasPrefix(label, before)) || (after != "" && strings.HasSuffix(label, after)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------
+// Forward upstream
+// ---------------------------------------------
+
+// Recursion desired on upstream queries (UPSTREAM_RD)
+const (
+	upstreamRDOn     = "on"     // always set, for recursive upstreams
+	upstreamRDOff    = "off"    // never set, for authoritative upstreams
+	upstreamRDMirror = "mirror" // copied from the client's query
+)
+
+// upstreamQuery builds the message sent upstream for req, asking for name
+// instead of the client's qname.
+func (h *DNSHandler) upstreamQuery(req *dns.Msg, name string, client net.IP) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, req.Question[0].Qtype)
+	m.Id = req.Id
+	m.RecursionDesired = h.upstreamRD == upstreamRDOn || (h.upstreamRD == upstreamRDMirror && req.RecursionDesired)
+
+	// Advertise the client's buffer size so the upstream only truncates
+	// what the client couldn't take anyway
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(clientUDPSize(req), opt.Do())
+	}
+
+	if ecs := h.clientSubnet(req, client); ecs != nil {
+		opt := ensureOPT(m)
+		opt.Option = append(opt.Option, ecs)
+	}
+
+	return m
+}
+
+// queryContext returns the context bounding one client query: it's done
+// after QUERY_TIMEOUT or once the server shuts down.
+func (h *DNSHandler) queryContext() (context.Context, context.CancelFunc) {
+	ctx := h.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if h.queryTimeout > 0 {
+		return context.WithTimeout(ctx, h.queryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// retryBackoff is the delay before the first retry of an upstream, doubled
+// for each one after.
+const retryBackoff = 50 * time.Millisecond
+
+// forwardQuery sends m to cfg's upstreams in turn, retrying each up to
+// h.retries times, until one answers or ctx is done. With
+// CASE_RANDOMIZATION the qname goes out randomly cased, must come back
+// verbatim, and is restored to m's spelling in the returned response.
+func (h *DNSHandler) forwardQuery(ctx context.Context, m *dns.Msg, cfg *ZoneConfig) (*dns.Msg, string, error) {
+	name := m.Question[0].Name
+	proto := transport(cfg.Protocol)
+	upgradeTCP := cfg.Protocol == "tcp-fallback" || (proto == "udp" && h.autoTCP)
+
+	if h.randomizeCase {
+		m = m.Copy()
+		m.Question[0].Name = randomCase(name)
+	}
+
+	if err := h.inflight.acquire(ctx); err != nil {
+		return nil, "", err
+	}
+	defer h.inflight.release()
+
+	var lastErr error
+	var retryAt time.Time // earliest end of a skipped upstream's breaker cooldown
+	tried := false
+upstreams:
+	for _, upstream := range h.upstreamOrder(cfg) {
+		index := slices.Index(cfg.Upstreams, upstream)
+		for attempt := 0; attempt <= h.retries; attempt++ {
+			// An open breaker skips the upstream without an exchange
+			if ok, until := cfg.state.breakerAllows(index, time.Now(), h.breakerThreshold, h.breakerCooldown); !ok {
+				if retryAt.IsZero() || until.Before(retryAt) {
+					retryAt = until
+				}
+				continue upstreams
+			}
+			tried = true
+
+			if attempt > 0 {
+				// Back off 50ms, 100ms, ... unless that runs past the deadline
+				delay := retryBackoff << (attempt - 1)
+				if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+					break upstreams
+				}
+				slog.Debug("retrying upstream", "upstream", proto+"://"+upstream, "name", name, "attempt", attempt)
+
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+				}
+			}
+			if ctx.Err() != nil {
+				break upstreams
+			}
+
+			// An upstream that just truncated is asked over TCP directly
+			via := proto
+			start := time.Now()
+			if upgradeTCP && cfg.state.needsTCP(index, start) {
+				via = "tcp"
+			}
+			resp, err := h.forward(ctx, m, cfg, via, upstream)
+			if err == nil && resp != nil {
+				err = checkResponse(m, resp, h.randomizeCase)
+				if err != nil {
+					malformedResponsesTotal.WithLabelValues(via + "://" + upstream).Inc()
+				}
+			}
+
+			// Failures count as a full timeout for BALANCE_MODE=latency,
+			// unless the query itself was abandoned
+			rtt := time.Since(start)
+			if err != nil || resp == nil {
+				rtt = max(rtt, h.upstreamTimeout)
+			}
+			if ctx.Err() == nil {
+				cfg.state.observeLatency(index, rtt, time.Now())
+			}
+			if err == nil && resp != nil {
+				if resp.Truncated && upgradeTCP && via != "tcp" {
+					if resp = h.retryTCP(ctx, cfg, m, upstream, resp); !resp.Truncated && h.tcpCooldown > 0 {
+						cfg.state.requireTCP(index, time.Now().Add(h.tcpCooldown))
+					}
+				}
+				if h.randomizeCase {
+					uncase(resp, m.Question[0].Name, name)
+				}
+				cfg.state.breakerSuccess(index)
+				return resp, upstream, nil
+			}
+			upstreamErrorsTotal.WithLabelValues(via + "://" + upstream).Inc()
+			slog.Warn("upstream exchange failed", "upstream", via+"://"+upstream, "name", name, "error", err)
+			lastErr = fmt.Errorf("failed to query upstream %s://%s: %w", via, upstream, err)
+			if ctx.Err() == nil && cfg.state.breakerFailure(index, time.Now(), h.breakerThreshold, h.breakerCooldown) {
+				breakerTripsTotal.WithLabelValues(via + "://" + upstream).Inc()
+				slog.Warn("upstream breaker open", "upstream", via+"://"+upstream, "cooldown", h.breakerCooldown)
+			}
+		}
+	}
+
+	if !tried && !retryAt.IsZero() {
+		return nil, "", &breakerOpenError{retryAt: retryAt}
+	}
+	if lastErr == nil && ctx.Err() != nil {
+		lastErr = fmt.Errorf("query abandoned: %w", ctx.Err())
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstreams configured")
+	}
+	return nil, "", lastErr
+}
+
+// checkResponse rejects a response that doesn't answer m: a different ID
+// or question means a spoofed packet or a confused upstream. exactCase
+// also requires the qname's casing to match, for 0x20 queries.
+func checkResponse(m, resp *dns.Msg, exactCase bool) error {
+	if resp.Id != m.Id {
+		return fmt.Errorf("response ID %d does not match query ID %d", resp.Id, m.Id)
+	}
+
+	// Some upstreams leave the question out of errors such as REFUSED
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	q := m.Question[0]
+	if len(resp.Question) != 1 || !strings.EqualFold(resp.Question[0].Name, q.Name) ||
+		resp.Question[0].Qtype != q.Qtype || resp.Question[0].Qclass != q.Qclass {
+		return fmt.Errorf("response question does not match %s %s", q.Name, dns.TypeToString[q.Qtype])
+	}
+	if exactCase && resp.Question[0].Name != q.Name {
+		return fmt.Errorf("response question %s does not match the casing of %s", resp.Question[0].Name, q.Name)
+	}
+	return nil
+}
+
+// retryTCP re-asks upstream over TCP after a truncated UDP answer,
+// falling back to the truncated one if that fails.
+func (h *DNSHandler) retryTCP(ctx context.Context, cfg *ZoneConfig, m *dns.Msg, upstream string, truncated *dns.Msg) *dns.Msg {
+	resp, err := h.forward(ctx, m, cfg, "tcp", upstream)
+	if err == nil && resp != nil {
+		if err = checkResponse(m, resp, h.randomizeCase); err != nil {
+			malformedResponsesTotal.WithLabelValues("tcp://" + upstream).Inc()
+		}
+	}
+	if err != nil || resp == nil {
+		upstreamErrorsTotal.WithLabelValues("tcp://" + upstream).Inc()
+		slog.Warn("tcp retry of truncated answer failed", "upstream", "tcp://"+upstream, "name", m.Question[0].Name, "error", err)
+		return truncated
+	}
+	return resp
+}
+
+// needsTCP reports whether upstream i truncated a UDP answer recently
+// enough, per TCP_COOLDOWN, to skip UDP at now.
+func (s *zoneState) needsTCP(i int, now time.Time) bool {
+	if s == nil || i < 0 || i >= len(s.upstreams) {
+		return false
+	}
+	return now.UnixNano() < s.upstreams[i].tcpUntil.Load()
+}
+
+// requireTCP has upstream i asked over TCP until until.
+func (s *zoneState) requireTCP(i int, until time.Time) {
+	if s == nil || i < 0 || i >= len(s.upstreams) {
+		return
+	}
+	s.upstreams[i].tcpUntil.Store(until.UnixNano())
+}
+
+func (h *DNSHandler) newClient(cfg *ZoneConfig, proto, upstream string) *dns.Client {
+	c := &dns.Client{
+		Net:          proto,
+		DialTimeout:  h.upstreamTimeout,
+		ReadTimeout:  h.upstreamTimeout,
+		WriteTimeout: h.upstreamTimeout,
+	}
+
+	// A Dialer replaces DialTimeout, so it carries the timeout too
+	if ip := h.bindAddr(upstream); ip != nil {
+		c.Dialer = &net.Dialer{Timeout: h.upstreamTimeout, LocalAddr: localAddr(proto, ip)}
+	}
+
+	if proto == "tls" {
+		c.Net = "tcp-tls"
+		c.TLSConfig = h.upstreamTLSConfig(cfg, upstream)
+	}
+
+	return c
+}
+
+// bindAddr returns the UPSTREAM_BIND_ADDR address of upstream's family,
+// or nil to leave the source address to the OS. Hostnames take the first,
+// and the dialer then only tries their addresses of its family.
+func (h *DNSHandler) bindAddr(upstream string) net.IP {
+	if len(h.bindAddrs) == 0 {
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(upstream)
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return h.bindAddrs[0]
+	}
+	for _, bind := range h.bindAddrs {
+		if (bind.To4() != nil) == (ip.To4() != nil) {
+			return bind
+		}
+	}
+	return nil
+}
+
+// localAddr is ip as the local address for dialing over proto.
+func localAddr(proto string, ip net.IP) net.Addr {
+	if proto == "udp" {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// parseBindAddrs parses UPSTREAM_BIND_ADDR: at most one address per
+// family.
+func parseBindAddrs(list []string) ([]net.IP, error) {
+	ips, err := parseIPs(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) > 2 || (len(ips) == 2 && (ips[0].To4() != nil) == (ips[1].To4() != nil)) {
+		return nil, fmt.Errorf("want at most one IPv4 and one IPv6 address")
+	}
+	return ips, nil
+}
+
+// ---------------------------------------------
+// Main DNS handler
+// ---------------------------------------------
+
+// reply writes m back to the client, recording its rcode and access log.
+// A failed write, e.g. a TCP client that hung up, is logged and counted.
+func (h *DNSHandler) reply(w dns.ResponseWriter, ql *queryLog, m *dns.Msg) {
+	responsesTotal.WithLabelValues(dns.RcodeToString[m.Rcode]).Inc()
+	if err := w.WriteMsg(m); err != nil {
+		writeErrorsTotal.Inc()
+		slog.Warn("failed to write response", "client", ql.client, "qname", ql.qname, "qtype", ql.qtype, "error", err)
+	}
+	ql.emit(m)
+}
+
+// ServeDNS implements dns.Handler on top of resolve: it writes whatever reply
+// resolve builds, sized for the client's transport.
+func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	queriesTotal.Inc()
+	ql := newQueryLog(w)
+
+	ctx, cancel := h.queryContext()
+	defer cancel()
+
+	ctx, span := startQuerySpan(ctx)
+	m := h.resolve(ctx, req, clientIP(w), ql)
+	if m == nil {
+		endQuerySpan(span, ql, nil)
+		return
+	}
+
+	if h.shuffleAnswers {
+		shuffleAnswers(m.Answer)
+	}
+	h.limitAnswers(m)
+	truncateForClient(w, req, m)
+	h.padResponse(w, req, m)
+	h.reply(w, ql, m)
+	endQuerySpan(span, ql, m)
+}
+
+// resolve builds the reply to req from client, or returns nil when the
+// query should go unanswered. It does no I/O of its own beyond the
+// upstream exchanges done through h.forwarder.
+func (h *DNSHandler) resolve(ctx context.Context, req *dns.Msg, ip net.IP, ql *queryLog) *dns.Msg {
+	if !h.clientAllowed(ip) {
+		m := h.errorResponse(req, dns.RcodeRefused, "", 0)
+		return withEDE(req, m, dns.ExtendedErrorCodeProhibited, "client not allowed")
+	}
+
+	if !h.limiter.allow(ip, time.Now()) {
+		rateLimitedTotal.Inc()
+		if h.limiter.drop {
+			return nil
+		}
+		m := h.errorResponse(req, dns.RcodeRefused, "", 0)
+		return withEDE(req, m, dns.ExtendedErrorCodeProhibited, "rate limited")
+	}
+
+	// Rewritten answers can't validate against the upstream's signatures,
+	// so by default the DO bit is cleared and no DNSSEC records are asked
+	// for. STRIP_DO=false passes it through for clients that want the
+	// records anyway, e.g. for names outside rewritten zones.
+	if opt := req.IsEdns0(); opt != nil && h.stripDO {
+		opt.SetDo(false)
+	}
+
+	// Exactly one question per query (RFC 9619), anything else is FORMERR
+	if len(req.Question) != 1 {
+		return h.errorResponse(req, dns.RcodeFormatError, "", 0)
+	}
+
+	q := req.Question[0]
+	originalName := q.Name
+	normalizedName := strings.ToLower(originalName)
+	ql.qname = originalName
+	ql.qtype = dns.TypeToString[q.Qtype]
+
+	if answer := h.overrideAnswer(q); answer != nil {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = answer
+		ql.upstream = "override"
+		return m
+	}
+
+	if _, ok := h.blocklist.match(normalizedName); ok {
+		blockedTotal.Inc()
+		ql.upstream = "blocklist"
+		return h.blockedAnswer(req)
+	}
+
+	zoneCfg, ok, isApex := h.selectZoneForName(normalizedName)
+	if !ok {
+		// Not in any allowed zone → OUT_OF_ZONE_RCODE, NXDOMAIN comes with
+		// a local SOA
+		var owner string
+		var ttl uint32
+		if h.outOfZone == dns.RcodeNameError {
+			owner, ttl = h.outOfZoneSOAOwner(normalizedName)
+		}
+		m := h.errorResponse(req, h.outOfZone, owner, ttl)
+		// NXDOMAIN is an answer; REFUSED is the one that needs explaining
+		if h.outOfZone == dns.RcodeRefused {
+			return withEDE(req, m, dns.ExtendedErrorCodeNotAuthoritative, "not authoritative")
+		}
+		return m
+	}
+	zoneQueriesTotal.WithLabelValues(zoneCfg.Zone).Inc()
+	ql.zone = zoneCfg.Zone
+	zoneCfg = zoneCfg.forClient(ip)
+
+	if zoneCfg.Zone == CatchAllZone {
+		return h.forwardUnchanged(ctx, req, ip, zoneCfg, ql)
+	}
+
+	if m := h.anyAnswer(req, zoneCfg, isApex); m != nil {
+		return m
+	}
+
+	// Apex handling
+	if isApex {
+		return h.apexAnswer(req, zoneCfg)
+	}
+
+	// Only the zone's allowed_types, or else FORWARD_TYPES, are forwarded.
+	// The name may well exist, so other types get NODATA, not NXDOMAIN
+	if !h.typeAllowed(zoneCfg, q.Qtype) {
+		return h.zoneErrorResponse(req, dns.RcodeSuccess, zoneCfg)
+	}
+
+	if m := h.aaaaAnswer(req, zoneCfg); m != nil {
+		return m
+	}
+
+	// Each of the zone's prefixes in turn, until one finds the name
+	var negative, failure *dns.Msg
+	for _, cfg := range zoneCfg.prefixCandidates() {
+		m := h.forwardRewritten(ctx, req, ip, cfg, ql)
+		switch {
+		case m.Rcode == dns.RcodeServerFailure:
+			// A failed lookup says nothing about the other prefixes
+			if failure == nil {
+				failure = m
+			}
+		case !isNegative(m):
+			return m
+		case negative == nil || (negative.Rcode == dns.RcodeNameError && m.Rcode == dns.RcodeSuccess):
+			// NODATA says the name exists, which beats NXDOMAIN from the others
+			negative = m
+		}
+	}
+	if negative != nil {
+		return negative
+	}
+	return failure
+}
+
+// nameFits reports whether name is a domain name within the 63-octet
+// label and 255-octet name limits. dns.IsDomainName and packing both let
+// a 256-octet name through.
+func nameFits(name string) bool {
+	var buf [256]byte
+	n, err := dns.PackDomainName(name, buf[:], 0, nil, false)
+	return err == nil && n <= 255
+}
+
+// forwardRewritten answers req for a name below cfg's apex by rewriting
+// it, forwarding it upstream (or taking the answer from the cache) and
+// restoring the client's names in the response.
+func (h *DNSHandler) forwardRewritten(ctx context.Context, req *dns.Msg, ip net.IP, zoneCfg *ZoneConfig, ql *queryLog) *dns.Msg {
+	originalName := req.Question[0].Name
+	normalizedName := strings.ToLower(originalName)
+
+	// A name with no upstream counterpart, such as one lacking a strip
+	// zone's prefix, can't exist
+	newName, err := h.rewriteQuery(normalizedName, zoneCfg)
+	if err != nil {
+		return h.zoneErrorResponse(req, dns.RcodeNameError, zoneCfg)
+	}
+
+	// The prefix can push a name that fit past the 63-octet label or
+	// 255-octet name limit; the upstream would get a malformed query
+	if !nameFits(newName) {
+		slog.Warn("name too long after rewrite", "zone", zoneCfg.Zone, "name", normalizedName, "rewritten", newName)
+		m := h.errorResponse(req, dns.RcodeServerFailure, "", 0)
+		return withEDE(req, m, dns.ExtendedErrorCodeOther, "name too long after rewrite")
+	}
+
+	ql.rewritten = newName
+
+	upstreamReq := h.upstreamQuery(req, newName, ip)
+	key := newCacheKey(zoneCfg, upstreamReq)
+	resp := h.cache.get(key, time.Now())
+	if resp == nil {
+		cacheMissesTotal.Inc()
+
+		resp, ql.upstream, err = h.fetch(ctx, upstreamReq, zoneCfg, key)
+		if err != nil {
+			slog.Error("upstream query failed", "zone", zoneCfg.Zone, "name", newName, "error", err)
+			m := h.errorResponse(req, dns.RcodeServerFailure, "", 0)
+			code, text := upstreamEDE(err)
+			return withEDE(req, m, code, text)
+		}
+	} else {
+		cacheHitsTotal.Inc()
+		ql.upstream = "cache"
+		h.prefetch(upstreamReq, zoneCfg, key)
+	}
+
+	replyTo(req, resp)
+	restoreClientOPT(req, resp)
+
+	// Rewrite names and TTLs
+	h.rewriteResponse(resp, zoneCfg, newName, originalName)
+	h.sanitizeResponse(resp, zoneCfg)
+
+	// Negative answers carry the local SOA, as the zone's own NXDOMAIN and
+	// NODATA do; positive ones are the upstream's data, whatever AA it set
+	resp.Authoritative = isNegative(resp) && h.authoritative
+
+	return resp
+}
+
+// fetched is a fetch result shared between concurrent identical queries.
+type fetched struct {
+	msg      *dns.Msg
+	upstream string
+}
+
+// fetch is fetchUpstream with concurrent identical queries collapsed into
+// one upstream exchange, whose response the others get a copy of. The
+// first caller's ctx bounds them all.
+func (h *DNSHandler) fetch(ctx context.Context, m *dns.Msg, cfg *ZoneConfig, key cacheKey) (*dns.Msg, string, error) {
+	v, err, shared := h.flights.Do(flightKey(cfg, key), func() (any, error) {
+		resp, upstream, err := h.fetchUpstream(ctx, m, cfg, key)
+		return fetched{resp, upstream}, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	f := v.(fetched)
+	if shared {
+		sharedQueriesTotal.Inc()
+		return f.msg.Copy(), f.upstream, nil
+	}
+	return f.msg, f.upstream, nil
+}
+
+// flightKey identifies an upstream query for fetch: the rewritten name
+// and qtype, sent over the same protocol to the same upstreams. The cache
+// key's zone, ECS subnet, DO and RD bits are part of it too, since they
+// shape the response fetchUpstream builds, and so is the split-horizon view it
+// caches under.
+func flightKey(cfg *ZoneConfig, key cacheKey) string {
+	var b strings.Builder
+	b.Grow(len(key.zone) + len(cfg.Protocol) + len(key.name) + len(key.subnet) + 16 + 24*len(cfg.Upstreams))
+	for _, s := range []string{key.zone, cfg.Protocol, key.name, key.subnet} {
+		b.WriteString(s)
+		b.WriteByte('|')
+	}
+	b.WriteString(strconv.Itoa(int(key.qtype)))
+	if key.do {
+		b.WriteString("|do")
+	}
+	if key.rd {
+		b.WriteString("|rd")
+	}
+	if key.view != 0 {
+		b.WriteString("|view")
+		b.WriteString(strconv.Itoa(key.view))
+	}
+	for _, upstream := range cfg.Upstreams {
+		b.WriteByte('|')
+		b.WriteString(upstream)
+	}
+	return b.String()
+}
+
+// fetchUpstream forwards the upstream query m for cfg and caches the
+// response under key. Outside the catch-all zone, AAAA answers are
+// synthesized as configured and the upstream SOA of negative answers is
+// swapped for the local one first, so cache hits replay exactly what a
+// fresh lookup returns.
+func (h *DNSHandler) fetchUpstream(ctx context.Context, m *dns.Msg, cfg *ZoneConfig, key cacheKey) (*dns.Msg, string, error) {
+	start := time.Now()
+	spanCtx, span := startForwardSpan(ctx, m, cfg)
+	resp, upstream, err := h.forwardQuery(spanCtx, m, cfg)
+	endForwardSpan(span, upstream, resp, err)
+	upstreamDuration.WithLabelValues(cfg.Zone).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, "", err
+	}
+
+	rewritten := cfg.Zone != CatchAllZone
+	if rewritten {
+		resp = h.synthesizeAAAA(ctx, m, resp, cfg)
+	}
+
+	// Replace the upstream SOA on NXDOMAIN and NODATA, its owner is the
+	// internal zone. The TTL comes from the upstream one
+	negTTL, negative := negativeCacheTTL(resp, h.zoneNegativeTTL(cfg))
+	if rewritten && (resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)) {
+		resp.Ns = []dns.RR{}
+		resp.Ns = append(resp.Ns, h.createLocalSOA(cfg.origin(), h.zoneNegativeTTL(cfg)))
+	}
+
+	if negative {
+		h.cache.set(key, resp, negTTL, time.Now())
+	} else if ttl, ok := minAnswerTTL(resp); ok {
+		h.cache.set(key, resp, ttl, time.Now())
+	}
+	return resp, upstream, nil
+}
+
+// replyTo readdresses an upstream (or cached) resp to the client's req.
+// Unlike dns.Msg.SetReply it keeps the upstream rcode. Such replies were
+// recursed on the client's behalf, so they get RA; local answers and
+// errors, REFUSED and FORMERR among them, don't.
+func replyTo(req, resp *dns.Msg) {
+	rcode := resp.Rcode
+	resp.SetReply(req)
+	resp.Rcode = rcode
+	resp.RecursionAvailable = true
+}
+
+// limitAnswers keeps at most MAX_ANSWERS records of the queried type in
+// resp, dropping the rest in order. Other records, such as the CNAME
+// chain leading to them, are kept.
+func (h *DNSHandler) limitAnswers(resp *dns.Msg) {
+	if h.maxAnswers == 0 || len(resp.Question) == 0 || len(resp.Answer) <= h.maxAnswers {
+		return
+	}
+
+	qtype := resp.Question[0].Qtype
+	n := 0
+	kept := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			if n == h.maxAnswers {
+				continue
+			}
+			n++
+		}
+		kept = append(kept, rr)
+	}
+	resp.Answer = kept
+}
+
+// truncateForClient trims oversized UDP answers and sets TC so the client
+// retries over TCP.
+func truncateForClient(w dns.ResponseWriter, req, resp *dns.Msg) {
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); !isUDP {
+		return
+	}
+
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	resp.Truncate(size)
+}
+
+// forwardUnchanged serves the catch-all zone: the query goes upstream as
+// is and the response comes back as is.
+func (h *DNSHandler) forwardUnchanged(ctx context.Context, req *dns.Msg, ip net.IP, cfg *ZoneConfig, ql *queryLog) *dns.Msg {
+	q := req.Question[0]
+	ql.rewritten = q.Name
+
+	upstreamReq := h.upstreamQuery(req, q.Name, ip)
+	key := newCacheKey(cfg, upstreamReq)
+	resp := h.cache.get(key, time.Now())
+	if resp == nil {
+		cacheMissesTotal.Inc()
+
+		var err error
+		resp, ql.upstream, err = h.fetch(ctx, upstreamReq, cfg, key)
+		if err != nil {
+			slog.Error("upstream query failed", "zone", cfg.Zone, "name", q.Name, "error", err)
+			m := h.errorResponse(req, dns.RcodeServerFailure, "", 0)
+			code, text := upstreamEDE(err)
+			return withEDE(req, m, code, text)
+		}
+	} else {
+		cacheHitsTotal.Inc()
+		ql.upstream = "cache"
+		h.prefetch(upstreamReq, cfg, key)
+	}
+
+	replyTo(req, resp)
+	restoreClientOPT(req, resp)
+	return resp
+}
+
+// WriteZoneSummary lists h's zones with their prefix and upstreams, one
+// per line, as printed by VALIDATE_ONLY.
+func (h *DNSHandler) WriteZoneSummary(w io.Writer) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	names := make([]string, 0, len(h.zones))
+	for name := range h.zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cfg := h.zones[name]
+		prefix := h.zonePrefix(&cfg)
+		if name == CatchAllZone || prefix == "" {
+			prefix = "(none)"
+		}
+		for _, candidate := range cfg.prefixCandidates()[1:] {
+			prefix += prefixSeparator + cmp.Or(h.zonePrefix(candidate), "(none)")
+		}
+		if cfg.Rewrite == rewriteStrip {
+			prefix += " rewrite=strip"
+		}
+		if cfg.NoRewrite {
+			prefix += " rewrite=none"
+		}
+		if cfg.UpstreamZone != "" {
+			prefix += " upstream_zone=" + cfg.UpstreamZone
+		}
+		if cfg.ReverseZone {
+			prefix += " reverse"
+		}
+		fmt.Fprintf(w, "  %s prefix=%s %s://%s\n", name, prefix, cfg.Protocol, strings.Join(cfg.Upstreams, ";"))
+		for _, view := range cfg.Views {
+			fmt.Fprintf(w, "    view %s %s://%s\n", viewCIDRs(view), cfg.Protocol, strings.Join(view.Upstreams, ";"))
+		}
+	}
+}
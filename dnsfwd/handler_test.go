@@ -0,0 +1,1549 @@
+package dnsfwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stubForwarder is a Forwarder answering from records, keyed by "name
+// TYPE" with a lowercased name, and with NXDOMAIN for anything else. It
+// keeps every query it gets.
+type stubForwarder struct {
+	records map[string][]dns.RR
+
+	mu      sync.Mutex
+	queries []stubQuery
+}
+
+type stubQuery struct {
+	msg      *dns.Msg
+	proto    string
+	upstream string
+}
+
+func (f *stubForwarder) Forward(_ context.Context, m *dns.Msg, _ *ZoneConfig, proto, upstream string) (*dns.Msg, error) {
+	f.mu.Lock()
+	f.queries = append(f.queries, stubQuery{m.Copy(), proto, upstream})
+	f.mu.Unlock()
+
+	q := m.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	rrs, ok := f.records[strings.ToLower(q.Name)+" "+dns.TypeToString[q.Qtype]]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = append(resp.Ns, mustRR("internal. 60 IN SOA ns.internal. hostmaster.internal. 1 3600 600 86400 60"))
+		return resp, nil
+	}
+	for _, rr := range rrs {
+		resp.Answer = append(resp.Answer, dns.Copy(rr))
+	}
+	return resp, nil
+}
+
+// names returns the query names the stub got, in order.
+func (f *stubForwarder) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var names []string
+	for _, q := range f.queries {
+		names = append(names, q.msg.Question[0].Name)
+	}
+	return names
+}
+
+// forwardFunc adapts a function to Forwarder.
+type forwardFunc func(ctx context.Context, m *dns.Msg, cfg *ZoneConfig, proto, upstream string) (*dns.Msg, error)
+
+func (f forwardFunc) Forward(ctx context.Context, m *dns.Msg, cfg *ZoneConfig, proto, upstream string) (*dns.Msg, error) {
+	return f(ctx, m, cfg, proto, upstream)
+}
+
+// testWriter is an in-memory dns.ResponseWriter keeping the last message
+// written.
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+	err    error // returned by WriteMsg
+}
+
+func newTestWriter(proto string) *testWriter {
+	ip := net.ParseIP("192.0.2.10")
+	if proto == "tcp" {
+		return &testWriter{remote: &net.TCPAddr{IP: ip, Port: 40000}}
+	}
+	return &testWriter{remote: &net.UDPAddr{IP: ip, Port: 40000}}
+}
+
+func (w *testWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), w.err }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.err
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// newTestHandler builds a handler for the ZONES value zones on top of
+// DefaultConfig, with fwd as its Forwarder and the cache off unless
+// configure turns it on.
+func newTestHandler(t testing.TB, zones string, fwd Forwarder, configure ...func(*Config)) *DNSHandler {
+	t.Helper()
+
+	parsed, err := ParseZoneEnv(zones)
+	if err != nil {
+		t.Fatalf("ParseZoneEnv(%q): %v", zones, err)
+	}
+	cfg := DefaultConfig()
+	cfg.Zones = parsed
+	cfg.Forwarder = fwd
+	cfg.CacheSize = 0
+	for _, f := range configure {
+		f(&cfg)
+	}
+
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	return h
+}
+
+// exchange sends a query for name and qtype to h over UDP and returns the
+// reply, failing the test when there is none.
+func exchange(t testing.TB, h *DNSHandler, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return serve(t, h, req)
+}
+
+// serve hands req to h over UDP and returns the reply.
+func serve(t testing.TB, h *DNSHandler, req *dns.Msg) *dns.Msg {
+	t.Helper()
+
+	w := newTestWriter("udp")
+	h.ServeDNS(w, req)
+	if w.msg == nil {
+		t.Fatalf("no reply to %s", req.Question[0].String())
+	}
+	return w.msg
+}
+
+func TestServeDNSZoneHit(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "Web.Pod.Example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[resp.Rcode])
+	}
+	if got := fwd.names(); len(got) != 1 || got[0] != "systemd-web." {
+		t.Fatalf("upstream queries = %v, want [systemd-web.]", got)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answer = %v, want one A record", resp.Answer)
+	}
+	a, ok := resp.Answer[0].(*dns.A)
+	if !ok || a.Hdr.Name != "Web.Pod.Example." || !a.A.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("answer = %v, want Web.Pod.Example. A 10.0.0.5", resp.Answer[0])
+	}
+	if a.Hdr.Ttl != 300 {
+		t.Errorf("TTL = %d, want ANSWER_TTL 300", a.Hdr.Ttl)
+	}
+}
+
+func TestServeDNSZoneMiss(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "web.other.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "invalid." || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("authority = %v, want the invalid. SOA", resp.Ns)
+	}
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+}
+
+func TestServeDNSOutOfZoneRcode(t *testing.T) {
+	tests := []struct {
+		rcode string
+		want  int
+		soa   bool
+	}{
+		{"", dns.RcodeNameError, true}, // the default
+		{"nxdomain", dns.RcodeNameError, true},
+		{"REFUSED", dns.RcodeRefused, false},
+		{"servfail", dns.RcodeServerFailure, false},
+	}
+	for _, tt := range tests {
+		fwd := &stubForwarder{}
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			if tt.rcode != "" {
+				c.OutOfZoneRcode = tt.rcode
+			}
+		})
+
+		resp := exchange(t, h, "web.other.example.", dns.TypeA)
+		if resp.Rcode != tt.want {
+			t.Errorf("OUT_OF_ZONE_RCODE=%q: rcode = %s, want %s", tt.rcode, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.want])
+		}
+		if hasSOA := soaOwner(resp) != ""; hasSOA != tt.soa || len(resp.Answer) != 0 {
+			t.Errorf("OUT_OF_ZONE_RCODE=%q: reply = %v, want an SOA %v and no answers", tt.rcode, resp, tt.soa)
+		}
+		if got := fwd.names(); len(got) != 0 {
+			t.Errorf("OUT_OF_ZONE_RCODE=%q: upstream queries = %v, want none", tt.rcode, got)
+		}
+
+		// Names in a zone are unaffected
+		if resp := exchange(t, h, "missing.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+			t.Errorf("OUT_OF_ZONE_RCODE=%q: in-zone NXDOMAIN became %s", tt.rcode, dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	if _, err := NewHandler(Config{OutOfZoneRcode: "notimp"}); err == nil {
+		t.Error("NewHandler with OUT_OF_ZONE_RCODE=notimp succeeded")
+	}
+}
+
+func TestServeDNSApex(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	soa := exchange(t, h, "pod.example.", dns.TypeSOA)
+	if soa.Rcode != dns.RcodeSuccess || len(soa.Answer) != 1 || soa.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("SOA reply = %v, want the local SOA", soa)
+	}
+	if name := soa.Answer[0].Header().Name; name != "pod.example." {
+		t.Errorf("SOA owner = %s, want pod.example.", name)
+	}
+
+	ns := exchange(t, h, "pod.example.", dns.TypeNS)
+	if len(ns.Answer) != 1 || ns.Answer[0].(*dns.NS).Ns != "dns-pod.hetmer.net." {
+		t.Errorf("NS answer = %v, want SOA_MNAME", ns.Answer)
+	}
+
+	// Other types at the apex: the name exists, so NODATA with the SOA
+	a := exchange(t, h, "pod.example.", dns.TypeA)
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 0 || len(a.Ns) != 1 {
+		t.Errorf("A reply = %v, want NODATA with the SOA", a)
+	}
+
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+}
+
+func TestServeDNSRewriteRestoresNXDOMAIN(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "missing.pod.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+	// The upstream SOA names the internal zone; the local one replaces it
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "pod.example." {
+		t.Errorf("authority = %v, want the pod.example. SOA", resp.Ns)
+	}
+}
+
+func TestServeDNSHeaderFlags(t *testing.T) {
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Authoritative = true // the internal server owns its zone
+		if m.Question[0].Name == "systemd-web." {
+			resp.Answer = append(resp.Answer, mustRR("systemd-web. 30 IN A 10.0.0.5"))
+		} else {
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp, nil
+	})
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		authoritative bool // AUTHORITATIVE
+		wantAA        bool
+		wantRA        bool // only forwarded and cached replies were recursed
+	}{
+		{"apex", "pod.example.", dns.TypeSOA, true, true, false},
+		{"apex not authoritative", "pod.example.", dns.TypeSOA, false, false, false},
+		{"zone NXDOMAIN", "missing.pod.example.", dns.TypeA, true, true, true},
+		{"zone NXDOMAIN not authoritative", "missing.pod.example.", dns.TypeA, false, false, true},
+		{"forwarded", "web.pod.example.", dns.TypeA, true, false, true},
+		{"disallowed type", "web.pod.example.", dns.TypeMX, true, true, false},
+		{"out of zone", "web.other.example.", dns.TypeA, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+				c.Authoritative = tt.authoritative
+			})
+
+			resp := exchange(t, h, tt.qname, tt.qtype)
+			if resp.Authoritative != tt.wantAA {
+				t.Errorf("AA = %v, want %v", resp.Authoritative, tt.wantAA)
+			}
+			if resp.RecursionAvailable != tt.wantRA {
+				t.Errorf("RA = %v, want %v", resp.RecursionAvailable, tt.wantRA)
+			}
+		})
+	}
+
+	// Cached replies were recursed too
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.CacheSize = 16
+	})
+	for range 2 {
+		if resp := exchange(t, h, "web.pod.example.", dns.TypeA); !resp.RecursionAvailable {
+			t.Error("cached: RA not set")
+		}
+	}
+
+	// Refusals and errors are not
+	h = newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.OutOfZoneRcode = "refused"
+	})
+	if resp := exchange(t, h, "web.other.example.", dns.TypeA); resp.Rcode != dns.RcodeRefused || resp.RecursionAvailable {
+		t.Errorf("REFUSED out of zone: rcode %s, RA %v, want REFUSED without RA", dns.RcodeToString[resp.Rcode], resp.RecursionAvailable)
+	}
+	h = newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.AllowCIDRs = []string{"10.0.0.0/8"}
+	})
+	if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeRefused || resp.RecursionAvailable {
+		t.Errorf("client not allowed: rcode %s, RA %v, want REFUSED without RA", dns.RcodeToString[resp.Rcode], resp.RecursionAvailable)
+	}
+	h = newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.RateLimit = 1
+		c.RateBurst = 1
+	})
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeRefused || resp.RecursionAvailable {
+		t.Errorf("rate limited: rcode %s, RA %v, want REFUSED without RA", dns.RcodeToString[resp.Rcode], resp.RecursionAvailable)
+	}
+	h = newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	req.Question = append(req.Question, req.Question[0])
+	if resp := serve(t, h, req); resp.Rcode != dns.RcodeFormatError || resp.RecursionAvailable {
+		t.Errorf("two questions: rcode %s, RA %v, want FORMERR without RA", dns.RcodeToString[resp.Rcode], resp.RecursionAvailable)
+	}
+}
+
+func TestServeDNSTruncatesUDP(t *testing.T) {
+	var big []dns.RR
+	for i := range 60 {
+		big = append(big, mustRR(fmt.Sprintf("systemd-big. 30 IN A 10.0.%d.%d", i/250, i%250+1)))
+	}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{records: map[string][]dns.RR{"systemd-big. A": big}})
+
+	tests := []struct {
+		name      string
+		proto     string
+		udpSize   uint16 // 0 for no EDNS
+		wantTC    bool
+		wantLimit int
+	}{
+		{"UDP without EDNS", "udp", 0, true, dns.MinMsgSize},
+		{"UDP with a small buffer", "udp", 700, true, 700},
+		{"UDP with a large buffer", "udp", 4096, false, 4096},
+		{"TCP", "tcp", 0, false, dns.MaxMsgSize},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("big.pod.example.", dns.TypeA)
+		if tt.udpSize != 0 {
+			req.SetEdns0(tt.udpSize, false)
+		}
+		w := newTestWriter(tt.proto)
+		h.ServeDNS(w, req)
+		resp := w.msg
+
+		packed, err := resp.Pack()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resp.Truncated != tt.wantTC || len(packed) > tt.wantLimit {
+			t.Errorf("%s: TC %v, %d bytes, want TC %v within %d bytes", tt.name, resp.Truncated, len(packed), tt.wantTC, tt.wantLimit)
+		}
+		if !tt.wantTC && len(resp.Answer) != len(big) {
+			t.Errorf("%s: %d answers, want all %d", tt.name, len(resp.Answer), len(big))
+		}
+	}
+}
+
+func TestParseZoneEnvWhitespace(t *testing.T) {
+	for _, env := range []string{
+		"a.example.=udp:1.1.1.1:53,",
+		"a.example.=udp:1.1.1.1:53, ",
+		",a.example.=udp:1.1.1.1:53,,",
+		"  a.example.=udp:1.1.1.1:53  ",
+		"a.example. = udp:1.1.1.1:53",
+		"a.example.\t=\tudp:1.1.1.1:53 ,\n",
+	} {
+		zones, err := ParseZoneEnv(env)
+		if err != nil {
+			t.Errorf("ParseZoneEnv(%q): %v", env, err)
+			continue
+		}
+		cfg, ok := zones["a.example."]
+		if len(zones) != 1 || !ok {
+			t.Errorf("ParseZoneEnv(%q) = %v, want the one zone a.example.", env, zones)
+			continue
+		}
+		if cfg.Protocol != "udp" || len(cfg.Upstreams) != 1 || cfg.Upstreams[0] != "1.1.1.1:53" {
+			t.Errorf("ParseZoneEnv(%q) = %s %v, want udp [1.1.1.1:53]", env, cfg.Protocol, cfg.Upstreams)
+		}
+	}
+
+	for _, env := range []string{
+		",",
+		" , ",
+		"a.example.",
+		" =udp:1.1.1.1:53",
+		"a.example.=udp:1.1.1.1:53, b.example.",
+	} {
+		if zones, err := ParseZoneEnv(env); err == nil {
+			t.Errorf("ParseZoneEnv(%q) = %v, want an error", env, zones)
+		}
+	}
+}
+
+func TestParseZoneEnvUpstreams(t *testing.T) {
+	tests := []struct {
+		env           string
+		wantPrefix    string
+		wantProto     string
+		wantUpstreams []string
+	}{
+		{"z.example.=udp:10.0.0.1:53", "", "udp", []string{"10.0.0.1:53"}},
+		{"z.example.=udp:10.0.0.1", "", "udp", []string{"10.0.0.1:53"}},
+		{"z.example.=udp:[2001:db8::1]:53", "", "udp", []string{"[2001:db8::1]:53"}},
+		{"z.example.=sys-:udp:[2001:db8::1]:5353", "sys-", "udp", []string{"[2001:db8::1]:5353"}},
+		{"z.example.=udp:[2001:db8::1]", "", "udp", []string{"[2001:db8::1]:53"}},
+		{"z.example.=udp:[fe80::1%eth0]:53", "", "udp", []string{"[fe80::1%eth0]:53"}},
+		{"z.example.=sys-:tcp:[fe80::1%eth0]", "sys-", "tcp", []string{"[fe80::1%eth0]:53"}},
+		{"z.example.=tls:1.1.1.1", "", "tls", []string{"1.1.1.1:853"}},
+		{"z.example.=dot:1.1.1.1", "", "tls", []string{"1.1.1.1:853"}},
+		{"z.example.=udp:10.0.0.1:53;[2001:db8::2]", "", "udp", []string{"10.0.0.1:53", "[2001:db8::2]:53"}},
+	}
+	for _, tt := range tests {
+		zones, err := ParseZoneEnv(tt.env)
+		if err != nil {
+			t.Errorf("ParseZoneEnv(%q): %v", tt.env, err)
+			continue
+		}
+		cfg := zones["z.example."]
+		if cfg.Prefix != tt.wantPrefix || cfg.Protocol != tt.wantProto || strings.Join(cfg.Upstreams, ",") != strings.Join(tt.wantUpstreams, ",") {
+			t.Errorf("ParseZoneEnv(%q) = %q %s %v, want %q %s %v", tt.env,
+				cfg.Prefix, cfg.Protocol, cfg.Upstreams, tt.wantPrefix, tt.wantProto, tt.wantUpstreams)
+		}
+	}
+}
+
+func TestServeDNSZoneTTLs(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 3600 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "short.example.=udp:10.0.0.1:53?answer_ttl=30&negative_ttl=10,"+
+		"half.example.=udp:10.0.0.1:53?answer_ttl=0&negative_ttl=5,"+
+		"long.example.=udp:10.0.0.1:53", fwd)
+
+	// Zero inherits ANSWER_TTL (300) and NEGATIVE_TTL (60) rather than meaning 0
+	tests := []struct {
+		zone                   string
+		answerTTL, negativeTTL uint32
+	}{
+		{"short.example.", 30, 10},
+		{"half.example.", 300, 5},
+		{"long.example.", 300, 60},
+	}
+	for _, tt := range tests {
+		resp := exchange(t, h, "web."+tt.zone, dns.TypeA)
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != tt.answerTTL {
+			t.Errorf("%s: answer = %v, want TTL %d", tt.zone, resp.Answer, tt.answerTTL)
+		}
+
+		// NXDOMAIN below the apex, NODATA at it
+		for _, q := range []struct {
+			name  string
+			qtype uint16
+		}{{"missing." + tt.zone, dns.TypeA}, {tt.zone, dns.TypeAAAA}} {
+			resp = exchange(t, h, q.name, q.qtype)
+			if len(resp.Ns) != 1 || resp.Ns[0].Header().Ttl != tt.negativeTTL || resp.Ns[0].(*dns.SOA).Minttl != tt.negativeTTL {
+				t.Errorf("%s %s: authority = %v, want the SOA with TTL and minimum %d", q.name, dns.TypeToString[q.qtype], resp.Ns, tt.negativeTTL)
+			}
+		}
+	}
+}
+
+func TestParseZoneEnvFirstEquals(t *testing.T) {
+	zones, err := ParseZoneEnv("a.example.=udp:1.2.3.4:53,b.example.=udp:1.2.3.5:53?answer_ttl=30")
+	if err != nil {
+		t.Fatalf("ParseZoneEnv: %v", err)
+	}
+	if a := zones["a.example."]; len(a.Upstreams) != 1 || a.Upstreams[0] != "1.2.3.4:53" {
+		t.Errorf("a.example. upstreams = %v, want [1.2.3.4:53]", a.Upstreams)
+	}
+	// Only the first "=" splits; the option's own "=" stays in the value
+	if b := zones["b.example."]; b.AnswerTTL != 30 {
+		t.Errorf("b.example. answer_ttl = %d, want 30", b.AnswerTTL)
+	}
+
+	if _, err := ParseZoneEnv("a.example.udp:1.2.3.4:53"); err == nil {
+		t.Error("entry without \"=\" parsed")
+	}
+}
+
+func TestParseZoneEnvQuoted(t *testing.T) {
+	zones, err := ParseZoneEnv(`"a.example.=udp:1.1.1.1:53;2.2.2.2:53",b.example.=udp:10.0.0.1:53,c.example.="tcp:10.0.0.2:53"`)
+	if err != nil {
+		t.Fatalf("ParseZoneEnv: %v", err)
+	}
+	want := map[string]string{
+		"a.example.": "udp 1.1.1.1:53,2.2.2.2:53",
+		"b.example.": "udp 10.0.0.1:53",
+		"c.example.": "tcp 10.0.0.2:53",
+	}
+	if len(zones) != len(want) {
+		t.Errorf("ParseZoneEnv = %v, want zones %v", zones, want)
+	}
+	for zone, w := range want {
+		cfg, ok := zones[zone]
+		if got := cfg.Protocol + " " + strings.Join(cfg.Upstreams, ","); !ok || got != w {
+			t.Errorf("%s = %q, want %q", zone, got, w)
+		}
+	}
+
+	// Commas inside quotes stay in the entry
+	entries, err := splitZoneEntries(`a.=udp:1.1.1.1:53,"b.=x,y",c.="z"`)
+	if err != nil {
+		t.Fatalf("splitZoneEntries: %v", err)
+	}
+	if got := strings.Join(entries, "|"); got != "a.=udp:1.1.1.1:53|b.=x,y|c.=z" {
+		t.Errorf("splitZoneEntries = %q, want a.=udp:1.1.1.1:53|b.=x,y|c.=z", got)
+	}
+
+	if zones, err := ParseZoneEnv(`"a.example.=udp:1.1.1.1:53,b.example.=udp:10.0.0.1:53`); err == nil {
+		t.Errorf("unterminated quote parsed as %v", zones)
+	}
+}
+
+// startUpstream serves handler on a loopback port over network, "udp" or
+// "tcp", until the test ends, and returns its address.
+func startUpstream(t testing.TB, network string, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	server := &dns.Server{Net: network, Handler: handler}
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn = pc
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = l
+	}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	if server.PacketConn != nil {
+		return server.PacketConn.LocalAddr().String()
+	}
+	return server.Listener.Addr().String()
+}
+
+// answerA is an upstream handler answering every query with an A record
+// for 10.0.0.5.
+func answerA(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, mustRR(req.Question[0].Name+" 30 IN A 10.0.0.5"))
+	_ = w.WriteMsg(resp)
+}
+
+func TestServeDNSCNAMEChain(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {
+			mustRR("systemd-web. 30 IN CNAME systemd-app."),
+			mustRR("systemd-app. 30 IN CNAME systemd-app-1."),
+			mustRR("systemd-app-1. 30 IN A 10.0.0.5"),
+		},
+		"systemd-ext. A": {
+			mustRR("systemd-ext. 30 IN CNAME lb.cloud.example."),
+			mustRR("lb.cloud.example. 30 IN A 203.0.113.7"),
+		},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	want := []string{
+		"web.pod.example.\t300\tIN\tCNAME\tapp.pod.example.",
+		"app.pod.example.\t300\tIN\tCNAME\tapp-1.pod.example.",
+		"app-1.pod.example.\t300\tIN\tA\t10.0.0.5",
+	}
+	if got := rrStrings(resp.Answer); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("answer =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A target outside the internal naming scheme is left alone, TTL and all
+	resp = exchange(t, h, "ext.pod.example.", dns.TypeA)
+	want = []string{
+		"ext.pod.example.\t300\tIN\tCNAME\tlb.cloud.example.",
+		"lb.cloud.example.\t30\tIN\tA\t203.0.113.7",
+	}
+	if got := rrStrings(resp.Answer); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("answer =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	var s []string
+	for _, rr := range rrs {
+		s = append(s, rr.String())
+	}
+	return s
+}
+
+func TestSelectZoneForNameNested(t *testing.T) {
+	h := newTestHandler(t, "example.=udp:10.0.0.1:53,sub.example.=udp:10.0.0.2:53,deep.sub.example.=udp:10.0.0.3:53", &stubForwarder{})
+
+	tests := []struct {
+		name     string
+		wantZone string
+		wantApex bool
+	}{
+		{"x.example.", "example.", false},
+		{"example.", "example.", true},
+		{"sub.example.", "sub.example.", true},
+		{"x.sub.example.", "sub.example.", false},
+		{"X.Sub.Example.", "sub.example.", false},
+		{"x.y.sub.example.", "sub.example.", false},
+		{"deep.sub.example.", "deep.sub.example.", true},
+		{"x.deep.sub.example.", "deep.sub.example.", false},
+		{"xsub.example.", "example.", false}, // a label boundary, not a string suffix
+	}
+	// Map order is random, so ask often enough to catch a wrong pick
+	for range 50 {
+		for _, tt := range tests {
+			cfg, ok, apex := h.selectZoneForName(tt.name)
+			if !ok || cfg.Zone != tt.wantZone || apex != tt.wantApex {
+				t.Fatalf("selectZoneForName(%q) = %v %v %v, want %s apex %v", tt.name, cfg, ok, apex, tt.wantZone, tt.wantApex)
+			}
+		}
+	}
+
+	if _, ok, _ := h.selectZoneForName("example.org."); ok {
+		t.Error("example.org. matched a zone")
+	}
+}
+
+// rewriteTest is a client name and the upstream name rewriteQuery should
+// map it to, under a zones value.
+type rewriteTest struct {
+	zones    string
+	client   string
+	upstream string
+}
+
+// checkRewrites checks each test's name both ways: rewriteQuery maps the
+// client name to the upstream one, and restoreName maps it back.
+func checkRewrites(t *testing.T, tests []rewriteTest) {
+	t.Helper()
+
+	for _, tt := range tests {
+		h := newTestHandler(t, tt.zones, &stubForwarder{})
+		cfg, ok, _ := h.selectZoneForName(tt.client)
+		if !ok {
+			t.Fatalf("%s: no zone for %s", tt.zones, tt.client)
+		}
+
+		got, err := h.rewriteQuery(tt.client, cfg)
+		if err != nil || got != tt.upstream {
+			t.Errorf("%s: rewriteQuery(%q) = %q, %v, want %q", tt.zones, tt.client, got, err, tt.upstream)
+			continue
+		}
+		if back, ok := h.restoreName(got, cfg); !ok || back != tt.client {
+			t.Errorf("%s: restoreName(%q) = %q, %v, want %q", tt.zones, got, back, ok, tt.client)
+		}
+	}
+}
+
+func TestRewriteQueryTemplate(t *testing.T) {
+	checkRewrites(t, []rewriteTest{
+		// No placeholder prepends, as before templates
+		{"pod.example.=udp:10.0.0.1:53", "web.pod.example.", "systemd-web."},
+		{"pod.example.=svc-:udp:10.0.0.1:53", "web.pod.example.", "svc-web."},
+		{"pod.example.=systemd-%s:udp:10.0.0.1:53", "web.pod.example.", "systemd-web."},
+		{"pod.example.=%s.internal:udp:10.0.0.1:53", "web.pod.example.", "web.internal."},
+		{"pod.example.=%s-svc:udp:10.0.0.1:53", "web.pod.example.", "web-svc."},
+		{"pod.example.=x-%s.internal:udp:10.0.0.1:53", "web.pod.example.", "x-web.internal."},
+	})
+
+	// A name that doesn't fit the template isn't one of the zone's
+	h := newTestHandler(t, "pod.example.=%s.internal:udp:10.0.0.1:53", &stubForwarder{})
+	cfg, _, _ := h.selectZoneForName("web.pod.example.")
+	if name, ok := h.restoreName("web.other.", cfg); ok {
+		t.Errorf("restoreName(web.other.) = %q, want no match", name)
+	}
+}
+
+func TestRewriteQueryPrefixMode(t *testing.T) {
+	checkRewrites(t, []rewriteTest{
+		// first, the default: the template wraps the subdomain as a whole
+		{"pod.example.=udp:10.0.0.1:53", "a.b.pod.example.", "systemd-a.b."},
+		{"pod.example.=udp:10.0.0.1:53", "a.b.c.pod.example.", "systemd-a.b.c."},
+		{"pod.example.=%s.internal:udp:10.0.0.1:53", "a.b.pod.example.", "a.b.internal."},
+		{"pod.example.=udp:10.0.0.1:53?prefix_mode=first", "a.b.pod.example.", "systemd-a.b."},
+		// each: every label gets its own
+		{"pod.example.=udp:10.0.0.1:53?prefix_mode=each", "a.b.pod.example.", "systemd-a.systemd-b."},
+		{"pod.example.=udp:10.0.0.1:53?prefix_mode=each", "a.b.c.pod.example.", "systemd-a.systemd-b.systemd-c."},
+		{"pod.example.=%s-x:udp:10.0.0.1:53?prefix_mode=each", "a.b.pod.example.", "a-x.b-x."},
+	})
+
+	// Under each, a name with one unprefixed label doesn't map back
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53?prefix_mode=each", &stubForwarder{})
+	cfg, _, _ := h.selectZoneForName("a.b.pod.example.")
+	if name, ok := h.restoreName("systemd-a.b.", cfg); ok {
+		t.Errorf("restoreName(systemd-a.b.) = %q, want no match", name)
+	}
+}
+
+func TestServeDNSQuestionCount(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	two := new(dns.Msg)
+	two.SetQuestion("web.pod.example.", dns.TypeA)
+	two.Question = append(two.Question, dns.Question{Name: "api.pod.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	none := new(dns.Msg)
+	none.Id = dns.Id()
+
+	for _, req := range []*dns.Msg{two, none} {
+		w := newTestWriter("udp")
+		h.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeFormatError {
+			t.Errorf("reply to %d questions = %v, want FORMERR", len(req.Question), w.msg)
+		}
+	}
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+}
+
+func TestLocalSOAFields(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{}, func(c *Config) {
+		c.SOAMname = "ns1.example.net"
+		c.SOARname = "dns.admin@example.net"
+		c.SOASerial = 2024010101
+		c.SOARefresh = 7200
+		c.SOARetry = 900
+		c.SOAExpire = 604800
+		c.NegativeTTL = 30
+	})
+
+	apex := exchange(t, h, "pod.example.", dns.TypeSOA)
+	out := exchange(t, h, "web.other.example.", dns.TypeA)
+	for _, tt := range []struct {
+		name  string
+		rrs   []dns.RR
+		owner string
+	}{
+		{"apex", apex.Answer, "pod.example."},
+		{"out of zone", out.Ns, "invalid."},
+	} {
+		if len(tt.rrs) != 1 {
+			t.Errorf("%s: %v, want one SOA", tt.name, tt.rrs)
+			continue
+		}
+		want := "ns1.example.net. dns\\.admin.example.net. 2024010101 7200 900 604800 30"
+		soa, ok := tt.rrs[0].(*dns.SOA)
+		if !ok || soa.Hdr.Name != tt.owner || soa.Hdr.Ttl != 30 {
+			t.Errorf("%s: %v, want %s's SOA with TTL 30", tt.name, tt.rrs[0], tt.owner)
+			continue
+		}
+		if got := strings.TrimPrefix(soa.String(), soa.Hdr.String()); got != want {
+			t.Errorf("%s: SOA %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestSelectZoneForNameWildcard(t *testing.T) {
+	h := newTestHandler(t, "*.example.=udp:10.0.0.1:53,pod.example.=udp:10.0.0.2:53,*.sub.example.=udp:10.0.0.3:53,sub.example.=udp:10.0.0.4:53", &stubForwarder{})
+
+	tests := []struct {
+		name     string
+		wantZone string
+		wantApex bool
+	}{
+		{"web.example.", "*.example.", false},
+		{"a.b.example.", "*.example.", false},
+		{"pod.example.", "pod.example.", true},
+		{"web.pod.example.", "pod.example.", false},
+		// Same parent: the explicit zone beats the wildcard
+		{"sub.example.", "sub.example.", true},
+		{"web.sub.example.", "sub.example.", false},
+	}
+	for range 50 {
+		for _, tt := range tests {
+			cfg, ok, apex := h.selectZoneForName(tt.name)
+			if !ok || cfg.Zone != tt.wantZone || apex != tt.wantApex {
+				t.Fatalf("selectZoneForName(%q) = %v %v %v, want %s apex %v", tt.name, cfg, ok, apex, tt.wantZone, tt.wantApex)
+			}
+		}
+	}
+
+	// A wildcard doesn't cover its parent
+	if cfg, ok, _ := h.selectZoneForName("example."); ok {
+		t.Errorf("example. matched %s", cfg.Zone)
+	}
+}
+
+func TestServeDNSWildcardZone(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "*.example.=udp:10.0.0.1:53,pod.example.=udp:10.0.0.2:53", fwd)
+
+	exchange(t, h, "web.other.example.", dns.TypeA)
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	var got []string
+	for _, q := range fwd.queries {
+		got = append(got, q.msg.Question[0].Name+" via "+q.upstream)
+	}
+	want := []string{"systemd-web.other. via 10.0.0.1:53", "systemd-web. via 10.0.0.2:53"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("upstream queries = %v, want %v", got, want)
+	}
+}
+
+func TestServeDNSNODATAHidesUpstreamSOA(t *testing.T) {
+	for _, tt := range []struct{ zones, soa string }{
+		{"pod.example.=udp:10.0.0.1:53", "systemd-web. 60 IN SOA ns.systemd-web. hostmaster.systemd-web. 1 3600 600 86400 60"},
+		{"pod.example.=udp:10.0.0.1:53?upstream_zone=systemd.internal.", "systemd.internal. 60 IN SOA ns.systemd.internal. hostmaster.systemd.internal. 1 3600 600 86400 60"},
+	} {
+		fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+			resp := new(dns.Msg)
+			resp.SetReply(m)
+			resp.Ns = append(resp.Ns, mustRR(tt.soa))
+			return resp, nil
+		})
+		h := newTestHandler(t, tt.zones, fwd)
+
+		resp := exchange(t, h, "web.pod.example.", dns.TypeAAAA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+			t.Errorf("%s: reply = %v, want NODATA", tt.zones, resp)
+		}
+		if len(resp.Ns) != 1 || soaOwner(resp) != "pod.example." {
+			t.Errorf("%s: authority = %v, want the local SOA only", tt.zones, resp.Ns)
+		}
+		if s := resp.String(); strings.Contains(s, "systemd") {
+			t.Errorf("%s: reply leaks the upstream naming:\n%s", tt.zones, s)
+		}
+	}
+}
+
+func TestServeDNSSanitizesInternalNames(t *testing.T) {
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR("systemd-web. 30 IN MX 10 systemd-mail."))
+		resp.Ns = append(resp.Ns, mustRR("systemd-web. 30 IN NS ns1.systemd-infra.corp."))
+		resp.Extra = append(resp.Extra,
+			mustRR("systemd-mail. 30 IN A 10.0.0.7"),
+			mustRR("ns1.systemd-infra.corp. 30 IN A 10.0.0.8"),
+			mustRR("public.example.org. 30 IN A 192.0.2.1"),
+		)
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.ForwardTypes = []string{"MX"}
+	})
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeMX)
+	want := []string{
+		"web.pod.example.\t300\tIN\tMX\t10 mail.pod.example.",
+		"", // the NS naming an internal host goes
+		"mail.pod.example.\t300\tIN\tA\t10.0.0.7",
+		"public.example.org.\t30\tIN\tA\t192.0.2.1",
+	}
+	got := []string{strings.Join(rrStrings(resp.Answer), " "), strings.Join(rrStrings(resp.Ns), " ")}
+	got = append(got, rrStrings(resp.Extra)...)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("reply sections\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestServeDNSMaxAnswers(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {
+			mustRR("systemd-web. 30 IN CNAME systemd-lb."),
+			mustRR("systemd-lb. 30 IN A 10.0.0.1"),
+			mustRR("systemd-lb. 30 IN A 10.0.0.2"),
+			mustRR("systemd-lb. 30 IN A 10.0.0.3"),
+			mustRR("systemd-lb. 30 IN A 10.0.0.4"),
+		},
+	}}
+
+	for _, tt := range []struct {
+		maxAnswers int
+		want       []string
+	}{
+		{0, []string{"CNAME lb.pod.example.", "A 10.0.0.1", "A 10.0.0.2", "A 10.0.0.3", "A 10.0.0.4"}},
+		// The CNAME doesn't count, and the kept records are already restored
+		{2, []string{"CNAME lb.pod.example.", "A 10.0.0.1", "A 10.0.0.2"}},
+		{10, []string{"CNAME lb.pod.example.", "A 10.0.0.1", "A 10.0.0.2", "A 10.0.0.3", "A 10.0.0.4"}},
+	} {
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.MaxAnswers = tt.maxAnswers
+		})
+
+		// TCP too, where size never trims
+		for _, proto := range []string{"udp", "tcp"} {
+			req := new(dns.Msg)
+			req.SetQuestion("web.pod.example.", dns.TypeA)
+			w := newTestWriter(proto)
+			h.ServeDNS(w, req)
+
+			var got []string
+			for _, rr := range w.msg.Answer {
+				got = append(got, strings.Join(strings.Fields(rr.String())[3:], " "))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("MAX_ANSWERS=%d over %s: answer %v, want %v", tt.maxAnswers, proto, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRewriteQueryUpstreamZone(t *testing.T) {
+	checkRewrites(t, []rewriteTest{
+		{"pod.example.=udp:10.0.0.1:53?upstream_zone=systemd.internal.", "web.pod.example.", "web.systemd.internal."},
+		{"pod.example.=udp:10.0.0.1:53?upstream_zone=systemd.internal.", "a.b.pod.example.", "a.b.systemd.internal."},
+		// In addition to a prefix the zone names itself
+		{"pod.example.=svc-:udp:10.0.0.1:53?upstream_zone=systemd.internal.", "web.pod.example.", "svc-web.systemd.internal."},
+	})
+
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"web.systemd.internal. A": {
+			mustRR("web.systemd.internal. 30 IN CNAME lb.systemd.internal."),
+			mustRR("lb.systemd.internal. 30 IN A 10.0.0.5"),
+		},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53?upstream_zone=systemd.internal.", fwd)
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	want := []string{
+		"web.pod.example.\t300\tIN\tCNAME\tlb.pod.example.",
+		"lb.pod.example.\t300\tIN\tA\t10.0.0.5",
+	}
+	if got := rrStrings(resp.Answer); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("answer\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Names outside the upstream zone don't map back
+	cfg, _, _ := h.selectZoneForName("web.pod.example.")
+	if name, ok := h.restoreName("web.other.internal.", cfg); ok {
+		t.Errorf("restoreName(web.other.internal.) = %q, want no match", name)
+	}
+}
+
+func TestServeDNSDisallowedTypeIsNODATA(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeMX)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Fatalf("reply = %v, want NOERROR without answers, not NXDOMAIN", resp)
+	}
+	if len(resp.Ns) != 1 || soaOwner(resp) != "pod.example." || resp.Ns[0].Header().Ttl != 60 {
+		t.Errorf("authority = %v, want the local SOA with NEGATIVE_TTL", resp.Ns)
+	}
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+}
+
+func TestServeDNSForwardTypes(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. TXT":   {mustRR(`systemd-web. 30 IN TXT "v=1"`)},
+		"systemd-web. SRV":   {mustRR("systemd-web. 30 IN SRV 0 5 443 systemd-web.")},
+		"systemd-web. CNAME": {mustRR("systemd-web. 30 IN CNAME systemd-lb.")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.ForwardTypes = []string{"a", " TXT", "SRV", "CNAME"}
+	})
+
+	tests := []struct {
+		qtype uint16
+		want  string
+	}{
+		{dns.TypeTXT, "web.pod.example.\t300\tIN\tTXT\t\"v=1\""},
+		{dns.TypeSRV, "web.pod.example.\t300\tIN\tSRV\t0 5 443 web.pod.example."},
+		{dns.TypeCNAME, "web.pod.example.\t300\tIN\tCNAME\tlb.pod.example."},
+	}
+	for _, tt := range tests {
+		resp := exchange(t, h, "web.pod.example.", tt.qtype)
+		if got := strings.Join(rrStrings(resp.Answer), " "); got != tt.want {
+			t.Errorf("%s: answer = %q, want %q", dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+
+	// MX is left out, so it gets the local NODATA without a lookup
+	before := len(fwd.names())
+	resp := exchange(t, h, "web.pod.example.", dns.TypeMX)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || soaOwner(resp) != "pod.example." {
+		t.Errorf("MX: reply = %v, want NODATA with the local SOA", resp)
+	}
+	if len(fwd.names()) != before {
+		t.Error("MX was forwarded")
+	}
+
+	if _, err := NewHandler(Config{ForwardTypes: []string{"A", "BOGUS"}}); err == nil || !strings.Contains(err.Error(), "BOGUS") {
+		t.Errorf("NewHandler with FORWARD_TYPES=A,BOGUS: err = %v, want the unknown type named", err)
+	}
+}
+
+func TestNormalizeUpstream(t *testing.T) {
+	tests := []struct {
+		upstream, proto, want string
+	}{
+		{"10.0.0.1", "udp", "10.0.0.1:53"},
+		{"10.0.0.1", "tcp", "10.0.0.1:53"},
+		{"10.0.0.1", "tls", "10.0.0.1:853"},
+		{"10.0.0.1:5353", "udp", "10.0.0.1:5353"},
+		{"10.0.0.1:53", "tls", "10.0.0.1:53"},
+		{"2001:db8::1", "udp", "[2001:db8::1]:53"},
+		{"2001:db8::1", "tls", "[2001:db8::1]:853"},
+		{"[2001:db8::1]", "udp", "[2001:db8::1]:53"},
+		{"[2001:db8::1]:5353", "udp", "[2001:db8::1]:5353"},
+		{"fe80::1%eth0", "udp", "[fe80::1%eth0]:53"},
+		{"dns.example", "tls", "dns.example:853"},
+		{"dns.example:8853", "tls", "dns.example:8853"},
+	}
+	for _, tt := range tests {
+		if got, err := normalizeUpstream(tt.upstream, tt.proto); err != nil || got != tt.want {
+			t.Errorf("normalizeUpstream(%q, %s) = %q, %v, want %q", tt.upstream, tt.proto, got, err, tt.want)
+		}
+	}
+
+	for _, upstream := range []string{"[2001:db8::1", "[]:53", "[2001:db8::1]53", "[2001:db8::1]:", ":53", "10.0.0.1:"} {
+		if got, err := normalizeUpstream(upstream, "udp"); err == nil {
+			t.Errorf("normalizeUpstream(%q) = %q, want an error", upstream, got)
+		}
+	}
+}
+
+func TestServeDNSWriteError(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{})
+
+	// Forwarded, and answered locally
+	for _, name := range []string{"web.pod.example.", "web.other.example."} {
+		before := testutil.ToFloat64(writeErrorsTotal)
+		logs.Reset()
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := newTestWriter("udp")
+		w.err = errors.New("connection reset by peer")
+		h.ServeDNS(w, req)
+
+		if n := testutil.ToFloat64(writeErrorsTotal) - before; n != 1 {
+			t.Errorf("%s: write_errors_total went up by %v, want 1", name, n)
+		}
+		line := logs.String()
+		for _, want := range []string{"failed to write response", "client=192.0.2.10", "qname=" + name, "connection reset by peer"} {
+			if !strings.Contains(line, want) {
+				t.Errorf("%s: log %q lacks %q", name, line, want)
+			}
+		}
+	}
+}
+
+func TestRewriteStrip(t *testing.T) {
+	checkRewrites(t, []rewriteTest{
+		{"pod.example.=ext-:udp:10.0.0.1:53?rewrite=strip", "ext-web.pod.example.", "web.pod.example."},
+		{"pod.example.=%s-public:udp:10.0.0.1:53?rewrite=strip", "web-public.pod.example.", "web.pod.example."},
+		{"pod.example.=ext-:udp:10.0.0.1:53?rewrite=strip&upstream_zone=corp.internal.", "ext-web.pod.example.", "web.corp.internal."},
+	})
+
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"web.pod.example. A": {
+			mustRR("web.pod.example. 30 IN CNAME lb.pod.example."),
+			mustRR("lb.pod.example. 30 IN A 10.0.0.5"),
+		},
+	}}
+	h := newTestHandler(t, "pod.example.=ext-:udp:10.0.0.1:53?rewrite=strip", fwd)
+
+	resp := exchange(t, h, "ext-web.pod.example.", dns.TypeA)
+	want := []string{
+		"ext-web.pod.example.\t300\tIN\tCNAME\text-lb.pod.example.",
+		"ext-lb.pod.example.\t300\tIN\tA\t10.0.0.5",
+	}
+	if got := rrStrings(resp.Answer); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("answer\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Client names without the prefix aren't the zone's to forward
+	if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s for an unprefixed name, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+	if got := fwd.names(); len(got) != 1 {
+		t.Errorf("upstream queries = %v, want only the prefixed name's", got)
+	}
+}
+
+func TestRewriteQueryNoPrefix(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "inherit.example.=udp:10.0.0.1:53,none.example.=-:udp:10.0.0.2:53,own.example.=own-:udp:10.0.0.3:53", fwd, func(c *Config) {
+		c.DefaultPrefix = "k8s-"
+	})
+
+	for _, name := range []string{"web.inherit.example.", "web.none.example.", "web.own.example."} {
+		exchange(t, h, name, dns.TypeA)
+	}
+	want := []string{"k8s-web.", "web.", "own-web."}
+	if got := fwd.names(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("upstream queries = %v, want %v", got, want)
+	}
+
+	// Without a prefix only the query name itself maps back, not every name
+	cfg, _, _ := h.selectZoneForName("web.none.example.")
+	if name, ok := h.restoreName("other.", cfg); ok {
+		t.Errorf("restoreName(other.) = %q, want no match", name)
+	}
+}
+
+func TestServeDNSCoalescesIdenticalQueries(t *testing.T) {
+	var mu sync.Mutex
+	exchanges := make(map[uint16]int)
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		mu.Lock()
+		exchanges[m.Question[0].Qtype]++
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond) // long enough for every query to join
+
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range 20 {
+		qtype := dns.TypeA
+		if i%10 == 0 {
+			qtype = dns.TypeAAAA
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			req := new(dns.Msg)
+			req.SetQuestion("web.pod.example.", qtype)
+			w := newTestWriter("udp")
+			h.ServeDNS(w, req)
+			if w.msg == nil || w.msg.Id != req.Id || w.msg.Rcode != dns.RcodeSuccess {
+				t.Errorf("reply = %v, want NOERROR for query %d", w.msg, req.Id)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if exchanges[dns.TypeA] != 1 || exchanges[dns.TypeAAAA] != 1 {
+		t.Errorf("exchanges per qtype = %v, want one each", exchanges)
+	}
+}
+
+func TestServeDNSReverseZone(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"5.0.0.10.in-addr.arpa. PTR": {mustRR("5.0.0.10.in-addr.arpa. 30 IN PTR host5.lan.")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53,10.in-addr.arpa.=udp:10.0.0.1:53", fwd)
+
+	cfg, _, _ := h.selectZoneForName("5.0.0.10.in-addr.arpa.")
+	if !cfg.ReverseZone {
+		t.Errorf("%s not a reverse zone", cfg.Zone)
+	}
+
+	resp := exchange(t, h, "5.0.0.10.in-addr.arpa.", dns.TypePTR)
+	// The name goes up unprefixed
+	if got := fwd.names(); len(got) != 1 || got[0] != "5.0.0.10.in-addr.arpa." {
+		t.Errorf("upstream queries = %v, want the reverse name unchanged", got)
+	}
+	want := "5.0.0.10.in-addr.arpa.\t300\tIN\tPTR\thost5.lan."
+	if got := rrStrings(resp.Answer); len(got) != 1 || got[0] != want {
+		t.Errorf("answer = %v, want %s", got, want)
+	}
+
+	// PTR is only forwarded for reverse zones
+	if resp := exchange(t, h, "web.pod.example.", dns.TypePTR); len(fwd.names()) != 1 || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("PTR in a forward zone: reply %v, upstream queries %v, want NODATA locally", resp, fwd.names())
+	}
+}
+
+func TestOutOfZoneSOA(t *testing.T) {
+	tests := []struct {
+		soa       string
+		name      string
+		wantOwner string
+		wantTTL   uint32
+	}{
+		{"", "web.nowhere.net.", "invalid.", 60}, // the default
+		{"nxdomain.example.net.", "web.nowhere.net.", "nxdomain.example.net.", 60},
+		{outOfZoneSOANone, "web.nowhere.net.", "", 0},
+		// closest: the zone sharing the most labels, with its own TTL
+		{outOfZoneSOAClosest, "x.c.pod.example.", "a.pod.example.", 10},
+		{outOfZoneSOAClosest, "web.org.", "other.org.", 20},
+		{outOfZoneSOAClosest, "web.nowhere.net.", "", 0},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "a.pod.example.=udp:10.0.0.1:53?negative_ttl=10,other.org.=udp:10.0.0.2:53?negative_ttl=20", &stubForwarder{}, func(c *Config) {
+			if tt.soa != "" {
+				c.OutOfZoneSOA = tt.soa
+			}
+		})
+
+		resp := exchange(t, h, tt.name, dns.TypeA)
+		if resp.Rcode != dns.RcodeNameError {
+			t.Errorf("OUT_OF_ZONE_SOA=%q %s: rcode = %s, want NXDOMAIN", tt.soa, tt.name, dns.RcodeToString[resp.Rcode])
+		}
+		if tt.wantOwner == "" {
+			if len(resp.Ns) != 0 {
+				t.Errorf("OUT_OF_ZONE_SOA=%q %s: authority = %v, want none", tt.soa, tt.name, resp.Ns)
+			}
+			continue
+		}
+		if len(resp.Ns) != 1 || soaOwner(resp) != tt.wantOwner || resp.Ns[0].Header().Ttl != tt.wantTTL {
+			t.Errorf("OUT_OF_ZONE_SOA=%q %s: authority = %v, want %s's SOA with TTL %d", tt.soa, tt.name, resp.Ns, tt.wantOwner, tt.wantTTL)
+		}
+	}
+}
+
+func TestRewriteMismatchesCounted(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {
+			mustRR("systemd-web. 30 IN A 10.0.0.5"),
+			mustRR("unrelated.example.org. 30 IN A 192.0.2.1"),
+			mustRR("other-web. 30 IN A 192.0.2.2"),
+		},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+	counter := rewriteMismatchesTotal.WithLabelValues("pod.example.")
+	before := testutil.ToFloat64(counter)
+
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	if n := testutil.ToFloat64(counter) - before; n != 2 {
+		t.Errorf("rewrite_mismatches_total went up by %v, want 2", n)
+	}
+
+	// A clean response, and the local SOA of a negative one, count nothing
+	before = testutil.ToFloat64(counter)
+	exchange(t, h, "missing.pod.example.", dns.TypeA)
+	if n := testutil.ToFloat64(counter) - before; n != 0 {
+		t.Errorf("rewrite_mismatches_total went up by %v for NXDOMAIN, want 0", n)
+	}
+}
+
+func TestServeDNSHTTPSTarget(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. HTTPS": {
+			mustRR(`systemd-web. 30 IN HTTPS 1 systemd-lb. alpn="h2,h3" ipv4hint="10.0.0.5" ipv6hint="fd00::5"`),
+			mustRR("systemd-web. 30 IN HTTPS 2 . alpn=h2"),
+		},
+		"systemd-web. SVCB": {mustRR("systemd-web. 30 IN SVCB 1 systemd-backend. port=8443")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.ForwardTypes = []string{"HTTPS", "SVCB"}
+	})
+
+	https := exchange(t, h, "web.pod.example.", dns.TypeHTTPS)
+	want := []string{
+		`web.pod.example.	300	IN	HTTPS	1 lb.pod.example. alpn="h2,h3" ipv4hint="10.0.0.5" ipv6hint="fd00::5"`,
+		`web.pod.example.	300	IN	HTTPS	2 . alpn="h2"`,
+	}
+	if got := rrStrings(https.Answer); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("HTTPS answer\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	svcb := exchange(t, h, "web.pod.example.", dns.TypeSVCB)
+	wantSVCB := `web.pod.example.	300	IN	SVCB	1 backend.pod.example. port="8443"`
+	if got := rrStrings(svcb.Answer); len(got) != 1 || got[0] != wantSVCB {
+		t.Errorf("SVCB answer = %v, want %s", got, wantSVCB)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53?negative_ttl=10", &stubForwarder{})
+	cfg, _, _ := h.selectZoneForName("pod.example.")
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	req.RecursionDesired = true
+
+	tests := []struct {
+		name      string
+		msg       *dns.Msg
+		wantRcode int
+		wantSOA   string
+		wantTTL   uint32
+		wantAA    bool
+	}{
+		{"REFUSED", h.errorResponse(req, dns.RcodeRefused, "", 0), dns.RcodeRefused, "", 0, false},
+		{"SERVFAIL", h.errorResponse(req, dns.RcodeServerFailure, "", 0), dns.RcodeServerFailure, "", 0, false},
+		{"FORMERR", h.errorResponse(req, dns.RcodeFormatError, "", 0), dns.RcodeFormatError, "", 0, false},
+		{"out-of-zone NXDOMAIN", h.errorResponse(req, dns.RcodeNameError, "invalid.", 60), dns.RcodeNameError, "invalid.", 60, false},
+		{"zone NXDOMAIN", h.zoneErrorResponse(req, dns.RcodeNameError, cfg), dns.RcodeNameError, "pod.example.", 10, true},
+		{"zone NODATA", h.zoneErrorResponse(req, dns.RcodeSuccess, cfg), dns.RcodeSuccess, "pod.example.", 10, true},
+	}
+	for _, tt := range tests {
+		m := tt.msg
+		if m.Rcode != tt.wantRcode || m.Authoritative != tt.wantAA {
+			t.Errorf("%s: rcode %s AA %v, want %s AA %v", tt.name, dns.RcodeToString[m.Rcode], m.Authoritative, dns.RcodeToString[tt.wantRcode], tt.wantAA)
+		}
+		if m.Id != req.Id || !m.Response || !m.RecursionDesired || len(m.Question) != 1 || m.Question[0] != req.Question[0] {
+			t.Errorf("%s: header %v, want a reply to the request", tt.name, m.MsgHdr)
+		}
+		if len(m.Answer) != 0 || len(m.Extra) != 0 {
+			t.Errorf("%s: answer %v, additional %v, want none", tt.name, m.Answer, m.Extra)
+		}
+
+		if tt.wantSOA == "" {
+			if len(m.Ns) != 0 {
+				t.Errorf("%s: authority %v, want none", tt.name, m.Ns)
+			}
+			continue
+		}
+		soa, ok := m.Ns[0].(*dns.SOA)
+		if len(m.Ns) != 1 || !ok || soa.Hdr.Name != tt.wantSOA || soa.Hdr.Ttl != tt.wantTTL || soa.Minttl != tt.wantTTL {
+			t.Errorf("%s: authority %v, want %s's SOA with TTL and minimum %d", tt.name, m.Ns, tt.wantSOA, tt.wantTTL)
+		}
+	}
+}
+
+func TestServeDNSTTLMode(t *testing.T) {
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR("systemd-web. 600 IN MX 10 systemd-mail."))
+		resp.Ns = append(resp.Ns, mustRR("systemd-web. 30 IN NS ns1.example.net."))
+		resp.Extra = append(resp.Extra,
+			mustRR("systemd-mail. 3600 IN A 10.0.0.7"),
+			mustRR("public.example.org. 30 IN A 192.0.2.1"),
+		)
+		return resp, nil
+	})
+
+	// ANSWER_TTL is 300; records that don't map back keep theirs
+	tests := []struct {
+		mode              string
+		answer, ns, extra uint32
+	}{
+		{ttlModeOverride, 300, 300, 300},
+		{ttlModePassthrough, 600, 30, 3600},
+		{ttlModeCap, 300, 30, 300},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.TTLMode = tt.mode
+			c.ForwardTypes = []string{"MX"}
+		})
+		resp := exchange(t, h, "web.pod.example.", dns.TypeMX)
+		if len(resp.Answer) != 1 || len(resp.Ns) != 1 || len(resp.Extra) != 2 {
+			t.Fatalf("TTL_MODE=%s: reply = %v, want 1 answer, 1 NS and 2 additional records", tt.mode, resp)
+		}
+
+		got := []uint32{resp.Answer[0].Header().Ttl, resp.Ns[0].Header().Ttl, resp.Extra[0].Header().Ttl, resp.Extra[1].Header().Ttl}
+		want := []uint32{tt.answer, tt.ns, tt.extra, 30}
+		if !slices.Equal(got, want) {
+			t.Errorf("TTL_MODE=%s: answer, ns, extra TTLs = %v, want %v", tt.mode, got, want)
+		}
+	}
+}
+
+func TestServeDNSMinTTL(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-low. A":  {mustRR("systemd-low. 5 IN A 10.0.0.5")},
+		"systemd-high. A": {mustRR("systemd-high. 600 IN A 10.0.0.6")},
+	}}
+
+	tests := []struct {
+		mode     string
+		minTTL   uint32
+		wantLow  uint32
+		wantHigh uint32
+	}{
+		{ttlModePassthrough, 60, 60, 600},
+		{ttlModeCap, 60, 60, 300},
+		{ttlModePassthrough, 0, 5, 600},
+		// Override ignores upstream TTLs, and so the floor
+		{ttlModeOverride, 60, 300, 300},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.TTLMode = tt.mode
+			c.MinTTL = tt.minTTL
+		})
+		for name, want := range map[string]uint32{"low.pod.example.": tt.wantLow, "high.pod.example.": tt.wantHigh} {
+			resp := exchange(t, h, name, dns.TypeA)
+			if len(resp.Answer) != 1 {
+				t.Errorf("%s MIN_TTL=%d: %s answer = %v, want one A", tt.mode, tt.minTTL, name, resp.Answer)
+				continue
+			}
+			if ttl := resp.Answer[0].Header().Ttl; ttl != want {
+				t.Errorf("%s MIN_TTL=%d: %s TTL = %d, want %d", tt.mode, tt.minTTL, name, ttl, want)
+			}
+		}
+	}
+}
+
+func TestServeDNSNameTooLongAfterRewrite(t *testing.T) {
+	quietLog(t)
+	label := func(n int) string { return strings.Repeat("a", n) }
+	// 210 + n octets on the wire, at most 255
+	long := func(n int) string {
+		return "web." + label(63) + "." + label(63) + "." + label(63) + "." + label(n) + ".pod.example."
+	}
+	// Upstream names end in a zone 4 octets longer, which with the prefix
+	// adds 12 octets
+	const keepZone = "pod.example.=systemd-:udp:10.0.0.1:53?upstream_zone=pod.example.org."
+	upstream := func(name string) string {
+		return "systemd-" + strings.TrimSuffix(name, "pod.example.") + "pod.example.org."
+	}
+
+	tests := []struct {
+		zones   string
+		name    string
+		rewrite string // the upstream name, "" when too long
+	}{
+		{"pod.example.=udp:10.0.0.1:53", label(55) + ".pod.example.", "systemd-" + label(55) + "."}, // a 63-octet label
+		{"pod.example.=udp:10.0.0.1:53", label(56) + ".pod.example.", ""},
+		{keepZone, long(33), upstream(long(33))}, // 255 octets upstream
+		{keepZone, long(34), ""},
+		{keepZone, long(45), ""}, // 255 octets from the client
+	}
+	for _, tt := range tests {
+		fwd := &stubForwarder{}
+		h := newTestHandler(t, tt.zones, fwd)
+
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, dns.TypeA)
+		req.SetEdns0(1232, false)
+		resp := serve(t, h, req)
+
+		if tt.rewrite != "" {
+			if got := fwd.names(); len(got) != 1 || got[0] != tt.rewrite {
+				t.Errorf("%s: upstream queries = %v, want [%s]", tt.name, got, tt.rewrite)
+			}
+			continue
+		}
+		if got := fwd.names(); len(got) != 0 {
+			t.Errorf("%s: upstream queries = %v, want none", tt.name, got)
+		}
+		if resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("%s: rcode = %s, want SERVFAIL", tt.name, dns.RcodeToString[resp.Rcode])
+		}
+		if e := ede(resp); e == nil || e.InfoCode != dns.ExtendedErrorCodeOther || e.ExtraText != "name too long after rewrite" {
+			t.Errorf("%s: EDE = %v, want \"name too long after rewrite\"", tt.name, e)
+		}
+	}
+}
+
+func TestServeDNSPassThrough(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"www.ext.example. A": {
+			mustRR("www.ext.example. 30 IN CNAME web.ext.example."),
+			mustRR("web.ext.example. 30 IN A 10.0.0.5"),
+		},
+		"ext.example. SOA": {mustRR("ext.example. 30 IN SOA ns.ext.example. hostmaster.ext.example. 7 3600 600 86400 60")},
+	}}
+
+	tests := []struct {
+		mode    string
+		wantTTL string
+	}{
+		{ttlModeOverride, "300"},
+		{ttlModePassthrough, "30"},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, "ext.example.=udp:10.0.0.1:53?rewrite=none", fwd, func(c *Config) {
+			c.TTLMode = tt.mode
+		})
+
+		resp := exchange(t, h, "www.ext.example.", dns.TypeA)
+		want := []string{
+			"www.ext.example.\t" + tt.wantTTL + "\tIN\tCNAME\tweb.ext.example.",
+			"web.ext.example.\t" + tt.wantTTL + "\tIN\tA\t10.0.0.5",
+		}
+		if got := rrStrings(resp.Answer); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("TTL_MODE=%s: answer = %v, want %v", tt.mode, got, want)
+		}
+	}
+	if got := fwd.names(); len(got) != 2 || got[0] != "www.ext.example." || got[1] != "www.ext.example." {
+		t.Errorf("upstream queries = %v, want the client's name unaltered", got)
+	}
+
+	// The apex is still answered locally
+	h := newTestHandler(t, "ext.example.=udp:10.0.0.1:53?rewrite=none", fwd)
+	resp := exchange(t, h, "ext.example.", dns.TypeSOA)
+	var soa *dns.SOA
+	if len(resp.Answer) == 1 {
+		soa, _ = resp.Answer[0].(*dns.SOA)
+	}
+	if soa == nil || soa.Ns == "ns.ext.example." {
+		t.Errorf("apex SOA = %v, want the local one", resp.Answer)
+	}
+	if got := fwd.names(); len(got) != 2 {
+		t.Errorf("upstream queries = %v after an apex query, want no more", got)
+	}
+}
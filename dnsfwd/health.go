@@ -0,0 +1,256 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Upstream liveness probing and /healthz
+// ---------------------------------------------
+
+// zoneState is the runtime state shared by every copy of a ZoneConfig.
+// A nil *zoneState is valid and reports every upstream as up.
+type zoneState struct {
+	upstreams []upstreamState // parallel to ZoneConfig.Upstreams
+	next      atomic.Uint32   // round-robin counter
+}
+
+type upstreamState struct {
+	down      atomic.Bool
+	tcpUntil  atomic.Int64  // unix nanos until which UDP is skipped, see TCP_COOLDOWN
+	failures  atomic.Uint32 // consecutive failed exchanges, see breakerAllows
+	openUntil atomic.Int64  // unix nanos until which an open breaker skips it
+
+	mu      sync.Mutex    // guards rtt and sampled
+	rtt     time.Duration // latency EWMA, 0 until the first sample
+	sampled time.Time
+}
+
+func newZoneState(upstreams int) *zoneState {
+	return &zoneState{upstreams: make([]upstreamState, upstreams)}
+}
+
+// withState returns zones with runtime state attached to each one. An
+// upstream that prev's zone of the same name and protocol also has keeps
+// its state, so a reload doesn't forget what it knew about the upstreams
+// it left alone.
+func withState(zones, prev map[string]ZoneConfig) map[string]ZoneConfig {
+	for name, cfg := range zones {
+		old, ok := prev[name]
+		if !ok || old.Protocol != cfg.Protocol {
+			old = ZoneConfig{}
+		}
+		cfg.state = carryState(old.state, old.Upstreams, cfg.Upstreams)
+		zones[name] = withViewState(cfg, old.Views)
+	}
+	return zones
+}
+
+// zoneChanged reports whether cfg differs from old in anything but
+// runtime state, which makes old's cached answers stale.
+func zoneChanged(old, cfg ZoneConfig) bool {
+	config := func(c ZoneConfig) ZoneConfig {
+		c.state, c.globals = nil, nil
+		c.Views = slices.Clone(c.Views)
+		for i := range c.Views {
+			c.Views[i].state = nil
+		}
+		return c
+	}
+	return !reflect.DeepEqual(config(old), config(cfg))
+}
+
+// carryState returns state for upstreams, with that of the ones also in
+// prevUpstreams copied from prev.
+func carryState(prev *zoneState, prevUpstreams, upstreams []string) *zoneState {
+	s := newZoneState(len(upstreams))
+	if prev == nil {
+		return s
+	}
+	for i, upstream := range upstreams {
+		if j := slices.Index(prevUpstreams, upstream); j >= 0 && j < len(prev.upstreams) {
+			s.upstreams[i].copyFrom(&prev.upstreams[j])
+		}
+	}
+	if slices.Equal(prevUpstreams, upstreams) {
+		s.next.Store(prev.next.Load())
+	}
+	return s
+}
+
+// copyFrom sets u's health, breaker, TCP cooldown and latency state to
+// prev's.
+func (u *upstreamState) copyFrom(prev *upstreamState) {
+	u.down.Store(prev.down.Load())
+	u.tcpUntil.Store(prev.tcpUntil.Load())
+	u.failures.Store(prev.failures.Load())
+	u.openUntil.Store(prev.openUntil.Load())
+
+	prev.mu.Lock()
+	u.rtt, u.sampled = prev.rtt, prev.sampled
+	prev.mu.Unlock()
+}
+
+func (s *zoneState) up(i int) bool {
+	return s == nil || i >= len(s.upstreams) || !s.upstreams[i].down.Load()
+}
+
+// setUp records upstream i's reachability and reports whether it changed.
+func (s *zoneState) setUp(i int, up bool) bool {
+	if s == nil || i >= len(s.upstreams) {
+		return false
+	}
+	return s.upstreams[i].down.Swap(!up) == up
+}
+
+func (s *zoneState) anyUp() bool {
+	if s == nil {
+		return true
+	}
+	for i := range s.upstreams {
+		if s.up(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeLoop checks every upstream each interval until ctx is done.
+func (h *DNSHandler) probeLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.probeUpstreams()
+		}
+	}
+}
+
+// ProbeUpstreams probes every upstream once, as Run does each
+// PROBE_INTERVAL, and returns the failures joined, nil when all of them
+// answered. It's meant for a startup check before serving.
+func (h *DNSHandler) ProbeUpstreams() error {
+	return errors.Join(h.probeUpstreams()...)
+}
+
+// probeUpstreams sends an SOA query to every upstream for the zone it
+// serves, see probeName, returning an error for each that didn't answer
+// NOERROR or NXDOMAIN. REFUSED and SERVFAIL count as down: such an
+// upstream is reachable but won't resolve the zone's names.
+func (h *DNSHandler) probeUpstreams() []error {
+	h.mu.RLock()
+	zones := h.zones
+	h.mu.RUnlock()
+
+	var mu sync.Mutex
+	var failed []error
+	var wg sync.WaitGroup
+	for _, zone := range zones {
+		for _, cfg := range zone.horizons() {
+			for i, upstream := range cfg.Upstreams {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					h.probeUpstream(cfg, i, upstream, &mu, &failed)
+				}()
+			}
+		}
+	}
+	wg.Wait()
+
+	// Sorted, so the joined error reads the same every time
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Error() < failed[j].Error() })
+	return failed
+}
+
+// probeUpstream probes cfg's upstream i, recording its reachability and
+// appending a failure to failed under mu.
+func (h *DNSHandler) probeUpstream(cfg *ZoneConfig, i int, upstream string, mu *sync.Mutex, failed *[]error) {
+	m := new(dns.Msg)
+	m.SetQuestion(probeName(cfg), dns.TypeSOA)
+
+	ctx, cancel := h.queryContext()
+	defer cancel()
+
+	resp, err := h.forward(ctx, m, cfg, transport(cfg.Protocol), upstream)
+	if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		err = fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		mu.Lock()
+		*failed = append(*failed, fmt.Errorf("zone %s upstream %s: %w", cfg.Zone, upstream, err))
+		mu.Unlock()
+	}
+	if err == nil {
+		cfg.state.breakerSuccess(i)
+	}
+	if !cfg.state.setUp(i, err == nil) {
+		return
+	}
+	if err != nil {
+		slog.Warn("upstream down", "zone", cfg.Zone, "upstream", upstream, "error", err)
+	} else {
+		slog.Info("upstream up", "zone", cfg.Zone, "upstream", upstream)
+	}
+}
+
+// probeName returns the name whose SOA probes cfg's upstreams: the zone
+// itself when they use the client's names, otherwise the zone their
+// rewritten names live in, the root for plain prefixed names.
+func probeName(cfg *ZoneConfig) string {
+	if cfg.NoRewrite || cfg.ReverseZone {
+		return cfg.origin()
+	}
+	if zone := upstreamZone(cfg); zone != "" {
+		return dns.Fqdn(zone)
+	}
+	return "."
+}
+
+// ServeHealth answers 200 while every zone, and each of its views, has a
+// reachable upstream, and 503 listing the zones that don't.
+func (h *DNSHandler) ServeHealth(rw http.ResponseWriter, _ *http.Request) {
+	h.mu.RLock()
+	var down []string
+	for name, zone := range h.zones {
+		for _, cfg := range zone.horizons() {
+			if !cfg.state.anyUp() {
+				down = append(down, name)
+				break
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	if len(down) > 0 {
+		sort.Strings(down)
+		http.Error(rw, fmt.Sprintf("no reachable upstream for %s", strings.Join(down, ", ")), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = fmt.Fprintln(rw, "ok")
+}
+
+// NewHealthServer returns an HTTP server for ServeHealth at /healthz.
+func (h *DNSHandler) NewHealthServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.ServeHealth)
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,171 @@
+package dnsfwd
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSetZonesKeepsState(t *testing.T) {
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53;10.0.0.2:53,other.example.=udp:10.0.0.3:53", &stubForwarder{})
+	now := time.Now()
+
+	zoneState := func(zone string) *zoneState {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return h.zones[zone].state
+	}
+
+	s := zoneState("pod.example.")
+	s.setUp(1, false)
+	for range 3 {
+		s.breakerFailure(1, now, 3, time.Minute)
+	}
+	s.observeLatency(1, 20*time.Millisecond, now)
+	s.requireTCP(1, now.Add(time.Minute))
+	zoneState("other.example.").setUp(0, false)
+
+	// 10.0.0.2 stays in pod.example., now second to a new upstream;
+	// other.example. switches protocol
+	zones, err := ParseZoneEnv("pod.example.=udp:10.0.0.4:53;10.0.0.2:53,other.example.=tcp:10.0.0.3:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.SetZones(zones); err != nil {
+		t.Fatalf("SetZones: %v", err)
+	}
+
+	s = zoneState("pod.example.")
+	if !s.up(0) {
+		t.Error("new upstream 10.0.0.4 starts down")
+	}
+	if s.up(1) {
+		t.Error("10.0.0.2 came back up on reload")
+	}
+	if ok, _ := s.breakerAllows(1, now, 3, time.Minute); ok {
+		t.Error("10.0.0.2's open breaker closed on reload")
+	}
+	if !s.needsTCP(1, now) {
+		t.Error("10.0.0.2's TCP cooldown ended on reload")
+	}
+	if rtt := s.latency(1, now); rtt != 20*time.Millisecond {
+		t.Errorf("10.0.0.2's latency = %s after reload, want 20ms", rtt)
+	}
+
+	if !zoneState("other.example.").up(0) {
+		t.Error("other.example. kept its state across a protocol change")
+	}
+}
+
+func TestProbeUpstreams(t *testing.T) {
+	quietLog(t)
+	reachable := startUpstream(t, "udp", answerA)
+	// An upstream that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	unreachable := pc.LocalAddr().String()
+
+	configure := func(c *Config) {
+		c.UpstreamTimeout = 100 * time.Millisecond
+		c.UpstreamRetries = 0
+	}
+
+	h := newTestHandler(t, "pod.example.=udp:"+reachable, nil, configure)
+	if err := h.ProbeUpstreams(); err != nil {
+		t.Errorf("ProbeUpstreams with every upstream reachable: %v", err)
+	}
+
+	h = newTestHandler(t, "pod.example.=udp:"+reachable+",other.example.=udp:"+unreachable, nil, configure)
+	err = h.ProbeUpstreams()
+	if err == nil {
+		t.Fatal("ProbeUpstreams with an unreachable upstream succeeded")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "other.example.") || !strings.Contains(msg, unreachable) {
+		t.Errorf("error %q does not name other.example.'s upstream %s", msg, unreachable)
+	} else if strings.Contains(msg, reachable) {
+		t.Errorf("error %q names the reachable upstream %s", msg, reachable)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.zones["pod.example."].state.up(0) {
+		t.Error("reachable upstream marked down")
+	}
+	if h.zones["other.example."].state.up(0) {
+		t.Error("unreachable upstream still up after the probe")
+	}
+}
+
+func TestProbeName(t *testing.T) {
+	tests := []struct{ zones, want string }{
+		{"pod.example.=udp:10.0.0.1:53", "."},
+		{"pod.example.=udp:10.0.0.1:53?upstream_zone=systemd.internal", "systemd.internal."},
+		{"pod.example.=udp:10.0.0.1:53?rewrite=strip", "pod.example."},
+		{"pod.example.=udp:10.0.0.1:53?rewrite=none", "pod.example."},
+		{"*.pod.example.=udp:10.0.0.1:53?rewrite=none", "pod.example."},
+	}
+	for _, tt := range tests {
+		zones, err := ParseZoneEnv(tt.zones)
+		if err != nil {
+			t.Fatalf("ParseZoneEnv(%q): %v", tt.zones, err)
+		}
+		for _, cfg := range zones {
+			if got := probeName(&cfg); got != tt.want {
+				t.Errorf("%s: probe name = %q, want %q", tt.zones, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestProbeRcodes(t *testing.T) {
+	quietLog(t)
+
+	tests := []struct {
+		rcode int
+		up    bool
+	}{
+		{dns.RcodeSuccess, true},
+		{dns.RcodeNameError, true},
+		{dns.RcodeRefused, false},
+		{dns.RcodeServerFailure, false},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var asked []string
+		upstream := startUpstream(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+			mu.Lock()
+			asked = append(asked, r.Question[0].Name+" "+dns.TypeToString[r.Question[0].Qtype])
+			mu.Unlock()
+			m := new(dns.Msg)
+			m.SetRcode(r, tt.rcode)
+			_ = w.WriteMsg(m)
+		})
+		h := newTestHandler(t, "pod.example.=udp:"+upstream+"?upstream_zone=systemd.internal", nil, func(c *Config) {
+			c.UpstreamRetries = 0
+		})
+
+		err := h.ProbeUpstreams()
+		if (err == nil) != tt.up {
+			t.Errorf("%s: ProbeUpstreams = %v, want up %v", dns.RcodeToString[tt.rcode], err, tt.up)
+		}
+		h.mu.RLock()
+		up := h.zones["pod.example."].state.up(0)
+		h.mu.RUnlock()
+		if up != tt.up {
+			t.Errorf("%s: upstream up = %v, want %v", dns.RcodeToString[tt.rcode], up, tt.up)
+		}
+
+		mu.Lock()
+		if len(asked) != 1 || asked[0] != "systemd.internal. SOA" {
+			t.Errorf("%s: upstream asked %v, want the SOA of systemd.internal.", dns.RcodeToString[tt.rcode], asked)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,63 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ---------------------------------------------
+// Upstream concurrency limit (MAX_INFLIGHT, INFLIGHT_WAIT)
+// ---------------------------------------------
+
+// inflightLimit is a semaphore bounding concurrent forwardQuery calls, so a
+// flood can't open an unbounded number of upstream sockets. A nil
+// *inflightLimit is unlimited.
+type inflightLimit struct {
+	slots chan struct{}
+	wait  time.Duration // how long to wait for a free slot
+}
+
+func newInflightLimit(max uint32, wait time.Duration) *inflightLimit {
+	if max == 0 {
+		return nil
+	}
+	return &inflightLimit{slots: make(chan struct{}, max), wait: wait}
+}
+
+// errInflightFull is returned by acquire when no slot freed up in time.
+var errInflightFull = errors.New("too many upstream queries in flight")
+
+// acquire takes a slot, waiting up to l.wait or until ctx is done. Every
+// successful acquire must be paired with a release.
+func (l *inflightLimit) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			return fmt.Errorf("%w (%d)", errInflightFull, cap(l.slots))
+		case <-ctx.Done():
+			return fmt.Errorf("query abandoned: %w", ctx.Err())
+		}
+	}
+	upstreamInflight.Inc()
+	return nil
+}
+
+func (l *inflightLimit) release() {
+	if l == nil {
+		return
+	}
+	upstreamInflight.Dec()
+	<-l.slots
+}
@@ -0,0 +1,78 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInflightLimit(t *testing.T) {
+	l := newInflightLimit(2, 10*time.Millisecond)
+	ctx := context.Background()
+
+	for range 2 {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatalf("acquire below the limit: %v", err)
+		}
+	}
+	if err := l.acquire(ctx); !errors.Is(err, errInflightFull) {
+		t.Fatalf("acquire at the limit = %v, want errInflightFull", err)
+	}
+	l.release()
+	if err := l.acquire(ctx); err != nil {
+		t.Errorf("acquire after a release: %v", err)
+	}
+
+	if newInflightLimit(0, time.Second) != nil {
+		t.Error("MAX_INFLIGHT=0 made a limit")
+	}
+}
+
+func TestMaxInflightCapsUpstreamQueries(t *testing.T) {
+	var current, peak atomic.Int32
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.MaxInflight = 2
+		c.InflightWait = time.Second
+	})
+
+	var wg sync.WaitGroup
+	for i := range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(fmt.Sprintf("web%d.pod.example.", i), dns.TypeA)
+			w := newTestWriter("udp")
+			h.ServeDNS(w, req)
+			if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+				t.Errorf("reply to %s = %v, want NOERROR after waiting for a slot", req.Question[0].Name, w.msg)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p != 2 {
+		t.Errorf("%d upstream queries at once, want MAX_INFLIGHT 2", p)
+	}
+}
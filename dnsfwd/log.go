@@ -0,0 +1,71 @@
+package dnsfwd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Access log, one line per query at info
+// ---------------------------------------------
+
+// queryLog collects what ServeDNS learned about a query, for the access
+// log line written alongside the reply.
+type queryLog struct {
+	start     time.Time
+	client    string
+	qname     string
+	qtype     string
+	zone      string
+	rewritten string
+	upstream  string
+}
+
+func newQueryLog(w dns.ResponseWriter) *queryLog {
+	return &queryLog{start: time.Now(), client: clientHost(w.RemoteAddr())}
+}
+
+// clientHost returns addr without its port. UDP and TCP addresses format
+// just the IP, saving the host:port string that would be split again.
+func clientHost(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case nil:
+		return ""
+	case *net.UDPAddr:
+		if addr.Zone == "" {
+			return addr.IP.String()
+		}
+	case *net.TCPAddr:
+		if addr.Zone == "" {
+			return addr.IP.String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (ql *queryLog) emit(m *dns.Msg) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		return
+	}
+
+	slog.LogAttrs(context.Background(), slog.LevelInfo, "query",
+		slog.String("client", ql.client),
+		slog.String("qname", ql.qname),
+		slog.String("qtype", ql.qtype),
+		slog.String("zone", ql.zone),
+		slog.String("rewritten", ql.rewritten),
+		slog.String("upstream", ql.upstream),
+		slog.String("rcode", dns.RcodeToString[m.Rcode]),
+		slog.Int("answers", len(m.Answer)),
+		slog.Duration("latency", time.Since(ql.start)),
+	)
+}
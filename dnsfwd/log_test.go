@@ -0,0 +1,85 @@
+package dnsfwd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// captureLog sends the default logger's output at level, as JSON, to the
+// returned buffer until t ends.
+func captureLog(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd)
+	buf := captureLog(t, slog.LevelInfo)
+
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log %q: %v", buf, err)
+	}
+	want := map[string]any{
+		"msg":       "query",
+		"client":    "192.0.2.10",
+		"qname":     "web.pod.example.",
+		"qtype":     "A",
+		"zone":      "pod.example.",
+		"rewritten": "systemd-web.",
+		"upstream":  "10.0.0.1:53",
+		"rcode":     "NOERROR",
+		"answers":   float64(1),
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+	if _, ok := line["latency"].(float64); !ok {
+		t.Errorf("latency = %v, want a duration", line["latency"])
+	}
+}
+
+func TestAccessLogLevel(t *testing.T) {
+	quiet := captureLog(t, slog.LevelWarn)
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", &stubForwarder{})
+
+	exchange(t, h, "web.pod.example.", dns.TypeA)
+	if quiet.Len() != 0 {
+		t.Errorf("LOG_LEVEL=warn still logs queries: %s", quiet)
+	}
+}
+
+func TestClientHost(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}, "192.0.2.10"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, "2001:db8::1"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 40000, Zone: "eth0"}, "fe80::1%eth0"},
+		{&net.UnixAddr{Name: "/run/dns.sock", Net: "unix"}, "/run/dns.sock"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := clientHost(tt.addr); got != tt.want {
+			t.Errorf("clientHost(%v) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
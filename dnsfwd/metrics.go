@@ -0,0 +1,141 @@
+package dnsfwd
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ---------------------------------------------
+// Prometheus metrics
+// ---------------------------------------------
+
+const metricsNamespace = "dns_fwd"
+
+var (
+	queriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_total",
+		Help:      "Total DNS queries received.",
+	})
+
+	responsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "responses_total",
+		Help:      "DNS responses sent, by rcode.",
+	}, []string{"rcode"})
+
+	zoneQueriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "zone_queries_total",
+		Help:      "Queries matching a configured zone, by zone.",
+	}, []string{"zone"})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Failed upstream exchanges, by upstream.",
+	}, []string{"upstream"})
+
+	malformedResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_malformed_responses_total",
+		Help:      "Upstream responses rejected for a mismatched ID or question, by upstream.",
+	}, []string{"upstream"})
+
+	breakerTripsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_breaker_trips_total",
+		Help:      "Times an upstream's circuit breaker opened, by upstream.",
+	}, []string{"upstream"})
+
+	rewriteMismatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rewrite_mismatches_total",
+		Help:      "Upstream response records whose name doesn't map back into the zone, by zone.",
+	}, []string{"zone"})
+
+	upstreamInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_inflight",
+		Help:      "Queries currently being forwarded upstream.",
+	})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Time spent forwarding a query upstream, including failover.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"zone"})
+
+	rateLimitedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Queries refused or dropped by the per-client rate limit.",
+	})
+
+	writeErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_errors_total",
+		Help:      "Responses that could not be written back to the client.",
+	})
+
+	blockedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocked_total",
+		Help:      "Queries answered from the blocklist.",
+	})
+
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_hits_total",
+		Help:      "Queries answered from the response cache.",
+	})
+
+	cacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_misses_total",
+		Help:      "Queries that had to be forwarded upstream.",
+	})
+
+	sharedQueriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_shared_total",
+		Help:      "Cache misses answered by an identical upstream query already in flight.",
+	})
+
+	prefetchesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_prefetches_total",
+		Help:      "Cache entries refreshed ahead of expiry by PREFETCH_THRESHOLD.",
+	})
+)
+
+var registerOnce sync.Once
+
+// RegisterMetrics registers the package's collectors with the default
+// Prometheus registry. Calls after the first do nothing.
+func RegisterMetrics() {
+	registerOnce.Do(registerMetrics)
+}
+
+func registerMetrics() {
+	prometheus.MustRegister(
+		queriesTotal,
+		responsesTotal,
+		zoneQueriesTotal,
+		upstreamErrorsTotal,
+		malformedResponsesTotal,
+		breakerTripsTotal,
+		rewriteMismatchesTotal,
+		upstreamInflight,
+		upstreamDuration,
+		rateLimitedTotal,
+		blockedTotal,
+		writeErrorsTotal,
+		cacheHitsTotal,
+		cacheMissesTotal,
+		prefetchesTotal,
+		sharedQueriesTotal,
+	)
+}
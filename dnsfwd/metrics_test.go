@@ -0,0 +1,75 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryMetrics(t *testing.T) {
+	quietLog(t)
+	fwd := &stubForwarder{records: map[string][]dns.RR{
+		"systemd-web. A": {mustRR("systemd-web. 30 IN A 10.0.0.5")},
+	}}
+	// A zone of its own, so its upstream_duration_seconds series is new
+	h := newTestHandler(t, "metrics.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.CacheSize = 16
+	})
+
+	queries := testutil.ToFloat64(queriesTotal)
+	noerror := testutil.ToFloat64(responsesTotal.WithLabelValues("NOERROR"))
+	nxdomain := testutil.ToFloat64(responsesTotal.WithLabelValues("NXDOMAIN"))
+	zone := testutil.ToFloat64(zoneQueriesTotal.WithLabelValues("metrics.example."))
+	hits, misses := testutil.ToFloat64(cacheHitsTotal), testutil.ToFloat64(cacheMissesTotal)
+	forwarded := testutil.CollectAndCount(upstreamDuration)
+
+	exchange(t, h, "web.metrics.example.", dns.TypeA)
+	exchange(t, h, "web.metrics.example.", dns.TypeA)
+	exchange(t, h, "web.elsewhere.example.", dns.TypeA)
+
+	tests := []struct {
+		name      string
+		got, want float64
+	}{
+		{"queries_total", testutil.ToFloat64(queriesTotal) - queries, 3},
+		{"responses_total{rcode=NOERROR}", testutil.ToFloat64(responsesTotal.WithLabelValues("NOERROR")) - noerror, 2},
+		{"responses_total{rcode=NXDOMAIN}", testutil.ToFloat64(responsesTotal.WithLabelValues("NXDOMAIN")) - nxdomain, 1},
+		{"zone_queries_total{zone=metrics.example.}", testutil.ToFloat64(zoneQueriesTotal.WithLabelValues("metrics.example.")) - zone, 2},
+		{"cache_hits_total", testutil.ToFloat64(cacheHitsTotal) - hits, 1},
+		{"cache_misses_total", testutil.ToFloat64(cacheMissesTotal) - misses, 1},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s went up by %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if n := testutil.CollectAndCount(upstreamDuration) - forwarded; n != 1 {
+		t.Errorf("upstream_duration_seconds gained %d series, want 1 for the forwarded query", n)
+	}
+}
+
+func TestUpstreamErrorMetrics(t *testing.T) {
+	quietLog(t)
+	fwd := forwardFunc(func(context.Context, *dns.Msg, *ZoneConfig, string, string) (*dns.Msg, error) {
+		return nil, errors.New("i/o timeout")
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.UpstreamRetries = 0
+	})
+	counter := upstreamErrorsTotal.WithLabelValues("udp://10.0.0.1:53")
+	servfail := responsesTotal.WithLabelValues("SERVFAIL")
+	before, beforeServfail := testutil.ToFloat64(counter), testutil.ToFloat64(servfail)
+
+	if resp := exchange(t, h, "web.pod.example.", dns.TypeA); resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+	if n := testutil.ToFloat64(counter) - before; n != 1 {
+		t.Errorf("upstream_errors_total went up by %v, want 1", n)
+	}
+	if n := testutil.ToFloat64(servfail) - beforeServfail; n != 1 {
+		t.Errorf("responses_total{rcode=SERVFAIL} went up by %v, want 1", n)
+	}
+}
@@ -0,0 +1,92 @@
+package dnsfwd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Static override records (OVERRIDES)
+// Format:
+//   OVERRIDES="api.pod.hetmer.net. A 10.0.0.5,api.pod.hetmer.net. AAAA fd00::5"
+//
+// Repeating a name and type returns several records. Matching queries are
+// answered locally with ANSWER_TTL and never reach an upstream.
+// ---------------------------------------------
+
+type overrideKey struct {
+	name  string // lowercased, with trailing dot
+	qtype uint16
+}
+
+func parseOverrides(entries []string) (map[overrideKey][]net.IP, error) {
+	overrides := make(map[overrideKey][]net.IP)
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		if err := addOverride(overrides, entry); err != nil {
+			return nil, err
+		}
+	}
+	return overrides, nil
+}
+
+// addOverride parses one "name type value" entry into overrides.
+func addOverride(overrides map[overrideKey][]net.IP, entry string) error {
+	fields := strings.Fields(entry)
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid override %q (want \"name type value\")", entry)
+	}
+
+	name := strings.ToLower(dns.Fqdn(fields[0]))
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid name in override %q", entry)
+	}
+
+	ip := net.ParseIP(fields[2])
+	var qtype uint16
+	switch strings.ToUpper(fields[1]) {
+	case "A":
+		qtype = dns.TypeA
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address in override %q", entry)
+		}
+		ip = ip.To4()
+	case "AAAA":
+		qtype = dns.TypeAAAA
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address in override %q", entry)
+		}
+	default:
+		return fmt.Errorf("unsupported type in override %q (want A or AAAA)", entry)
+	}
+
+	key := overrideKey{name: name, qtype: qtype}
+	overrides[key] = append(overrides[key], ip)
+	return nil
+}
+
+// overrideAnswer returns the records overriding q, owned by q's name as
+// the client spelled it, or nil when there is no override.
+func (h *DNSHandler) overrideAnswer(q dns.Question) []dns.RR {
+	g := h.globals.Load()
+	ips := g.overrides[overrideKey{name: strings.ToLower(q.Name), qtype: q.Qtype}]
+	if len(ips) == 0 {
+		return nil
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: g.answerTTL}
+	answer := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		if q.Qtype == dns.TypeA {
+			answer = append(answer, &dns.A{Hdr: hdr, A: ip})
+		} else {
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return answer
+}
@@ -0,0 +1,64 @@
+package dnsfwd
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := parseOverrides([]string{
+		"API.Pod.Example A 10.0.0.5",
+		"api.pod.example. A 10.0.0.6",
+		"api.pod.example. aaaa fd00::5",
+		" ",
+	})
+	if err != nil {
+		t.Fatalf("parseOverrides: %v", err)
+	}
+	if n := len(overrides[overrideKey{"api.pod.example.", dns.TypeA}]); n != 2 {
+		t.Errorf("%d A overrides, want 2", n)
+	}
+	if n := len(overrides[overrideKey{"api.pod.example.", dns.TypeAAAA}]); n != 1 {
+		t.Errorf("%d AAAA overrides, want 1", n)
+	}
+
+	for _, entry := range []string{
+		"api.pod.example. A",
+		"api.pod.example. A 10.0.0.5 extra",
+		"api.pod.example. A fd00::5",
+		"api.pod.example. AAAA 10.0.0.5",
+		"api.pod.example. A not-an-ip",
+		"api.pod.example. CNAME web.pod.example.",
+		"api..pod.example. A 10.0.0.5",
+	} {
+		if _, err := parseOverrides([]string{entry}); err == nil {
+			t.Errorf("parseOverrides(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
+func TestServeDNSOverride(t *testing.T) {
+	fwd := &stubForwarder{}
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.Overrides = []string{"api.pod.example. A 10.0.0.5", "api.pod.example. A 10.0.0.6"}
+	})
+
+	resp := exchange(t, h, "API.pod.example.", dns.TypeA)
+	want := []string{
+		"API.pod.example.\t300\tIN\tA\t10.0.0.5",
+		"API.pod.example.\t300\tIN\tA\t10.0.0.6",
+	}
+	if got := rrStrings(resp.Answer); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("answer = %v, want %v", got, want)
+	}
+	if got := fwd.names(); len(got) != 0 {
+		t.Errorf("upstream queries = %v, want none", got)
+	}
+
+	// Only the overridden type is answered locally
+	exchange(t, h, "api.pod.example.", dns.TypeAAAA)
+	if got := fwd.names(); len(got) != 1 {
+		t.Errorf("upstream queries = %v, want the AAAA one", got)
+	}
+}
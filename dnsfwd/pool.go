@@ -0,0 +1,150 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Upstream TCP/TLS connection pool
+// ---------------------------------------------
+
+type pooledConn struct {
+	conn     *dns.Conn
+	lastUsed time.Time
+}
+
+// connPool keeps idle TCP/TLS connections per upstream so sequential queries
+// skip the handshake. A nil *connPool is valid and pools nothing.
+type connPool struct {
+	mu          sync.Mutex
+	idle        map[string][]pooledConn // by net://upstream, most recently used last
+	maxIdle     int
+	idleTimeout time.Duration
+}
+
+func newConnPool(maxIdle int, idleTimeout time.Duration) *connPool {
+	if maxIdle <= 0 {
+		return nil
+	}
+	return &connPool{
+		idle:        make(map[string][]pooledConn),
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// get returns an idle connection for key, or nil if none is fresh.
+func (p *connPool) get(key string) *dns.Conn {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	last := conns[len(conns)-1]
+	if p.idleTimeout > 0 && time.Since(last.lastUsed) > p.idleTimeout {
+		// The freshest one is stale, so all of them are
+		for _, pc := range conns {
+			_ = pc.conn.Close()
+		}
+		delete(p.idle, key)
+		return nil
+	}
+
+	p.idle[key] = conns[:len(conns)-1]
+	return last.conn
+}
+
+// put returns a healthy connection to the pool, closing the oldest idle
+// one if key is already at maxIdle.
+func (p *connPool) put(key string, conn *dns.Conn) {
+	if p == nil {
+		_ = conn.Close()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := append(p.idle[key], pooledConn{conn: conn, lastUsed: time.Now()})
+	if len(conns) > p.maxIdle {
+		_ = conns[0].conn.Close()
+		conns = conns[1:]
+	}
+	p.idle[key] = conns
+}
+
+// exchange sends m to upstream, reusing pooled connections for TCP and
+// TLS. It returns early once ctx is done.
+func (h *DNSHandler) exchange(ctx context.Context, c *dns.Client, m *dns.Msg, upstream string) (*dns.Msg, error) {
+	pooled := (c.Net == "tcp" || c.Net == "tcp-tls") && h.pool != nil
+
+	key := c.Net + "://" + upstream
+	if c.TLSConfig != nil {
+		key += "#" + c.TLSConfig.ServerName
+	}
+
+	if pooled {
+		if conn := h.pool.get(key); conn != nil {
+			resp, err := exchangeConn(ctx, c, m, conn)
+			if err == nil {
+				h.pool.put(key, conn)
+				return resp, nil
+			}
+			_ = conn.Close()
+
+			// A timeout is the upstream's fault, anything else is most likely
+			// the idle connection having been closed under us: redial once
+			var netErr net.Error
+			if ctx.Err() != nil || errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, err
+			}
+		}
+	}
+
+	conn, err := c.DialContext(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeConn(ctx, c, m, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if pooled {
+		h.pool.put(key, conn)
+	} else {
+		_ = conn.Close()
+	}
+	return resp, nil
+}
+
+// exchangeConn runs one exchange on conn. The dns package only honours
+// context deadlines, so cancellation expires conn's deadline to unblock
+// the pending read.
+func exchangeConn(ctx context.Context, c *dns.Client, m *dns.Msg, conn *dns.Conn) (*dns.Msg, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	resp, _, err := c.ExchangeWithConnContext(ctx, m, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
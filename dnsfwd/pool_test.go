@@ -0,0 +1,61 @@
+package dnsfwd
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Sequential TCP queries to a loopback upstream, each a fresh connection
+// without the pool and a reused one with it: about 120µs -> 35µs and
+// 115 -> 79 allocs per query at the time of writing.
+func BenchmarkForwardTCP(b *testing.B) {
+	addr := startUpstream(b, "tcp", answerA)
+
+	for _, bench := range []struct {
+		name    string
+		maxIdle int
+	}{
+		{"NoPool", 0},
+		{"Pool", 4},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			h := newTestHandler(b, "pod.example.=tcp:"+addr, nil, func(c *Config) {
+				c.PoolMaxIdle = bench.maxIdle
+			})
+			quietLog(b)
+			req := new(dns.Msg)
+			req.SetQuestion("web.pod.example.", dns.TypeA)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				w := newTestWriter("udp")
+				h.ServeDNS(w, req)
+				if w.msg == nil || len(w.msg.Answer) != 1 {
+					b.Fatalf("reply = %v, want one answer", w.msg)
+				}
+			}
+		})
+	}
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	addr := startUpstream(t, "tcp", answerA)
+	h := newTestHandler(t, "pod.example.=tcp:"+addr, nil)
+
+	for range 3 {
+		if resp := exchange(t, h, "web.pod.example.", dns.TypeA); len(resp.Answer) != 1 {
+			t.Fatalf("reply = %v, want one answer", resp)
+		}
+	}
+	conns := 0
+	h.pool.mu.Lock()
+	for _, idle := range h.pool.idle {
+		conns += len(idle)
+	}
+	h.pool.mu.Unlock()
+	if conns != 1 {
+		t.Errorf("%d idle connections after 3 sequential queries, want the one reused", conns)
+	}
+}
@@ -0,0 +1,59 @@
+package dnsfwd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// Fallback prefixes
+//
+// A zone covering two naming schemes lists its prefixes separated by "|",
+// and a name the first doesn't find is looked up with the next:
+//   ZONES=pod.hetmer.net.=systemd-|k8s-:udp:10.0.0.1:53
+// ---------------------------------------------
+
+// prefixSeparator separates a zone's prefixes in ZONES.
+const prefixSeparator = "|"
+
+// splitPrefixes splits a ZONES prefix field into the zone's Prefix and
+// its fallback Prefixes.
+func splitPrefixes(field string) (string, []string) {
+	prefix, rest, ok := strings.Cut(field, prefixSeparator)
+	if !ok {
+		return prefix, nil
+	}
+	return prefix, strings.Split(rest, prefixSeparator)
+}
+
+// prefixCandidates returns cfg followed by a copy of it for each of its
+// fallback prefixes, in the order they're tried.
+func (cfg *ZoneConfig) prefixCandidates() []*ZoneConfig {
+	candidates := []*ZoneConfig{cfg}
+	for _, prefix := range cfg.Prefixes {
+		candidate := *cfg
+		candidate.Prefix = prefix
+		candidate.Prefixes = nil
+		candidates = append(candidates, &candidate)
+	}
+	return candidates
+}
+
+// isNegative reports whether m is NXDOMAIN or NODATA, so the next prefix
+// may still find the name.
+func isNegative(m *dns.Msg) bool {
+	return m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+}
+
+// validatePrefix checks one of cfg's prefixes against its prefix_mode.
+func validatePrefix(cfg *ZoneConfig, prefix string) error {
+	if strings.Count(prefix, "%s") > 1 {
+		return fmt.Errorf("prefix %q has more than one %%s placeholder", prefix)
+	}
+	if cfg.PrefixMode == prefixModeEach && strings.Contains(prefix, ".") {
+		return fmt.Errorf("prefix_mode each needs a single-label prefix, not %q", prefix)
+	}
+	return nil
+}
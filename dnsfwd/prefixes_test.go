@@ -0,0 +1,108 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrefixFallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		first func(resp *dns.Msg) error // what the systemd- lookup gets
+	}{
+		{"NXDOMAIN", func(resp *dns.Msg) error { resp.Rcode = dns.RcodeNameError; return nil }},
+		{"NODATA", func(*dns.Msg) error { return nil }},
+		{"SERVFAIL", func(resp *dns.Msg) error { resp.Rcode = dns.RcodeServerFailure; return nil }},
+		{"transport error", func(*dns.Msg) error { return errors.New("connection refused") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+				name := m.Question[0].Name
+				names = append(names, name)
+				resp := new(dns.Msg)
+				resp.SetReply(m)
+				if name == "k8s-web." {
+					resp.Answer = append(resp.Answer, mustRR("k8s-web. 30 IN A 10.0.0.6"))
+					return resp, nil
+				}
+				if err := tt.first(resp); err != nil {
+					return nil, err
+				}
+				return resp, nil
+			})
+			h := newTestHandler(t, "pod.example.=systemd-|k8s-:udp:10.0.0.1:53", fwd)
+
+			resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+			if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+				t.Fatalf("reply = %v, want the k8s-web. answer", resp)
+			}
+			if name := resp.Answer[0].Header().Name; name != "web.pod.example." {
+				t.Errorf("answer owner = %s, want web.pod.example.", name)
+			}
+			if len(names) == 0 || names[0] != "systemd-web." || names[len(names)-1] != "k8s-web." {
+				t.Errorf("upstream queries = %v, want systemd-web. first and k8s-web. last", names)
+			}
+		})
+	}
+}
+
+func TestPrefixFallbackAllNegative(t *testing.T) {
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		switch m.Question[0].Name {
+		case "a-web.":
+			resp.Rcode = dns.RcodeServerFailure
+		case "b-web.":
+			resp.Rcode = dns.RcodeNameError
+		case "c-web.":
+			// NODATA: the name exists, without records of this type
+		}
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=a-|b-|c-:udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("reply = %v, want NODATA, over NXDOMAIN and SERVFAIL", resp)
+	}
+	if owner := soaOwner(resp); owner != "pod.example." {
+		t.Errorf("SOA owner = %q, want pod.example.", owner)
+	}
+}
+
+func TestPrefixFallbackAllFail(t *testing.T) {
+	fwd := forwardFunc(func(context.Context, *dns.Msg, *ZoneConfig, string, string) (*dns.Msg, error) {
+		return nil, errors.New("connection refused")
+	})
+	h := newTestHandler(t, "pod.example.=a-|b-:udp:10.0.0.1:53", fwd)
+
+	resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestSplitPrefixes(t *testing.T) {
+	tests := []struct {
+		field        string
+		wantPrefix   string
+		wantPrefixes []string
+	}{
+		{"systemd-", "systemd-", nil},
+		{"systemd-|k8s-", "systemd-", []string{"k8s-"}},
+		{"a-|b-|%s.internal", "a-", []string{"b-", "%s.internal"}},
+	}
+	for _, tt := range tests {
+		prefix, prefixes := splitPrefixes(tt.field)
+		if prefix != tt.wantPrefix || !reflect.DeepEqual(prefixes, tt.wantPrefixes) {
+			t.Errorf("splitPrefixes(%q) = %q, %q, want %q, %q", tt.field, prefix, prefixes, tt.wantPrefix, tt.wantPrefixes)
+		}
+	}
+}
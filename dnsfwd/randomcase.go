@@ -0,0 +1,42 @@
+package dnsfwd
+
+import (
+	"math/rand/v2"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ---------------------------------------------
+// DNS 0x20 case randomization (CASE_RANDOMIZATION)
+// Upstreams echo the question byte for byte, so a randomly cased qname
+// adds entropy a spoofed answer has to guess.
+// ---------------------------------------------
+
+// randomCase flips the case of every letter in name at random.
+func randomCase(name string) string {
+	b := []byte(strings.ToLower(name))
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' && rand.IntN(2) == 0 {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// uncase puts name back wherever resp echoes the randomized spelling, so
+// callers see the name they asked for.
+func uncase(resp *dns.Msg, randomized, name string) {
+	for i := range resp.Question {
+		if resp.Question[i].Name == randomized {
+			resp.Question[i].Name = name
+		}
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Name == randomized {
+				hdr.Name = name
+			}
+		}
+	}
+}
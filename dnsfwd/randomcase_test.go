@@ -0,0 +1,70 @@
+package dnsfwd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCaseRandomization(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		mu.Lock()
+		sent = append(sent, m.Question[0].Name)
+		mu.Unlock()
+
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 30 IN A 10.0.0.5"))
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.CaseRandomization = true
+	})
+
+	for range 20 {
+		resp := exchange(t, h, "a-long-service-name.pod.example.", dns.TypeA)
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "a-long-service-name.pod.example." {
+			t.Fatalf("answer = %v, want the client's spelling back", resp.Answer)
+		}
+	}
+
+	// 20 queries of 23 letters each: the same spelling twice is
+	// vanishingly unlikely unless nothing is randomized
+	spellings := make(map[string]bool)
+	for _, name := range sent {
+		if !strings.EqualFold(name, "systemd-a-long-service-name.") {
+			t.Fatalf("upstream query for %s, want systemd-a-long-service-name. in any case", name)
+		}
+		spellings[name] = true
+	}
+	if len(spellings) < 2 {
+		t.Errorf("upstream got %v, want randomized casing", sent)
+	}
+}
+
+func TestCaseRandomizationRejectsRecased(t *testing.T) {
+	// An upstream, or a spoofer, that doesn't echo the casing
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Question[0].Name = strings.ToLower(resp.Question[0].Name)
+		resp.Answer = append(resp.Answer, mustRR(resp.Question[0].Name+" 30 IN A 10.0.0.5"))
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.CaseRandomization = true
+		c.UpstreamRetries = 0
+	})
+
+	// The lowercase spelling can come back right by chance; a name this
+	// long makes that one in 2^23
+	resp := exchange(t, h, "a-long-service-name.pod.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
@@ -0,0 +1,101 @@
+package dnsfwd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------
+// Per-client rate limiting (RATE_LIMIT, RATE_BURST)
+// ---------------------------------------------
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP. A nil *rateLimiter allows
+// everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64 // bucket capacity
+	buckets map[string]*bucket
+	drop    bool // drop throttled queries instead of answering REFUSED
+}
+
+func newRateLimiter(rate, burst uint32, drop bool) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = rate
+	}
+	return &rateLimiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		drop:    drop,
+	}
+}
+
+// allow takes a token from ip's bucket, reporting false if it is empty.
+func (l *rateLimiter) allow(ip net.IP, now time.Time) bool {
+	if l == nil || ip == nil {
+		return true
+	}
+
+	key := ip.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup forgets buckets that have refilled completely; a new bucket
+// starts full, so dropping them changes nothing but memory use.
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) cleanupLoop(ctx context.Context, interval time.Duration) {
+	if l == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.cleanup(now)
+		}
+	}
+}
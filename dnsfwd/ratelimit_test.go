@@ -0,0 +1,105 @@
+package dnsfwd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(2, 3, false)
+	now := time.Now()
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+
+	// A full bucket lets a burst through, then throttles
+	for i := range 3 {
+		if !l.allow(a, now) {
+			t.Fatalf("query %d of the burst throttled", i+1)
+		}
+	}
+	if l.allow(a, now) {
+		t.Error("query past the burst allowed")
+	}
+	// Other clients have their own bucket
+	if !l.allow(b, now) {
+		t.Error("another client throttled")
+	}
+
+	// 2/s: one token back after half a second, no more
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow(a, now) {
+		t.Error("refilled token not allowed")
+	}
+	if l.allow(a, now) {
+		t.Error("more than the refill allowed")
+	}
+
+	// Refills stop at the burst
+	now = now.Add(time.Hour)
+	for i := range 3 {
+		if !l.allow(a, now) {
+			t.Fatalf("query %d after a long pause throttled", i+1)
+		}
+	}
+	if l.allow(a, now) {
+		t.Error("bucket refilled past the burst")
+	}
+
+	var off *rateLimiter
+	if !off.allow(a, now) {
+		t.Error("nil limiter throttled")
+	}
+}
+
+func TestRateLimiterCleanup(t *testing.T) {
+	l := newRateLimiter(10, 10, false)
+	now := time.Now()
+	l.allow(net.ParseIP("192.0.2.1"), now)
+	l.allow(net.ParseIP("192.0.2.2"), now.Add(900*time.Millisecond))
+
+	// 192.0.2.1 has refilled after a second, 192.0.2.2 not yet
+	l.cleanup(now.Add(time.Second))
+	if _, ok := l.buckets["192.0.2.1"]; ok {
+		t.Error("refilled bucket kept")
+	}
+	if _, ok := l.buckets["192.0.2.2"]; !ok {
+		t.Error("partly empty bucket dropped")
+	}
+}
+
+func TestRateLimitAction(t *testing.T) {
+	for _, tt := range []struct {
+		action    string
+		wantReply bool
+	}{
+		{"refuse", true},
+		{"drop", false},
+	} {
+		fwd := &stubForwarder{}
+		h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+			c.RateLimit = 1
+			c.RateBurst = 1
+			c.RateLimitAction = tt.action
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion("web.pod.example.", dns.TypeA)
+		if resp := serve(t, h, req); resp.Rcode == dns.RcodeRefused {
+			t.Fatalf("%s: first query refused", tt.action)
+		}
+
+		w := newTestWriter("udp")
+		h.ServeDNS(w, req)
+		switch {
+		case tt.wantReply && (w.msg == nil || w.msg.Rcode != dns.RcodeRefused):
+			t.Errorf("%s: throttled reply = %v, want REFUSED", tt.action, w.msg)
+		case !tt.wantReply && w.msg != nil:
+			t.Errorf("%s: throttled reply = %v, want none", tt.action, w.msg)
+		}
+		if n := len(fwd.names()); n != 1 {
+			t.Errorf("%s: %d upstream queries, want only the allowed one", tt.action, n)
+		}
+	}
+}
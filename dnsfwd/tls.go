@@ -0,0 +1,48 @@
+package dnsfwd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ---------------------------------------------
+// TLS (DNS-over-TLS upstreams)
+// ---------------------------------------------
+
+// LoadCertPool reads a PEM bundle of CA certificates, as used for
+// Config.UpstreamCAs. An empty path returns nil, which makes crypto/tls use
+// the system roots.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// upstreamTLSConfig verifies the upstream against the zone's
+// TLSServerName, or the upstream's own host (name or IP) if unset.
+func (h *DNSHandler) upstreamTLSConfig(cfg *ZoneConfig, upstream string) *tls.Config {
+	serverName := cfg.TLSServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(upstream)
+	}
+
+	return &tls.Config{
+		ServerName: serverName,
+		RootCAs:    h.upstreamCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+}
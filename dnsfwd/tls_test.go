@@ -0,0 +1,118 @@
+package dnsfwd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTLSUpstream starts a DNS-over-TLS server on localhost answering
+// with handler until t ends. Its certificate is for 127.0.0.1 and
+// dns.test, signed by itself; roots trusts it and pemFile holds it.
+func startTLSUpstream(t *testing.T, handler dns.HandlerFunc) (addr string, roots *x509.CertPool, pemFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns_fwd test upstream"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+
+	pemFile = filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: l, Net: "tcp-tls", Handler: handler}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return l.Addr().String(), roots, pemFile
+}
+
+func TestTLSUpstream(t *testing.T) {
+	quietLog(t)
+	addr, roots, pemFile := startTLSUpstream(t, answerA)
+	plain := startUpstream(t, "tcp", answerA)
+
+	pool, err := LoadCertPool(pemFile)
+	if err != nil {
+		t.Fatalf("LoadCertPool: %v", err)
+	}
+	if !pool.Equal(roots) {
+		t.Error("LoadCertPool doesn't hold the upstream's certificate")
+	}
+
+	tests := []struct {
+		name  string
+		zones string
+		cas   *x509.CertPool
+		rcode int
+	}{
+		{"verified by IP", "pod.example.=tls:" + addr, pool, dns.RcodeSuccess},
+		{"dot alias", "pod.example.=dot:" + addr, pool, dns.RcodeSuccess},
+		{"tls_server_name", "pod.example.=tls:" + addr + "?tls_server_name=dns.test", pool, dns.RcodeSuccess},
+		// TLS failures end in SERVFAIL
+		{"wrong server name", "pod.example.=tls:" + addr + "?tls_server_name=other.test", pool, dns.RcodeServerFailure},
+		{"untrusted certificate", "pod.example.=tls:" + addr, nil, dns.RcodeServerFailure},
+		{"no TLS upstream", "pod.example.=tls:" + plain, pool, dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, tt.zones, nil, func(c *Config) {
+			c.UpstreamCAs = tt.cas
+			c.UpstreamRetries = 0
+			c.UpstreamTimeout = 200 * time.Millisecond
+		})
+		resp := exchange(t, h, "web.pod.example.", dns.TypeA)
+		if resp.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if tt.rcode == dns.RcodeSuccess && len(resp.Answer) != 1 {
+			t.Errorf("%s: answer = %v, want the upstream's A record", tt.name, resp.Answer)
+		}
+	}
+
+	if _, err := LoadCertPool(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("LoadCertPool of a missing file succeeded")
+	}
+}
@@ -0,0 +1,93 @@
+package dnsfwd
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// ---------------------------------------------
+// Tracing (OpenTelemetry)
+//
+// Spans go to the global TracerProvider, a no-op until the binary
+// installs one for OTEL_EXPORTER_OTLP_ENDPOINT. DNS carries no trace
+// context, so every query is a trace of its own: a dns.query span per
+// ServeDNS with a dns.forward child per upstream lookup.
+// ---------------------------------------------
+
+var (
+	tracer = otel.Tracer("github.com/totoCZ/dns_fwd/dnsfwd")
+
+	// Built once, they'd otherwise cost an allocation per span
+	serverSpan = trace.WithSpanKind(trace.SpanKindServer)
+	clientSpan = trace.WithSpanKind(trace.SpanKindClient)
+)
+
+func startQuerySpan(ctx context.Context) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "dns.query", serverSpan)
+}
+
+// endQuerySpan tags span with what ql learned about the query and the
+// rcode of m, nil for a query left unanswered, and ends it.
+func endQuerySpan(span trace.Span, ql *queryLog, m *dns.Msg) {
+	if !span.IsRecording() {
+		span.End()
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("dns.qname", ql.qname),
+		attribute.String("dns.qtype", ql.qtype),
+		attribute.String("dns.zone", ql.zone),
+		attribute.String("dns.rewritten", ql.rewritten),
+		attribute.String("dns.upstream", ql.upstream),
+	)
+	if m == nil {
+		span.SetAttributes(attribute.Bool("dns.dropped", true))
+	} else {
+		span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[m.Rcode]))
+		if m.Rcode == dns.RcodeServerFailure {
+			span.SetStatus(codes.Error, "SERVFAIL")
+		}
+	}
+	span.End()
+}
+
+// startForwardSpan starts the span around forwardQuery sending m for cfg.
+// Under a query span that isn't recording, with tracing off or the trace
+// sampled out, it returns ctx and a no-op span without allocating.
+func startForwardSpan(ctx context.Context, m *dns.Msg, cfg *ZoneConfig) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx, noop.Span{}
+	}
+	return tracer.Start(ctx, "dns.forward", clientSpan, trace.WithAttributes(
+		attribute.String("dns.zone", cfg.Zone),
+		attribute.String("dns.qname", m.Question[0].Name),
+		attribute.String("dns.qtype", dns.TypeToString[m.Question[0].Qtype]),
+	))
+}
+
+// endForwardSpan records which upstream answered resp, or err, and ends
+// span.
+func endForwardSpan(span trace.Span, upstream string, resp *dns.Msg, err error) {
+	if !span.IsRecording() {
+		span.End()
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(
+			attribute.String("dns.upstream", upstream),
+			attribute.String("dns.rcode", dns.RcodeToString[resp.Rcode]),
+		)
+	}
+	span.End()
+}
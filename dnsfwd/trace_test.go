@@ -0,0 +1,107 @@
+package dnsfwd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans sends the spans of the package tracer to an in-memory
+// exporter until t ends.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// spanAttrs returns span's attributes as strings by key.
+func spanAttrs(span tracetest.SpanStub) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range span.Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	quietLog(t)
+	exporter := recordSpans(t)
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, _ string) (*dns.Msg, error) {
+		if m.Question[0].Name == "systemd-down." {
+			return nil, errors.New("connection refused")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 30 IN A 10.0.0.5"))
+		return resp, nil
+	})
+	h := newTestHandler(t, "pod.example.=udp:10.0.0.1:53", fwd, func(c *Config) {
+		c.UpstreamRetries = 0
+	})
+
+	tests := []struct {
+		qname      string
+		wantRcode  string
+		wantStatus codes.Code
+	}{
+		{"web.pod.example.", "NOERROR", codes.Unset},
+		{"down.pod.example.", "SERVFAIL", codes.Error},
+	}
+	for _, tt := range tests {
+		exporter.Reset()
+		exchange(t, h, tt.qname, dns.TypeA)
+
+		spans := exporter.GetSpans()
+		if len(spans) != 2 {
+			t.Fatalf("%s: %d spans, want dns.forward and dns.query", tt.qname, len(spans))
+		}
+		// Children end first
+		forward, query := spans[0], spans[1]
+		if forward.Name != "dns.forward" || query.Name != "dns.query" {
+			t.Fatalf("%s: spans %s, %s, want dns.forward, dns.query", tt.qname, forward.Name, query.Name)
+		}
+		if forward.Parent.SpanID() != query.SpanContext.SpanID() {
+			t.Errorf("%s: dns.forward is not a child of dns.query", tt.qname)
+		}
+
+		attrs := spanAttrs(query)
+		want := map[string]string{
+			"dns.qname":     tt.qname,
+			"dns.qtype":     "A",
+			"dns.zone":      "pod.example.",
+			"dns.rewritten": "systemd-" + tt.qname[:len(tt.qname)-len("pod.example.")],
+			"dns.rcode":     tt.wantRcode,
+		}
+		for k, v := range want {
+			if attrs[k] != v {
+				t.Errorf("%s: dns.query %s = %q, want %q", tt.qname, k, attrs[k], v)
+			}
+		}
+		if query.Status.Code != tt.wantStatus {
+			t.Errorf("%s: dns.query status %s, want %s", tt.qname, query.Status.Code, tt.wantStatus)
+		}
+
+		attrs = spanAttrs(forward)
+		if tt.wantStatus == codes.Error {
+			if forward.Status.Code != codes.Error || len(forward.Events) == 0 {
+				t.Errorf("%s: dns.forward status %v, events %v, want the recorded error", tt.qname, forward.Status, forward.Events)
+			}
+			continue
+		}
+		if attrs["dns.upstream"] != "10.0.0.1:53" || attrs["dns.rcode"] != "NOERROR" || attrs["dns.qname"] != want["dns.rewritten"] {
+			t.Errorf("%s: dns.forward attributes %v, want upstream 10.0.0.1:53, rcode NOERROR, qname %s", tt.qname, attrs, want["dns.rewritten"])
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package dnsfwd
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// ---------------------------------------------
+// Split-horizon views (config file "views")
+// ---------------------------------------------
+
+// ZoneView sends the queries of clients in CIDRs to its own upstreams
+// instead of the zone's, over the zone's protocol. A zone's views are
+// matched in order; clients in none of them use the zone's upstreams.
+type ZoneView struct {
+	CIDRs     []*net.IPNet
+	Upstreams []string // host:port or [ipv6]:port, tried in order
+
+	state *zoneState // upstream health, like ZoneConfig's
+}
+
+// withViewState attaches runtime state to copies of cfg's views, so
+// configs sharing the Views slice keep their own. Each view takes over
+// the state of prev's view in its place for the upstreams they share.
+func withViewState(cfg ZoneConfig, prev []ZoneView) ZoneConfig {
+	cfg.Views = slices.Clone(cfg.Views)
+	for i := range cfg.Views {
+		var old ZoneView
+		if i < len(prev) {
+			old = prev[i]
+		}
+		cfg.Views[i].state = carryState(old.state, old.Upstreams, cfg.Views[i].Upstreams)
+	}
+	return cfg
+}
+
+// forClient returns cfg narrowed to the first view containing ip, or cfg
+// itself when no view does.
+func (cfg *ZoneConfig) forClient(ip net.IP) *ZoneConfig {
+	if ip == nil {
+		return cfg
+	}
+	for i, view := range cfg.Views {
+		for _, ipNet := range view.CIDRs {
+			if ipNet.Contains(ip) {
+				return cfg.narrowed(i)
+			}
+		}
+	}
+	return cfg
+}
+
+// narrowed returns a copy of cfg answering from view i's upstreams.
+func (cfg *ZoneConfig) narrowed(i int) *ZoneConfig {
+	narrowed := *cfg
+	narrowed.Upstreams = cfg.Views[i].Upstreams
+	narrowed.state = cfg.Views[i].state
+	narrowed.Views = nil
+	narrowed.view = i + 1
+	return &narrowed
+}
+
+// horizons returns cfg followed by each of its views narrowed from it,
+// every upstream set the zone may forward to.
+func (cfg *ZoneConfig) horizons() []*ZoneConfig {
+	all := []*ZoneConfig{cfg}
+	for i := range cfg.Views {
+		all = append(all, cfg.narrowed(i))
+	}
+	return all
+}
+
+// validateViews checks that each of cfg's views names clients and
+// upstreams to send them to.
+func validateViews(cfg *ZoneConfig) error {
+	for i, view := range cfg.Views {
+		if len(view.CIDRs) == 0 {
+			return fmt.Errorf("view #%d has no cidrs", i+1)
+		}
+		if len(view.Upstreams) == 0 {
+			return fmt.Errorf("view #%d has no upstreams", i+1)
+		}
+		for _, upstream := range view.Upstreams {
+			if err := validateUpstream(upstream); err != nil {
+				return fmt.Errorf("view #%d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// viewCIDRs lists view's networks, comma-separated.
+func viewCIDRs(view ZoneView) string {
+	cidrs := make([]string, 0, len(view.CIDRs))
+	for _, ipNet := range view.CIDRs {
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return strings.Join(cidrs, ",")
+}
@@ -0,0 +1,59 @@
+package dnsfwd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestViews(t *testing.T) {
+	zones, _, err := LoadConfigFile(writeConfigFile(t, `{"zones": [
+		{"zone": "pod.example.", "upstreams": ["10.0.0.1"],
+		 "views": [{"cidrs": ["10.0.0.0/8", "fd00::/8"], "upstreams": ["10.0.0.3"]}]}
+	]}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+	// Each upstream gives its own address for every name
+	fwd := forwardFunc(func(_ context.Context, m *dns.Msg, _ *ZoneConfig, _, upstream string) (*dns.Msg, error) {
+		host, _, _ := net.SplitHostPort(upstream)
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, mustRR(m.Question[0].Name+" 30 IN A "+host))
+		return resp, nil
+	})
+	cfg := DefaultConfig()
+	cfg.Zones = zones
+	cfg.Forwarder = fwd
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	// The cache stays on: one view's answer must not reach the other
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{"10.1.2.3", "10.0.0.3"},
+		{"192.0.2.10", "10.0.0.1"},
+		{"fd00::5", "10.0.0.3"},
+		{"2001:db8::5", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("web.pod.example.", dns.TypeA)
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 40000}}
+		h.ServeDNS(w, req)
+
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Errorf("client %s: reply = %v, want one A", tt.client, w.msg)
+			continue
+		}
+		if got := w.msg.Answer[0].(*dns.A).A.String(); got != tt.want {
+			t.Errorf("client %s: answer %s, want %s's", tt.client, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// ---------------------------------------------
+// Logging
+// LOG_FORMAT=json|text, LOG_LEVEL=debug|info|warn|error
+// LOG_FILE=path writes to a rotated file instead of stdout, see rotate.go
+//
+// Per-query access logs are emitted at info, so LOG_LEVEL=warn silences
+// them while keeping errors.
+// ---------------------------------------------
+
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnvWithDefault("LOG_LEVEL", "info"))); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var out io.Writer = os.Stdout
+	if path := getEnvWithDefault("LOG_FILE", ""); path != "" {
+		maxSize := int64(getEnvUint32WithDefault("LOG_MAX_SIZE_MB", 100)) << 20
+		f, err := openRotatingFile(path, maxSize, int(getEnvUint32WithDefault("LOG_MAX_BACKUPS", 3)))
+		if err != nil {
+			return fmt.Errorf("invalid LOG_FILE: %w", err)
+		}
+		out = f
+	}
+
+	var handler slog.Handler
+	switch format := getEnvWithDefault("LOG_FORMAT", "text"); strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT: %s", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
@@ -1,334 +1,563 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/totoCZ/dns_fwd/dnsfwd"
 )
 
 // ---------------------------------------------
-// Configuration structures
+// Env utilities
 // ---------------------------------------------
 
-type ZoneConfig struct {
-	Zone     string // normalized with trailing dot
-	Prefix   string // optional override, fallback to handler.defaultPrefix
-	Protocol string // udp/tcp
-	Upstream string // host:port or [ipv6]:port
-}
+// Every setting can also come from a file named by KEY_FILE, e.g. a
+// Docker or Kubernetes secret mount; the file wins over KEY itself.
+// Unreadable files are collected in envFileErr, which run reports.
+var (
+	envFileMu  sync.Mutex
+	envFileErr error
+)
 
-type DNSHandler struct {
-	zones         map[string]ZoneConfig
-	defaultPrefix string
-	negativeTTL   uint32
-	answerTTL     uint32
-	listenAddr    string
+// lookupEnv returns KEY_FILE's contents without the trailing newline if
+// set, else KEY's value.
+func lookupEnv(key string) (string, bool) {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return strings.TrimRight(string(data), "\r\n"), true
+		}
+
+		envFileMu.Lock()
+		envFileErr = errors.Join(envFileErr, fmt.Errorf("invalid %s_FILE: %w", key, err))
+		envFileMu.Unlock()
+	}
+	return os.LookupEnv(key)
 }
 
-// ---------------------------------------------
-// Env utilities
-// ---------------------------------------------
+// takeEnvFileErr returns and clears the errors collected by lookupEnv.
+func takeEnvFileErr() error {
+	envFileMu.Lock()
+	defer envFileMu.Unlock()
+
+	err := envFileErr
+	envFileErr = nil
+	return err
+}
 
 func getEnvWithDefault(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists && value != "" {
+	if value, exists := lookupEnv(key); exists && value != "" {
 		return value
 	}
 	return defaultValue
 }
 
-func getEnvUint32WithDefault(key string, defaultValue uint32) uint32 {
-	if value, exists := os.LookupEnv(key); exists && value != "" {
-		var result uint32
-		_, err := fmt.Sscanf(value, "%d", &result)
-		if err == nil {
+func getEnvDurationWithDefault(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := lookupEnv(key); exists && value != "" {
+		if result, err := time.ParseDuration(value); err == nil {
 			return result
 		}
 	}
 	return defaultValue
 }
 
-// ---------------------------------------------
-// Parse ZONES env variable
-// Format:
-//   ZONES=pod.hetmer.net.=udp:[ip]:53,net2.hetmer.net.=udp:10.42.0.1:53
-//
-// Optional prefixes:
-//   ZONES=pod.hetmer.net.=systemd-:udp:[ip]:53
-// ---------------------------------------------
-
-func parseZoneEnv(env string) (map[string]ZoneConfig, error) {
-	zones := make(map[string]ZoneConfig)
-
-	if env == "" {
-		return nil, fmt.Errorf("ZONES env var must not be empty")
+func getEnvBoolWithDefault(key string, defaultValue bool) bool {
+	if value, exists := lookupEnv(key); exists && value != "" {
+		if result, err := strconv.ParseBool(value); err == nil {
+			return result
+		}
 	}
+	return defaultValue
+}
 
-	entries := strings.Split(env, ",")
-	for _, entry := range entries {
-		parts := strings.Split(entry, "=")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid ZONES entry: %s", entry)
+func getEnvUint32WithDefault(key string, defaultValue uint32) uint32 {
+	if value, exists := lookupEnv(key); exists && value != "" {
+		var result uint32
+		_, err := fmt.Sscanf(value, "%d", &result)
+		if err == nil {
+			return result
 		}
+	}
+	return defaultValue
+}
 
-		zone := parts[0]
-		if !strings.HasSuffix(zone, ".") {
-			zone += "."
+func getEnvFloatWithDefault(key string, defaultValue float64) float64 {
+	if value, exists := lookupEnv(key); exists && value != "" {
+		if result, err := strconv.ParseFloat(value, 64); err == nil {
+			return result
 		}
+	}
+	return defaultValue
+}
 
-		value := parts[1]
+// getEnvListWithDefault splits a value on commas and newlines, the latter
+// for lists kept in a KEY_FILE; empty entries are left for the parser to
+// skip.
+func getEnvListWithDefault(key string, defaultValue []string) []string {
+	if value, exists := lookupEnv(key); exists && value != "" {
+		return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' })
+	}
+	return defaultValue
+}
 
-		prefix := ""
-		protoUp := value
+// getOutOfZoneSOA returns OUT_OF_ZONE_SOA, or "none" for a bare NXDOMAIN
+// with OUT_OF_ZONE_INCLUDE_SOA=false, whatever OUT_OF_ZONE_SOA says.
+func getOutOfZoneSOA(defaultValue string) string {
+	if !getEnvBoolWithDefault("OUT_OF_ZONE_INCLUDE_SOA", true) {
+		return "none"
+	}
+	return getEnvWithDefault("OUT_OF_ZONE_SOA", defaultValue)
+}
 
-		// detect optional prefix:prefix:proto:upstream syntax
-		if idx := strings.Index(value, ":"); idx != -1 {
-			field1 := value[:idx]
-			rest := value[idx+1:]
+// listenNets returns the networks to serve DNS on for LISTEN_PROTO: udp,
+// tcp or both.
+func listenNets(proto string) ([]string, error) {
+	switch proto {
+	case "udp", "tcp":
+		return []string{proto}, nil
+	case "both":
+		return []string{"udp", "tcp"}, nil
+	}
+	return nil, fmt.Errorf("invalid LISTEN_PROTO: %s", proto)
+}
 
-			// field1 could be a prefix OR a protocol
-			if field1 == "udp" || field1 == "tcp" {
-				// it's protocol
-				protoUp = value
-			} else {
-				// it's prefix
-				prefix = field1
-				protoUp = rest
-			}
+// newDNSServers returns a server for every address in the comma-separated
+// listenAddr on every network in nets.
+func newDNSServers(listenAddr string, nets []string) ([]*dns.Server, error) {
+	var servers []*dns.Server
+	for _, addr := range strings.Split(listenAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
 		}
-
-		// Now protoUp must start with proto:
-		sub := strings.SplitN(protoUp, ":", 2)
-		if len(sub) != 2 {
-			return nil, fmt.Errorf("invalid upstream syntax in: %s", entry)
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, err
 		}
-
-		proto := sub[0]
-		upstream := sub[1]
-
-		zones[zone] = ZoneConfig{
-			Zone:     zone,
-			Prefix:   prefix,
-			Protocol: proto,
-			Upstream: upstream,
+		for _, n := range nets {
+			servers = append(servers, &dns.Server{Addr: addr, Net: n})
 		}
 	}
-
-	return zones, nil
-}
-
-// ---------------------------------------------
-// SOA creation per zone
-// ---------------------------------------------
-
-func (h *DNSHandler) createLocalSOA(zone string) *dns.SOA {
-	return &dns.SOA{
-		Hdr: dns.RR_Header{
-			Name:   zone,
-			Rrtype: dns.TypeSOA,
-			Class:  dns.ClassINET,
-			Ttl:    h.negativeTTL,
-		},
-		Ns:      "dns-pod.hetmer.net.",
-		Mbox:    "pod.hetmer.net.",
-		Serial:  1,
-		Refresh: 3600,
-		Retry:   600,
-		Expire:  86400,
-		Minttl:  h.negativeTTL,
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no listen address")
 	}
+	return servers, nil
 }
 
-// ---------------------------------------------
-// Zone matching
-// ---------------------------------------------
+// loadZones reads zones from CONFIG_FILE when set, otherwise from ZONES,
+// leaving validation to the handler. The returned FileConfig is nil when
+// zones came from the env.
+func loadZones() (map[string]dnsfwd.ZoneConfig, *dnsfwd.FileConfig, error) {
+	var zones map[string]dnsfwd.ZoneConfig
+	var fc *dnsfwd.FileConfig
+	var err error
+
+	if path := getEnvWithDefault("CONFIG_FILE", ""); path != "" {
+		if getEnvWithDefault("ZONES", "") != "" {
+			slog.Warn("both CONFIG_FILE and ZONES are set, using CONFIG_FILE", "path", path)
+		}
+		zones, fc, err = dnsfwd.LoadConfigFile(path)
+	} else {
+		zones, err = dnsfwd.ParseZoneEnv(getEnvWithDefault("ZONES", ""))
+	}
+	// An unreadable ZONES_FILE explains the error better than what
+	// parsing the fallback came up with
+	if fileErr := takeEnvFileErr(); fileErr != nil {
+		return nil, nil, fileErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-func (h *DNSHandler) selectZoneForName(name string) (*ZoneConfig, bool, bool) {
-	name = strings.ToLower(name)
+	// DEFAULT_UPSTREAM is shorthand for a "." catch-all zone
+	if value := getEnvWithDefault("DEFAULT_UPSTREAM", ""); value != "" {
+		if _, ok := zones[dnsfwd.CatchAllZone]; ok {
+			slog.Warn("DEFAULT_UPSTREAM ignored, a catch-all zone is already configured")
+		} else {
+			catchAll, err := dnsfwd.ParseZoneEnv(dnsfwd.CatchAllZone + "=" + value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid DEFAULT_UPSTREAM: %w", err)
+			}
+			cfg := catchAll[dnsfwd.CatchAllZone]
+			if cfg.Prefix != "" {
+				return nil, nil, fmt.Errorf("invalid DEFAULT_UPSTREAM: the catch-all zone does not rewrite, drop prefix %q", cfg.Prefix)
+			}
+			zones[dnsfwd.CatchAllZone] = cfg
+		}
+	}
 
-	for _, cfg := range h.zones {
-		zone := strings.ToLower(cfg.Zone)
+	return zones, fc, nil
+}
 
-		// Apex: exact match
-		if name == zone {
-			return &cfg, true, true
+// reloadZones re-reads the zone config and swaps it into handler, with
+// CONFIG_FILE's settings applied on top of envCfg as at startup. On error
+// the previous config stays active.
+func reloadZones(handler *dnsfwd.DNSHandler, envCfg dnsfwd.Config) {
+	zones, fc, err := loadZones()
+	if err == nil {
+		cfg := envCfg
+		cfg.Zones = zones
+		if fc != nil {
+			fc.Apply(&cfg)
 		}
-		// Subdomain: ends with ".zone"
-		if strings.HasSuffix(name, "."+zone) {
-			return &cfg, true, false
+		var serial uint32
+		if serial, err = handler.Reload(cfg); err == nil {
+			slog.Info("reloaded config", "zones", len(zones), "serial", serial)
+			return
 		}
 	}
-
-	return nil, false, false
+	slog.Error("reload failed, keeping previous config", "error", err)
 }
 
 // ---------------------------------------------
-// Query rewriting
+// Main
 // ---------------------------------------------
 
-func (h *DNSHandler) rewriteQuery(name string, cfg *ZoneConfig) (string, error) {
-	name = strings.ToLower(name)
-	zone := strings.ToLower(cfg.Zone)
-
-	subdomain := strings.TrimSuffix(name, "."+zone)
-	if subdomain == "" {
-		return "", fmt.Errorf("empty subdomain after trimming zone")
-	}
+// errServerFailed is returned by run when a listener failed after
+// startup; the failure itself has already been logged.
+var errServerFailed = errors.New("server failed")
 
-	prefix := cfg.Prefix
-	if prefix == "" {
-		prefix = h.defaultPrefix
+// main exits 2 on configuration errors and 1 when a listener fails.
+func main() {
+	err := run(os.Args[1:])
+	switch {
+	case err == nil:
+	case errors.Is(err, errServerFailed):
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "dns_fwd: configuration error: %v\n", err)
+		os.Exit(2)
 	}
-
-	return prefix + subdomain + ".", nil
 }
 
-// ---------------------------------------------
-// Forward upstream
-// ---------------------------------------------
+// run configures and starts every server from the environment and args,
+// and serves until a signal or a listener failure.
+func run(args []string) error {
+	validateOnly := getEnvBoolWithDefault("VALIDATE_ONLY", false)
+	if len(args) > 0 {
+		switch args[0] {
+		case "--version", "-version":
+			fmt.Println(currentBuild())
+			return nil
+		case "--validate", "-validate":
+			validateOnly = true
+		}
+	}
 
-func forwardQuery(originalReq *dns.Msg, name, proto, upstream string) (*dns.Msg, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(name, originalReq.Question[0].Qtype)
-	m.Id = originalReq.Id
-	m.RecursionDesired = true
+	if err := setupLogging(); err != nil {
+		return err
+	}
 
-	c := &dns.Client{Net: proto}
+	build := currentBuild()
+	slog.Info("VERSION", "version", build.Version, "commit", build.Commit, "date", build.Date, "go", build.GoVersion)
 
-	resp, _, err := c.Exchange(m, upstream)
-	if err != nil || resp == nil {
-		return nil, fmt.Errorf("failed to query upstream %s://%s: %w", proto, upstream, err)
+	zones, fc, err := loadZones()
+	if err != nil {
+		return err
 	}
 
-	return resp, nil
-}
+	// Cancelled on shutdown so in-flight upstream queries give up at once
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-// ---------------------------------------------
-// Main DNS handler
-// ---------------------------------------------
+	upstreamCAs, err := dnsfwd.LoadCertPool(getEnvWithDefault("UPSTREAM_TLS_CA", ""))
+	if err != nil {
+		return fmt.Errorf("invalid UPSTREAM_TLS_CA: %w", err)
+	}
 
-func (h *DNSHandler) handleDNS(w dns.ResponseWriter, req *dns.Msg) {
-	if opt := req.IsEdns0(); opt != nil {
-		opt.SetDo(false)
+	cfg := dnsfwd.DefaultConfig()
+	cfg.Context = ctx
+	cfg.Zones = zones
+	cfg.DefaultPrefix = getEnvWithDefault("DEFAULT_PREFIX", cfg.DefaultPrefix)
+	cfg.AnswerTTL = getEnvUint32WithDefault("ANSWER_TTL", cfg.AnswerTTL)
+	cfg.NegativeTTL = getEnvUint32WithDefault("NEGATIVE_TTL", cfg.NegativeTTL)
+	cfg.TTLMode = getEnvWithDefault("TTL_MODE", cfg.TTLMode)
+	cfg.MinTTL = getEnvUint32WithDefault("MIN_TTL", cfg.MinTTL)
+	cfg.ForwardTypes = getEnvListWithDefault("FORWARD_TYPES", cfg.ForwardTypes)
+	cfg.Overrides = getEnvListWithDefault("OVERRIDES", cfg.Overrides)
+	cfg.Blocklist = getEnvListWithDefault("BLOCKLIST", cfg.Blocklist)
+	cfg.BlockMode = getEnvWithDefault("BLOCK_MODE", cfg.BlockMode)
+	cfg.SinkholeAddrs = getEnvListWithDefault("SINKHOLE_ADDRS", cfg.SinkholeAddrs)
+	cfg.OutOfZoneRcode = getEnvWithDefault("OUT_OF_ZONE_RCODE", cfg.OutOfZoneRcode)
+	cfg.OutOfZoneSOA = getOutOfZoneSOA(cfg.OutOfZoneSOA)
+	cfg.Padding = getEnvWithDefault("PADDING", cfg.Padding)
+	cfg.AAAAMode = getEnvWithDefault("AAAA_MODE", cfg.AAAAMode)
+	cfg.AnyMode = getEnvWithDefault("ANY_MODE", cfg.AnyMode)
+	cfg.ApexMode = getEnvWithDefault("APEX_MODE", cfg.ApexMode)
+	cfg.Authoritative = getEnvBoolWithDefault("AUTHORITATIVE", cfg.Authoritative)
+	cfg.DNS64Prefix = getEnvWithDefault("DNS64_PREFIX", cfg.DNS64Prefix)
+	cfg.MaxAnswers = int(getEnvUint32WithDefault("MAX_ANSWERS", uint32(cfg.MaxAnswers)))
+	cfg.ShuffleAnswers = getEnvBoolWithDefault("SHUFFLE_ANSWERS", cfg.ShuffleAnswers)
+
+	cfg.SOAMname = getEnvWithDefault("SOA_MNAME", cfg.SOAMname)
+	cfg.SOARname = getEnvWithDefault("SOA_RNAME", cfg.SOARname)
+	cfg.SOARefresh = getEnvUint32WithDefault("SOA_REFRESH", cfg.SOARefresh)
+	cfg.SOARetry = getEnvUint32WithDefault("SOA_RETRY", cfg.SOARetry)
+	cfg.SOAExpire = getEnvUint32WithDefault("SOA_EXPIRE", cfg.SOAExpire)
+	cfg.SOASerial = getEnvUint32WithDefault("SOA_SERIAL", cfg.SOASerial)
+	cfg.NSAddrs = getEnvListWithDefault("NS_ADDRS", cfg.NSAddrs)
+
+	cfg.AllowCIDRs = getEnvListWithDefault("ALLOW_CIDRS", cfg.AllowCIDRs)
+	cfg.RateLimit = getEnvUint32WithDefault("RATE_LIMIT", cfg.RateLimit)
+	cfg.RateBurst = getEnvUint32WithDefault("RATE_BURST", cfg.RateBurst)
+	cfg.RateLimitAction = getEnvWithDefault("RATE_LIMIT_ACTION", cfg.RateLimitAction)
+
+	cfg.StripDO = getEnvBoolWithDefault("STRIP_DO", cfg.StripDO)
+	cfg.ECSMode = getEnvWithDefault("ECS_MODE", cfg.ECSMode)
+	cfg.ECSPrefixV4 = getEnvUint32WithDefault("ECS_PREFIX_V4", cfg.ECSPrefixV4)
+	cfg.ECSPrefixV6 = getEnvUint32WithDefault("ECS_PREFIX_V6", cfg.ECSPrefixV6)
+
+	cfg.BalanceMode = getEnvWithDefault("BALANCE_MODE", cfg.BalanceMode)
+	cfg.UpstreamTimeout = getEnvDurationWithDefault("UPSTREAM_TIMEOUT", cfg.UpstreamTimeout)
+	cfg.QueryTimeout = getEnvDurationWithDefault("QUERY_TIMEOUT", cfg.QueryTimeout)
+	cfg.UpstreamRetries = int(getEnvUint32WithDefault("UPSTREAM_RETRIES", uint32(cfg.UpstreamRetries)))
+	cfg.AutoTCP = getEnvBoolWithDefault("AUTO_TCP", cfg.AutoTCP)
+	cfg.TCPCooldown = getEnvDurationWithDefault("TCP_COOLDOWN", cfg.TCPCooldown)
+	cfg.BreakerThreshold = getEnvUint32WithDefault("BREAKER_THRESHOLD", cfg.BreakerThreshold)
+	cfg.BreakerCooldown = getEnvDurationWithDefault("BREAKER_COOLDOWN", cfg.BreakerCooldown)
+	cfg.CaseRandomization = getEnvBoolWithDefault("CASE_RANDOMIZATION", cfg.CaseRandomization)
+	cfg.MaxInflight = getEnvUint32WithDefault("MAX_INFLIGHT", cfg.MaxInflight)
+	cfg.InflightWait = getEnvDurationWithDefault("INFLIGHT_WAIT", cfg.InflightWait)
+	cfg.PoolMaxIdle = int(getEnvUint32WithDefault("UPSTREAM_POOL_MAX_IDLE", uint32(cfg.PoolMaxIdle)))
+	cfg.PoolIdleTimeout = getEnvDurationWithDefault("UPSTREAM_POOL_IDLE_TIMEOUT", cfg.PoolIdleTimeout)
+	cfg.UpstreamCAs = upstreamCAs
+	cfg.UpstreamBindAddrs = getEnvListWithDefault("UPSTREAM_BIND_ADDR", cfg.UpstreamBindAddrs)
+	cfg.UpstreamRD = getEnvWithDefault("UPSTREAM_RD", cfg.UpstreamRD)
+	cfg.CacheSize = int(getEnvUint32WithDefault("CACHE_SIZE", uint32(cfg.CacheSize)))
+	cfg.PrefetchThreshold = getEnvFloatWithDefault("PREFETCH_THRESHOLD", cfg.PrefetchThreshold)
+	cfg.ProbeInterval = getEnvDurationWithDefault("PROBE_INTERVAL", cfg.ProbeInterval)
+
+	// The env settings a SIGHUP reload puts the file config back on top of
+	envCfg := cfg
+
+	listenAddr := getEnvWithDefault("LISTEN_ADDR", ":53")
+	if fc != nil {
+		fc.Apply(&cfg)
+		if fc.ListenAddr != "" {
+			listenAddr = fc.ListenAddr
+		}
+	}
+	// Certificate for DoT, and for DoH when present
+	var serverTLS *tls.Config
+	if getEnvWithDefault("TLS_CERT", "") != "" || getEnvWithDefault("TLS_KEY", "") != "" {
+		serverTLS, err = loadServerTLSConfig(getEnvWithDefault("TLS_CERT", ""), getEnvWithDefault("TLS_KEY", ""))
+		if err != nil {
+			return fmt.Errorf("invalid TLS_CERT/TLS_KEY: %w", err)
+		}
+	}
+	if getEnvWithDefault("TLS_LISTEN_ADDR", "") != "" && serverTLS == nil {
+		return fmt.Errorf("TLS_LISTEN_ADDR requires TLS_CERT and TLS_KEY")
 	}
 
-	if len(req.Question) == 0 {
-		m := new(dns.Msg)
-		m.SetRcode(req, dns.RcodeServerFailure)
-		_ = w.WriteMsg(m)
-		return
+	if err := takeEnvFileErr(); err != nil {
+		return err
 	}
 
-	q := req.Question[0]
-	originalName := q.Name
-	normalizedName := strings.ToLower(originalName)
+	handler, err := dnsfwd.NewHandler(cfg)
+	if err != nil {
+		return err
+	}
 
-	zoneCfg, ok, isApex := h.selectZoneForName(normalizedName)
-	if !ok {
-		// Not in any allowed zone → NXDOMAIN + local SOA
-		m := new(dns.Msg)
-		m.SetRcode(req, dns.RcodeNameError)
-		m.Ns = append(m.Ns, h.createLocalSOA("invalid."))
-		_ = w.WriteMsg(m)
-		return
+	nets, err := listenNets(getEnvWithDefault("LISTEN_PROTO", "both"))
+	if err != nil {
+		return err
 	}
 
-	// Apex handling
-	if isApex {
-		m := new(dns.Msg)
-		m.SetRcode(req, dns.RcodeSuccess)
+	dnsServers, err := activatedDNSServers()
+	if err != nil {
+		return fmt.Errorf("socket activation: %w", err)
+	}
+	if dnsServers != nil {
+		var addrs []string
+		nets = nil
+		for _, server := range dnsServers {
+			addrs = append(addrs, server.Addr)
+			if !slices.Contains(nets, server.Net) {
+				nets = append(nets, server.Net)
+			}
+		}
+		listenAddr = strings.Join(addrs, ",") + " (systemd sockets)"
+	} else if dnsServers, err = newDNSServers(listenAddr, nets); err != nil {
+		return fmt.Errorf("invalid LISTEN_ADDR: %w", err)
+	}
 
-		if q.Qtype == dns.TypeSOA {
-			m.Answer = append(m.Answer, h.createLocalSOA(zoneCfg.Zone))
+	// One probe of every upstream before serving, also in validate mode
+	// so CI catches unreachable upstreams
+	if getEnvBoolWithDefault("STARTUP_PROBE", false) {
+		if err := handler.ProbeUpstreams(); err != nil {
+			if getEnvBoolWithDefault("STARTUP_PROBE_STRICT", false) {
+				return fmt.Errorf("startup probe failed: %w", err)
+			}
+			slog.Warn("startup probe failed", "error", err)
 		} else {
-			m.Ns = append(m.Ns, h.createLocalSOA(zoneCfg.Zone))
+			slog.Info("startup probe: every upstream answered")
 		}
-
-		_ = w.WriteMsg(m)
-		return
 	}
 
-	// Only A/AAAA allowed
-	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
-		m := new(dns.Msg)
-		m.SetRcode(req, dns.RcodeNameError)
-		m.Ns = append(m.Ns, h.createLocalSOA(zoneCfg.Zone))
-		_ = w.WriteMsg(m)
-		return
+	if validateOnly {
+		fmt.Printf("config OK: %d zone(s), listening on %s\n", len(zones), listenAddr)
+		handler.WriteZoneSummary(os.Stdout)
+		return nil
 	}
 
-	newName, err := h.rewriteQuery(normalizedName, zoneCfg)
+	flushTraces, err := setupTracing(ctx)
 	if err != nil {
-		m := new(dns.Msg)
-		m.SetRcode(req, dns.RcodeServerFailure)
-		_ = w.WriteMsg(m)
-		return
+		return err
+	}
+	// Flushed on the way out, after the listeners have shut down
+	defer func() {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer flushCancel()
+		if err := flushTraces(flushCtx); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
+	}()
+
+	// Registered before any listener starts, so a signal arriving as soon
+	// as queries are answered still shuts down cleanly
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	go handler.Run(ctx)
+
+	dns.Handle(".", handler)
+
+	// Shutdown hooks for every listener, DNS and HTTP alike. running counts
+	// the ones answering queries (DNS, DoT and DoH), health and metrics
+	// aside
+	var servers []func(context.Context) error
+	running := 0
+	errCh := make(chan listenerError, 8)
+	start := func(name string, queries bool, serve func() error, shutdown func(context.Context) error) {
+		servers = append(servers, shutdown)
+		if queries {
+			running++
+		}
+		go func() {
+			errCh <- listenerError{err: fmt.Errorf("%s: %w", name, serve()), queries: queries}
+		}()
 	}
 
-	resp, err := forwardQuery(req, newName, zoneCfg.Protocol, zoneCfg.Upstream)
-	if err != nil {
-		m := new(dns.Msg)
-		m.SetRcode(req, dns.RcodeServerFailure)
-		_ = w.WriteMsg(m)
-		return
+	for _, server := range dnsServers {
+		start(server.Net+"://"+server.Addr, true, func() error { return serveDNS(server) }, server.ShutdownContext)
 	}
 
-	// Replace upstream SOA on NXDOMAIN
-	if resp.Rcode == dns.RcodeNameError {
-		resp.Ns = []dns.RR{}
-		resp.Ns = append(resp.Ns, h.createLocalSOA(zoneCfg.Zone))
+	if addr := getEnvWithDefault("TLS_LISTEN_ADDR", ""); addr != "" {
+		server := &dns.Server{Addr: addr, Net: "tcp-tls", TLSConfig: serverTLS}
+		start("tls", true, server.ListenAndServe, server.ShutdownContext)
+		slog.Info("DNS-over-TLS server running", "addr", addr)
 	}
 
-	resp.SetReply(req)
+	if addr := getEnvWithDefault("DOH_LISTEN_ADDR", ""); addr != "" {
+		server := handler.NewDoHServer(addr)
+		serve := server.ListenAndServe
 
-	// Rewrite names and TTLs
-	for i, ans := range resp.Answer {
-		if strings.EqualFold(ans.Header().Name, newName) {
-			resp.Answer[i].Header().Name = originalName
-			resp.Answer[i].Header().Ttl = h.answerTTL
-		}
-	}
-	for i, ns := range resp.Ns {
-		if strings.EqualFold(ns.Header().Name, newName) {
-			resp.Ns[i].Header().Name = originalName
-			resp.Ns[i].Header().Ttl = h.answerTTL
+		// Without a certificate, serve plain HTTP for a TLS-terminating proxy
+		if serverTLS != nil {
+			server.TLSConfig = serverTLS
+			serve = func() error { return server.ListenAndServeTLS("", "") }
 		}
+
+		start("doh", true, serve, server.Shutdown)
+		slog.Info("DNS-over-HTTPS server running", "addr", addr, "tls", serverTLS != nil)
 	}
-	for i, extra := range resp.Extra {
-		if strings.EqualFold(extra.Header().Name, newName) {
-			resp.Extra[i].Header().Name = originalName
-			resp.Extra[i].Header().Ttl = h.answerTTL
-		}
+
+	dnsfwd.RegisterMetrics()
+	// /healthz lives next to /metrics unless it gets its own listener
+	healthz := handler.ServeHealth
+	if addr := getEnvWithDefault("HEALTH_ADDR", ""); addr != "" {
+		server := handler.NewHealthServer(addr)
+		start("health", false, server.ListenAndServe, server.Shutdown)
+		healthz = nil
 	}
 
-	_ = w.WriteMsg(resp)
-}
+	metricsServer := newMetricsServer(getEnvWithDefault("METRICS_ADDR", ":9153"), handler.ServeConfig, healthz)
+	start("metrics", false, metricsServer.ListenAndServe, metricsServer.Shutdown)
 
-// ---------------------------------------------
-// Main
-// ---------------------------------------------
+	slog.Info("DNS server running", "addr", listenAddr, "proto", strings.Join(nets, "+"), "zones", len(zones))
 
-func main() {
-	zones, err := parseZoneEnv(getEnvWithDefault("ZONES", ""))
-	if err != nil {
-		panic(err)
+	bestEffort := getEnvBoolWithDefault("BEST_EFFORT_LISTEN", false)
+
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				reloadZones(handler, envCfg)
+				continue
+			}
+
+			slog.Info("shutting down", "signal", sig.String())
+			cancel()
+			shutdownServers(servers)
+			return nil
+
+		case failed := <-errCh:
+			// Health and metrics going down is no reason to stop answering
+			if !failed.queries {
+				slog.Error("server failed, still answering queries", "error", failed.err)
+				continue
+			}
+			slog.Error("server failed", append([]any{"error", failed.err}, listenErrorHint(failed.err)...)...)
+
+			// Any query listener exiting brings the others down with it,
+			// unless BEST_EFFORT_LISTEN keeps going on whatever is left
+			if running--; bestEffort && running > 0 {
+				slog.Warn("continuing without the failed listener", "running", running)
+				continue
+			}
+			cancel()
+			shutdownServers(servers)
+			return errServerFailed
+		}
 	}
+}
 
-	handler := &DNSHandler{
-		zones:         zones,
-		defaultPrefix: getEnvWithDefault("DEFAULT_PREFIX", "systemd-"),
-		negativeTTL:   getEnvUint32WithDefault("NEGATIVE_TTL", 60),
-		answerTTL:     getEnvUint32WithDefault("ANSWER_TTL", 300),
-		listenAddr:    getEnvWithDefault("LISTEN_ADDR", ":53"),
+// listenerError is a listener's exit, queries telling the DNS, DoT and
+// DoH listeners from the health and metrics ones.
+type listenerError struct {
+	err     error
+	queries bool
+}
+
+// listenErrorHint returns log attributes explaining the usual reasons a
+// listener fails to start, or nil.
+func listenErrorHint(err error) []any {
+	switch {
+	case errors.Is(err, syscall.EACCES), errors.Is(err, os.ErrPermission):
+		return []any{"hint", "permission denied: ports below 1024 need root or CAP_NET_BIND_SERVICE"}
+	case errors.Is(err, syscall.EADDRINUSE):
+		return []any{"hint", "address already in use: is another DNS server (e.g. systemd-resolved) listening?"}
 	}
+	return nil
+}
 
-	dns.HandleFunc(".", handler.handleDNS)
-	server := &dns.Server{Addr: handler.listenAddr, Net: "udp"}
+// shutdownTimeout is how long in-flight queries get to finish on exit.
+const shutdownTimeout = 5 * time.Second
 
-	fmt.Printf("DNS server running on %s with %d zones\n", handler.listenAddr, len(zones))
+func shutdownServers(servers []func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-	if err := server.ListenAndServe(); err != nil {
-		fmt.Printf("Server failed: %v\n", err)
+	var wg sync.WaitGroup
+	for _, shutdown := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = shutdown(ctx)
+		}()
 	}
+	wg.Wait()
 }
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/totoCZ/dns_fwd/dnsfwd"
+)
+
+// TestActivationChild isn't a test of its own: TestActivatedDNSServers
+// runs the test binary with it as a socket-activated child, the passed
+// sockets at fd 3 on, and reads what it prints.
+func TestActivationChild(t *testing.T) {
+	if os.Getenv("DNS_FWD_ACTIVATION_CHILD") == "" {
+		return
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	servers, err := activatedDNSServers()
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	for _, server := range servers {
+		fmt.Println(server.Net, server.Addr, server.Listener != nil || server.PacketConn != nil)
+	}
+	fmt.Println("env", os.Getenv("LISTEN_PID") == "" && os.Getenv("LISTEN_FDS") == "")
+	os.Exit(0)
+}
+
+func TestActivatedDNSServers(t *testing.T) {
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	tcpFile, err := tcp.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpFile.Close()
+	udpFile, err := udp.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpFile.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationChild$")
+	cmd.Env = append(os.Environ(), "DNS_FWD_ACTIVATION_CHILD=1", "LISTEN_FDS=2")
+	cmd.ExtraFiles = []*os.File{tcpFile, udpFile} // fd 3 and 4
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child: %v\n%s", err, out)
+	}
+
+	got := strings.Split(strings.TrimSpace(string(out)), "\n")
+	sort.Strings(got)
+	want := []string{
+		"env true",
+		"tcp " + tcp.Addr().String() + " true",
+		"udp " + udp.LocalAddr().String() + " true",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("child printed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestActivatedDNSServersNotActivated(t *testing.T) {
+	// Sockets meant for another process, e.g. the parent's
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	t.Setenv("LISTEN_FDS", "2")
+
+	servers, err := activatedDNSServers()
+	if err != nil || servers != nil {
+		t.Errorf("activatedDNSServers() = %v, %v, want nil, nil", servers, err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to a temporary directory, returning their paths and a pool trusting it.
+func writeTestCert(t *testing.T) (certFile, keyFile string, roots *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns_fwd test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+// stubForwarder answers every upstream query with an A record for
+// 10.0.0.5, keeping the names it was asked.
+type stubForwarder struct {
+	names chan string
+}
+
+func (f stubForwarder) Forward(_ context.Context, m *dns.Msg, _ *dnsfwd.ZoneConfig, _, _ string) (*dns.Msg, error) {
+	f.names <- m.Question[0].Name
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+		A:   net.IPv4(10, 0, 0, 5),
+	})
+	return resp, nil
+}
+
+// newTestHandler builds a handler for one zone, pod.example., whose
+// upstream queries go to fwd, with configure applied to its Config.
+func newTestHandler(t *testing.T, fwd dnsfwd.Forwarder, configure ...func(*dnsfwd.Config)) *dnsfwd.DNSHandler {
+	t.Helper()
+
+	zones, err := dnsfwd.ParseZoneEnv("pod.example.=udp:10.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := dnsfwd.DefaultConfig()
+	cfg.Zones = zones
+	cfg.Forwarder = fwd
+	for _, f := range configure {
+		f(&cfg)
+	}
+	handler, err := dnsfwd.NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func TestDoTListener(t *testing.T) {
+	certFile, keyFile, roots := writeTestCert(t)
+	serverTLS, err := loadServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loadServerTLSConfig: %v", err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd := stubForwarder{names: make(chan string, 1)}
+	server := &dns.Server{Listener: l, Net: "tcp-tls", Handler: newTestHandler(t, fwd)}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	defer server.Shutdown()
+
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: roots}}
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	resp, _, err := client.Exchange(req, l.Addr().String())
+	if err != nil {
+		t.Fatalf("DoT exchange: %v", err)
+	}
+
+	if name := <-fwd.names; name != "systemd-web." {
+		t.Errorf("upstream query for %s, want systemd-web.", name)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "web.pod.example." {
+		t.Errorf("answer = %v, want web.pod.example.'s A record", resp.Answer)
+	}
+}
+
+func TestLoadServerTLSConfig(t *testing.T) {
+	certFile, keyFile, _ := writeTestCert(t)
+
+	for _, tt := range []struct{ cert, key string }{
+		{certFile, ""},
+		{"", keyFile},
+		{keyFile, certFile},
+		{filepath.Join(t.TempDir(), "missing.pem"), keyFile},
+	} {
+		if _, err := loadServerTLSConfig(tt.cert, tt.key); err == nil {
+			t.Errorf("loadServerTLSConfig(%q, %q) succeeded", tt.cert, tt.key)
+		}
+	}
+}
+
+func TestNewDNSServers(t *testing.T) {
+	servers, err := newDNSServers("127.0.0.1:53, [::1]:53,", []string{"udp", "tcp"})
+	if err != nil {
+		t.Fatalf("newDNSServers: %v", err)
+	}
+	var got []string
+	for _, server := range servers {
+		got = append(got, server.Net+" "+server.Addr)
+	}
+	want := []string{"udp 127.0.0.1:53", "tcp 127.0.0.1:53", "udp [::1]:53", "tcp [::1]:53"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("servers = %v, want %v", got, want)
+	}
+
+	for _, addr := range []string{"", " , ", "127.0.0.1", "127.0.0.1:53,::1"} {
+		if _, err := newDNSServers(addr, []string{"udp"}); err == nil {
+			t.Errorf("newDNSServers(%q) succeeded, want an error", addr)
+		}
+	}
+}
+
+// freePort returns a loopback address whose port was free for TCP a
+// moment ago, for servers listening on UDP and TCP alike.
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListenNets(t *testing.T) {
+	for proto, want := range map[string]string{"udp": "udp", "tcp": "tcp", "both": "udp,tcp"} {
+		nets, err := listenNets(proto)
+		if err != nil || strings.Join(nets, ",") != want {
+			t.Errorf("listenNets(%q) = %v, %v, want %s", proto, nets, err, want)
+		}
+	}
+	if _, err := listenNets("sctp"); err == nil {
+		t.Error(`listenNets("sctp") succeeded, want an error`)
+	}
+}
+
+func TestUDPAndTCPListeners(t *testing.T) {
+	addr := freePort(t)
+	servers, err := newDNSServers(addr, []string{"udp", "tcp"})
+	if err != nil {
+		t.Fatalf("newDNSServers: %v", err)
+	}
+	fwd := stubForwarder{names: make(chan string, 2)}
+	handler := newTestHandler(t, fwd)
+
+	var shutdowns []func(context.Context) error
+	for _, server := range servers {
+		started := make(chan struct{})
+		server.Handler = handler
+		server.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = serveDNS(server) }()
+		<-started
+		shutdowns = append(shutdowns, server.ShutdownContext)
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		req := new(dns.Msg)
+		req.SetQuestion(network+".pod.example.", dns.TypeA)
+		client := &dns.Client{Net: network, Timeout: time.Second}
+		resp, _, err := client.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("%s exchange: %v", network, err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != req.Question[0].Name {
+			t.Errorf("%s answer = %v, want %s's A record", network, resp.Answer, req.Question[0].Name)
+		}
+		if name := <-fwd.names; name != "systemd-"+network+"." {
+			t.Errorf("%s: upstream query for %s, want systemd-%s.", network, name, network)
+		}
+	}
+
+	// Both go down together
+	shutdownServers(shutdowns)
+	req := new(dns.Msg)
+	req.SetQuestion("web.pod.example.", dns.TypeA)
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network, Timeout: 200 * time.Millisecond}
+		if _, _, err := client.Exchange(req, addr); err == nil {
+			t.Errorf("%s exchange after shutdown succeeded", network)
+		}
+	}
+}
+
+func TestOutOfZoneIncludeSOA(t *testing.T) {
+	tests := []struct {
+		include   string
+		soa       string
+		wantOwner string
+	}{
+		{"", "", "invalid."},
+		{"true", "nxdomain.example.net.", "nxdomain.example.net."},
+		{"false", "", ""},
+		{"false", "nxdomain.example.net.", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("OUT_OF_ZONE_INCLUDE_SOA", tt.include)
+		t.Setenv("OUT_OF_ZONE_SOA", tt.soa)
+		handler := newTestHandler(t, stubForwarder{}, func(c *dnsfwd.Config) {
+			c.OutOfZoneSOA = getOutOfZoneSOA(c.OutOfZoneSOA)
+		})
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &dns.Server{PacketConn: pc, Handler: handler}
+		go func() { _ = server.ActivateAndServe() }()
+
+		req := new(dns.Msg)
+		req.SetQuestion("web.nowhere.net.", dns.TypeA)
+		resp, err := dns.Exchange(req, pc.LocalAddr().String())
+		_ = server.Shutdown()
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+
+		if resp.Rcode != dns.RcodeNameError {
+			t.Errorf("OUT_OF_ZONE_INCLUDE_SOA=%q: rcode = %s, want NXDOMAIN", tt.include, dns.RcodeToString[resp.Rcode])
+		}
+		var owner string
+		if len(resp.Ns) > 0 {
+			owner = resp.Ns[0].Header().Name
+		}
+		if len(resp.Ns) > 1 || owner != tt.wantOwner {
+			t.Errorf("OUT_OF_ZONE_INCLUDE_SOA=%q OUT_OF_ZONE_SOA=%q: authority = %v, want SOA %q", tt.include, tt.soa, resp.Ns, tt.wantOwner)
+		}
+	}
+}
+
+func TestRunBadZones(t *testing.T) {
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("LOG_LEVEL", "error")
+
+	tests := []struct{ zones, want string }{
+		{"pod.example.=udp:10.0.0.1:53,other.example.=udp", "invalid ZONES entry other.example.=udp: missing protocol"},
+		{"pod.example.", "invalid ZONES entry: pod.example."},
+		{"pod.example.=udp:10.0.0.1:53?ttl=5", "invalid ZONES entry pod.example.=udp:10.0.0.1:53?ttl=5: unknown option ttl"},
+	}
+	for _, tt := range tests {
+		t.Setenv("ZONES", tt.zones)
+		err := run(nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ZONES=%q: run() = %v, want an error containing %q", tt.zones, err, tt.want)
+		}
+	}
+}
+
+func TestRunShutsDownOnSignal(t *testing.T) {
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	upstream := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 30 IN A 10.0.0.5")
+		m.Answer = append(m.Answer, rr)
+		_ = w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = upstream.ListenAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = upstream.Shutdown() })
+
+	addr := freePort(t)
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("LOG_LEVEL", "error")
+	t.Setenv("ZONES", "pod.example.=udp:"+upstream.PacketConn.LocalAddr().String())
+	t.Setenv("LISTEN_ADDR", addr)
+	t.Setenv("LISTEN_PROTO", "udp")
+	t.Setenv("METRICS_ADDR", "127.0.0.1:0")
+
+	done := make(chan error, 1)
+	go func() { done <- run(nil) }()
+
+	client := &dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}
+	q := new(dns.Msg)
+	q.SetQuestion("web.pod.example.", dns.TypeA)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, _, err := client.Exchange(q, addr)
+		if err == nil && len(resp.Answer) == 1 {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("run() = %v before serving", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no answer from %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run() = %v after SIGTERM, want nil", err)
+		}
+	case <-time.After(shutdownTimeout + time.Second):
+		t.Fatal("run() didn't return after SIGTERM")
+	}
+
+	if _, _, err := client.Exchange(q, addr); err == nil {
+		t.Error("the listener still answers after shutdown")
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	dnsfwd.RegisterMetrics()
+	h := newTestHandler(t, &stubForwarder{names: make(chan string, 1)})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsServer := &dns.Server{PacketConn: pc, Handler: h}
+	started := make(chan struct{})
+	dnsServer.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = dnsServer.ActivateAndServe() }()
+	<-started
+	defer dnsServer.Shutdown()
+
+	q := new(dns.Msg)
+	q.SetQuestion("metrics.pod.example.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(q, pc.LocalAddr().String()); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+
+	server := newMetricsServer("127.0.0.1:0", h.ServeConfig, nil)
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: status %d", rec.Code)
+	}
+	for _, name := range []string{
+		"dns_fwd_queries_total",
+		`dns_fwd_responses_total{rcode="NOERROR"}`,
+		`dns_fwd_zone_queries_total{zone="pod.example."}`,
+		`dns_fwd_upstream_duration_seconds_count{zone="pod.example."}`,
+		"dns_fwd_cache_misses_total",
+	} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("/metrics lacks %s", name)
+		}
+	}
+
+	// /healthz is only there when handed one
+	rec = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /healthz without a handler: status %d, want 404", rec.Code)
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	path := filepath.Join(t.TempDir(), "dns_fwd.log")
+	t.Setenv("LOG_FILE", path)
+
+	tests := []struct {
+		format, level string
+		wantErr       bool
+		wantInfo      bool
+	}{
+		{"json", "info", false, true},
+		{"text", "warn", false, false},
+		{"xml", "info", true, false},
+		{"json", "loud", true, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("LOG_FORMAT", tt.format)
+		t.Setenv("LOG_LEVEL", tt.level)
+		err := setupLogging()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LOG_FORMAT=%s LOG_LEVEL=%s: err = %v, want error %v", tt.format, tt.level, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if got := slog.Default().Enabled(context.Background(), slog.LevelInfo); got != tt.wantInfo {
+			t.Errorf("LOG_LEVEL=%s: info enabled = %v, want %v", tt.level, got, tt.wantInfo)
+		}
+	}
+
+	// JSON lines land in LOG_FILE
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("LOG_LEVEL", "info")
+	if err := setupLogging(); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("query", "qname", "web.pod.example.")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"msg":"query","qname":"web.pod.example."`) {
+		t.Errorf("log file = %q, want a JSON query line", data)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	prevVersion, prevCommit, prevDate := version, commit, date
+	t.Cleanup(func() { version, commit, date = prevVersion, prevCommit, prevDate })
+	version, commit, date = "v1.2.3", "abc123", "2024-01-01T00:00:00Z"
+
+	server := newMetricsServer("127.0.0.1:0", http.NotFound, nil)
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || ct != "application/json" {
+		t.Fatalf("GET /version: status %d, content type %q", rec.Code, ct)
+	}
+	var got buildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /version: %v", err)
+	}
+	want := buildInfo{Version: "v1.2.3", Commit: "abc123", Date: "2024-01-01T00:00:00Z", GoVersion: runtime.Version()}
+	if got != want {
+		t.Errorf("GET /version = %+v, want %+v", got, want)
+	}
+
+	// --version prints the same and exits before any setup
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = run([]string{"--version"})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if err != nil {
+		t.Errorf("run(--version) = %v", err)
+	}
+	if line := "dns_fwd v1.2.3 (commit abc123, built 2024-01-01T00:00:00Z, " + runtime.Version() + ")\n"; string(out) != line {
+		t.Errorf("--version printed %q, want %q", out, line)
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zones")
+	if err := os.WriteFile(path, []byte("pod.example.=udp:10.0.0.1:53\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { takeEnvFileErr() })
+
+	tests := []struct {
+		name, value, file string
+		want              string
+		wantErr           bool
+	}{
+		{"file only", "", path, "pod.example.=udp:10.0.0.1:53", false},
+		{"both set, the file wins", "other.example.=udp:10.0.0.2:53", path, "pod.example.=udp:10.0.0.1:53", false},
+		{"value only", "other.example.=udp:10.0.0.2:53", "", "other.example.=udp:10.0.0.2:53", false},
+		{"missing file", "other.example.=udp:10.0.0.2:53", filepath.Join(t.TempDir(), "missing"), "other.example.=udp:10.0.0.2:53", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ZONES", tt.value)
+			t.Setenv("ZONES_FILE", tt.file)
+
+			if got := getEnvWithDefault("ZONES", ""); got != tt.want {
+				t.Errorf("ZONES = %q, want %q", got, tt.want)
+			}
+			err := takeEnvFileErr()
+			if tt.wantErr && (err == nil || !strings.Contains(err.Error(), "invalid ZONES_FILE")) {
+				t.Errorf("takeEnvFileErr() = %v, want invalid ZONES_FILE", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("takeEnvFileErr() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns_fwd.log")
+	r, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { r.file.Close() }()
+
+	line := strings.Repeat("x", 39) + "\n" // 40 bytes, two fit
+	write := func(n int) {
+		t.Helper()
+		for range n {
+			if _, err := r.Write([]byte(line)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+	sizes := func() []int64 {
+		var sizes []int64
+		for _, name := range []string{path, path + ".1", path + ".2", path + ".3"} {
+			info, err := os.Stat(name)
+			if err != nil {
+				sizes = append(sizes, -1)
+				continue
+			}
+			sizes = append(sizes, info.Size())
+		}
+		return sizes
+	}
+
+	write(2)
+	if got := fmt.Sprint(sizes()); got != "[80 -1 -1 -1]" {
+		t.Errorf("after 80 bytes: sizes %s, want no rotation", got)
+	}
+	write(1)
+	if got := fmt.Sprint(sizes()); got != "[40 80 -1 -1]" {
+		t.Errorf("past 100 bytes: sizes %s, want the full file moved to .1", got)
+	}
+	// Two more rotations: .1 shifts to .2, and the oldest beyond
+	// LOG_MAX_BACKUPS goes
+	write(4)
+	if got := fmt.Sprint(sizes()); got != "[40 80 80 -1]" {
+		t.Errorf("after three rotations: sizes %s, want two backups", got)
+	}
+
+	// Reopening picks up the current size
+	r.file.Close()
+	if r, err = openRotatingFile(path, 100, 2); err != nil {
+		t.Fatal(err)
+	}
+	write(2)
+	if got := fmt.Sprint(sizes()); got != "[40 80 80 -1]" {
+		t.Errorf("after reopening: sizes %s, want a rotation at the old size", got)
+	}
+}
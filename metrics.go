@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newMetricsServer serves /metrics, /version and the effective /config,
+// plus /healthz when healthz is set.
+func newMetricsServer(addr string, config, healthz http.HandlerFunc) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/version", serveVersion)
+	mux.HandleFunc("/config", config)
+	if healthz != nil {
+		mux.HandleFunc("/healthz", healthz)
+	}
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ---------------------------------------------
+// Log file with size-based rotation
+// LOG_FILE=/var/log/dns_fwd.log, LOG_MAX_SIZE_MB=100, LOG_MAX_BACKUPS=3
+//
+// Once a write would take the file past LOG_MAX_SIZE_MB it is renamed to
+// LOG_FILE.1, older backups shift to .2, .3, ... and the oldest beyond
+// LOG_MAX_BACKUPS is removed, logrotate style.
+// ---------------------------------------------
+
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // bytes, 0 never rotates
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating first when p would not fit. A single write
+// larger than the limit still goes out whole, into a fresh file.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %w", r.path, err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file out of the way and starts a new one. The
+// new file is opened even when shifting the backups failed, so logging
+// carries on.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	shiftErr := r.shiftBackups()
+	if err := r.open(); err != nil {
+		return err
+	}
+	return shiftErr
+}
+
+func (r *rotatingFile) shiftBackups() error {
+	if r.maxBackups == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	for i := r.maxBackups - 1; i > 0; i-- {
+		old := fmt.Sprintf("%s.%d", r.path, i)
+		if err := os.Rename(old, fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, r.path+".1")
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// ---------------------------------------------
+// TLS (DNS-over-TLS and DNS-over-HTTPS listeners)
+// ---------------------------------------------
+
+// loadServerTLSConfig loads the certificate served to DoT clients.
+func loadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both TLS_CERT and TLS_KEY are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
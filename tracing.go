@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ---------------------------------------------
+// Tracing
+// OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)
+// turns on OTLP/HTTP export of query spans; the exporter reads the other
+// standard OTEL_* variables itself, e.g. OTEL_EXPORTER_OTLP_HEADERS.
+// Without an endpoint spans are never recorded.
+// ---------------------------------------------
+
+// setupTracing installs the OTLP trace exporter when configured and
+// returns the func flushing it on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if getEnvWithDefault("OTEL_EXPORTER_OTLP_ENDPOINT", "") == "" && getEnvWithDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", "dns_fwd"),
+			attribute.String("service.version", currentBuild().Version),
+		),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// ---------------------------------------------
+// Build info, set at build time:
+//   go build -ldflags="-X main.version=v1.2.3 -X main.commit=abc123 -X main.date=2024-01-01T00:00:00Z"
+// ---------------------------------------------
+
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuild returns the ldflags build info, filling gaps from the VCS
+// stamp the go tool embeds when building from a checkout.
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			}
+		}
+	}
+
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.Date == "" {
+		b.Date = "unknown"
+	}
+	return b
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("dns_fwd %s (commit %s, built %s, %s)", b.Version, b.Commit, b.Date, b.GoVersion)
+}
+
+func serveVersion(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(currentBuild())
+}